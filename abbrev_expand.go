@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/stts-se/rec"
+)
+
+// Server side abbreviation expansion. Text is split into whitespace separated
+// words. An abbreviation matches one or more consecutive words, ignoring surrounding
+// punctuation, so that e.g. "(tst," is expanded into "(test,". Longer (multi-word)
+// abbreviations take precedence over shorter ones.
+//
+// Abbreviations written in lower case also match capitalised or upper case words,
+// in which case the expansion is capitalised or upper cased in the same way.
+
+const leadingPunct = "\"'([{«„“‘¿¡"
+const trailingPunct = "\"'.,;:!?)]}»”’…"
+
+type abbrevLookup struct {
+	exact    map[string]string
+	folded   map[string]string // lower case abbrevs only
+	maxWords int
+}
+
+func newAbbrevLookup(list []Abbrev) abbrevLookup {
+	res := abbrevLookup{exact: make(map[string]string), folded: make(map[string]string), maxWords: 1}
+	for _, a := range list {
+		words := strings.Fields(a.Abbrev)
+		if len(words) == 0 {
+			continue
+		}
+		k := strings.Join(words, " ")
+		res.exact[k] = a.Expansion
+		if strings.ToLower(k) == k {
+			res.folded[k] = a.Expansion
+		}
+		if len(words) > res.maxWords {
+			res.maxWords = len(words)
+		}
+	}
+	return res
+}
+
+// matchCase adapts the case of expansion to the (abbreviated) word s
+func matchCase(s, expansion string) string {
+	hasUpper, hasLower := false, false
+	for _, r := range s {
+		if unicode.IsUpper(r) {
+			hasUpper = true
+		}
+		if unicode.IsLower(r) {
+			hasLower = true
+		}
+	}
+	if hasUpper && !hasLower && utf8.RuneCountInString(s) > 1 {
+		return strings.ToUpper(expansion)
+	}
+	first, _ := utf8.DecodeRuneInString(s)
+	if unicode.IsUpper(first) {
+		r, n := utf8.DecodeRuneInString(expansion)
+		return string(unicode.ToUpper(r)) + expansion[n:]
+	}
+	return expansion
+}
+
+func (l abbrevLookup) lookup(s string) (string, bool) {
+	if exp, ok := l.exact[s]; ok {
+		return exp, true
+	}
+	if exp, ok := l.folded[strings.ToLower(s)]; ok {
+		return matchCase(s, exp), true
+	}
+	return "", false
+}
+
+// lookupWithPunct looks up s with and without surrounding punctuation. It returns the
+// matching abbreviation, its expansion, and the expansion with the punctuation restored.
+func (l abbrevLookup) lookupWithPunct(s string) (string, string, string, bool) {
+	if exp, ok := l.lookup(s); ok {
+		return s, exp, exp, true
+	}
+	core := strings.TrimLeft(s, leadingPunct)
+	lead := s[:len(s)-len(core)]
+	if core == "" {
+		return "", "", "", false
+	}
+	if exp, ok := l.lookup(core); ok {
+		return core, exp, lead + exp, true
+	}
+	core2 := strings.TrimRight(core, trailingPunct)
+	trail := core[len(core2):]
+	if core2 == "" || core2 == core {
+		return "", "", "", false
+	}
+	if exp, ok := l.lookup(core2); ok {
+		return core2, exp, lead + exp + trail, true
+	}
+	return "", "", "", false
+}
+
+type textToken struct {
+	text       string
+	start, end int // byte offsets
+}
+
+func tokeniseText(s string) []textToken {
+	res := []textToken{}
+	start := -1
+	for i, r := range s {
+		if unicode.IsSpace(r) {
+			if start >= 0 {
+				res = append(res, textToken{text: s[start:i], start: start, end: i})
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		res = append(res, textToken{text: s[start:], start: start, end: len(s)})
+	}
+	return res
+}
+
+// appliedExpansion describes an abbreviation expanded by expandText
+type appliedExpansion struct {
+	Abbrev    string `json:"abbrev"`
+	Expansion string `json:"expansion"`
+	Position  int    `json:"position"` // word index in the input text
+}
+
+// expandText expands all abbreviations in s. The whitespace between words is kept,
+// except inside multi-word abbreviations.
+func expandText(s string, l abbrevLookup) (string, []appliedExpansion) {
+	var res strings.Builder
+	applied := []appliedExpansion{}
+	tokens := tokeniseText(s)
+	prevEnd := 0
+	for i := 0; i < len(tokens); {
+		matched := false
+		for n := l.maxWords; n >= 1; n-- {
+			if i+n > len(tokens) {
+				continue
+			}
+			words := []string{}
+			for _, t := range tokens[i : i+n] {
+				words = append(words, t.text)
+			}
+			abbrev, exp, repl, ok := l.lookupWithPunct(strings.Join(words, " "))
+			if !ok {
+				continue
+			}
+			res.WriteString(s[prevEnd:tokens[i].start])
+			res.WriteString(repl)
+			applied = append(applied, appliedExpansion{Abbrev: abbrev, Expansion: exp, Position: i})
+			prevEnd = tokens[i+n-1].end
+			i += n
+			matched = true
+			break
+		}
+		if !matched {
+			res.WriteString(s[prevEnd:tokens[i].end])
+			prevEnd = tokens[i].end
+			i++
+		}
+	}
+	res.WriteString(s[prevEnd:])
+	return res.String(), applied
+}
+
+// expandAbbrevs expands s using the abbreviations that apply to the session, profile and language
+func expandAbbrevs(s, session, profile, lang string) (string, []appliedExpansion) {
+	abbrevMutex.RLock()
+	l := newAbbrevLookup(resolveAbbrevs(lookupScopes(session, profile, lang)))
+	abbrevMutex.RUnlock()
+	return expandText(s, l)
+}
+
+// ExpandObject holds a text to expand, along with the values that decide which abbreviations to use
+type ExpandObject struct {
+	SessionID string `json:"session_id"`
+	Language  string `json:"language"`
+	Profile   string `json:"profile"`
+	Text      string `json:"text"`
+}
+
+type expandResponse struct {
+	Text       string             `json:"text"`
+	Expansions []appliedExpansion `json:"expansions"`
+}
+
+// expandAbbrevsHandler expands the abbreviations in a text, posted as an ExpandObject,
+// or sent using the 'text', 'session', 'lang' and 'profile' URL parameters
+func expandAbbrevsHandler(w http.ResponseWriter, r *http.Request) {
+	eo := ExpandObject{}
+	if r.Method == "POST" {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			msg := fmt.Sprintf("failed to read request body : %v", err)
+			log.Println(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		err = json.Unmarshal(body, &eo)
+		if err != nil {
+			msg := fmt.Sprintf("failed to unmarshal incoming JSON : %v", err)
+			log.Println("[chromedictator] " + msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+	} else {
+		q := r.URL.Query()
+		eo = ExpandObject{SessionID: q.Get("session"), Language: q.Get("lang"), Profile: q.Get("profile"), Text: q.Get("text")}
+	}
+
+	var res expandResponse
+	res.Text, res.Expansions = expandAbbrevs(eo.Text, eo.SessionID, eo.Profile, eo.Language)
+
+	resJSON, err := rec.PrettyMarshal(res)
+	if err != nil {
+		msg := fmt.Sprintf("expandAbbrevs: failed to create JSON from struct : %v", err)
+		log.Print(msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s\n", string(resJSON))
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stts-se/rec"
+)
+
+// Append-only log of abbreviation changes, one JSON object per line
+var abbrevLogFilePath = path.Join(baseDir, "abbrevs.log")
+
+// abbrevChange is an entry in the abbreviation change log.
+// An empty OldExpansion means that the abbreviation was added, and an empty NewExpansion means that it was deleted.
+type abbrevChange struct {
+	ID           int64  `json:"id"`
+	Time         string `json:"time"`
+	User         string `json:"user"`
+	Action       string `json:"action"` // add, update or delete
+	Via          string `json:"via"`    // api, import, file or rollback
+	Scope        string `json:"scope"`
+	Abbrev       string `json:"abbrev"`
+	OldExpansion string `json:"old_expansion,omitempty"`
+	NewExpansion string `json:"new_expansion,omitempty"`
+	RollbackOf   int64  `json:"rollback_of,omitempty"`
+}
+
+var abbrevLog = []abbrevChange{}
+var abbrevLogMutex = &sync.Mutex{}
+
+func newAbbrevChange(scope abbrevScope, abbrev, oldExpansion, newExpansion string) abbrevChange {
+	action := "update"
+	if oldExpansion == "" {
+		action = "add"
+	} else if newExpansion == "" {
+		action = "delete"
+	}
+	return abbrevChange{Action: action, Scope: scope.String(), Abbrev: abbrev, OldExpansion: oldExpansion, NewExpansion: newExpansion}
+}
+
+// diffAbbrevs lists the changes needed to go from the old to the new abbreviations
+func diffAbbrevs(old, new map[abbrevScope]map[string]string) []abbrevChange {
+	res := []abbrevChange{}
+	for s, m := range new {
+		for _, k := range sortedKeys(m) {
+			if old[s][k] != m[k] {
+				res = append(res, newAbbrevChange(s, k, old[s][k], m[k]))
+			}
+		}
+	}
+	for s, m := range old {
+		for _, k := range sortedKeys(m) {
+			if _, ok := new[s][k]; !ok {
+				res = append(res, newAbbrevChange(s, k, m[k], ""))
+			}
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Scope < res[j].Scope })
+	return res
+}
+
+// requestUser returns the user responsible for a request, given by the 'user' URL parameter or the X-User header.
+// If neither is set, the client's IP address is used.
+func requestUser(r *http.Request) string {
+	if u := r.URL.Query().Get("user"); u != "" {
+		return u
+	}
+	if u := r.Header.Get("X-User"); u != "" {
+		return u
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+func loadAbbrevLog() error {
+	abbrevLogMutex.Lock()
+	defer abbrevLogMutex.Unlock()
+
+	// a crash while appending may have left an incomplete line
+	truncated, err := truncatePartialLine(abbrevLogFilePath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("loadAbbrevLog: failed to repair file: %v", err)
+	}
+	if truncated {
+		log.Printf("loadAbbrevLog: removed incomplete last line of %s", abbrevLogFilePath)
+	}
+
+	fh, err := os.Open(abbrevLogFilePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("loadAbbrevLog: failed to open file: %v", err)
+	}
+	defer fh.Close()
+
+	sc := bufio.NewScanner(fh)
+	n := 0
+	for sc.Scan() {
+		n++
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var c abbrevChange
+		err := json.Unmarshal(sc.Bytes(), &c)
+		if err != nil {
+			return fmt.Errorf("loadAbbrevLog: %s line %d: couldn't unmarshal JSON : %v", abbrevLogFilePath, n, err)
+		}
+		abbrevLog = append(abbrevLog, c)
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("loadAbbrevLog: failed to read file: %v", err)
+	}
+	return nil
+}
+
+// logAbbrevChanges sets id, time, user and via of the changes, and appends them to the change log
+func logAbbrevChanges(changes []abbrevChange, user, via string) ([]abbrevChange, error) {
+	abbrevLogMutex.Lock()
+	defer abbrevLogMutex.Unlock()
+
+	if len(changes) == 0 {
+		return changes, nil
+	}
+
+	fh, err := os.OpenFile(abbrevLogFilePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return changes, fmt.Errorf("logAbbrevChanges: failed to open file: %v", err)
+	}
+	defer fh.Close()
+
+	var nextID int64 = 1
+	if len(abbrevLog) > 0 {
+		nextID = abbrevLog[len(abbrevLog)-1].ID + 1
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	bw := bufio.NewWriter(fh)
+	for i := range changes {
+		changes[i].ID = nextID
+		changes[i].Time = now
+		changes[i].User = user
+		changes[i].Via = via
+		nextID++
+		j, err := json.Marshal(changes[i])
+		if err != nil {
+			return changes, fmt.Errorf("logAbbrevChanges: failed to marshal change : %v", err)
+		}
+		bw.Write(j)
+		bw.WriteString("\n")
+	}
+	err = bw.Flush()
+	if err == nil {
+		err = fh.Sync()
+	}
+	if err != nil {
+		return changes, fmt.Errorf("logAbbrevChanges: failed to write file: %v", err)
+	}
+	abbrevLog = append(abbrevLog, changes...)
+	return changes, nil
+}
+
+// abbrevHistory lists changes in the abbreviation log, newest first. The list can be filtered using
+// the 'scope' and 'abbrev' URL parameters, and the number of changes limited using 'limit'.
+func abbrevHistory(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var scope string
+	if q.Get("scope") != "" {
+		s, err := scopeParam(r)
+		if err != nil {
+			msg := fmt.Sprintf("abbrevHistory: %v", err)
+			log.Println(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		scope = s.String()
+	}
+	limit := -1
+	if q.Get("limit") != "" {
+		l, err := strconv.Atoi(q.Get("limit"))
+		if err != nil || l < 0 {
+			msg := fmt.Sprintf("abbrevHistory: invalid limit '%s'", q.Get("limit"))
+			log.Println(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		limit = l
+	}
+
+	res := []abbrevChange{}
+	abbrevLogMutex.Lock()
+	for i := len(abbrevLog) - 1; i >= 0 && (limit < 0 || len(res) < limit); i-- {
+		c := abbrevLog[i]
+		if scope != "" && c.Scope != scope {
+			continue
+		}
+		if q.Get("abbrev") != "" && c.Abbrev != q.Get("abbrev") {
+			continue
+		}
+		res = append(res, c)
+	}
+	abbrevLogMutex.Unlock()
+
+	resJSON, err := rec.PrettyMarshal(res)
+	if err != nil {
+		msg := fmt.Sprintf("abbrevHistory: failed to create JSON from struct : %v", err)
+		log.Print(msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s\n", string(resJSON))
+}
+
+// rollbackAbbrev reverts the change with the given id. The abbreviation must not have been changed
+// since, unless the URL parameter 'force' is set to true.
+func rollbackAbbrev(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		msg := fmt.Sprintf("rollbackAbbrev: invalid id '%s'", mux.Vars(r)["id"])
+		log.Println(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	var change abbrevChange
+	found := false
+	abbrevLogMutex.Lock()
+	for _, c := range abbrevLog {
+		if c.ID == id {
+			change = c
+			found = true
+			break
+		}
+	}
+	abbrevLogMutex.Unlock()
+	if !found {
+		msg := fmt.Sprintf("rollbackAbbrev: no such change: %d", id)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusNotFound)
+		return
+	}
+
+	scope, err := parseAbbrevScope(change.Scope)
+	if err != nil {
+		msg := fmt.Sprintf("rollbackAbbrev: %v", err)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+
+	abbrevMutex.Lock()
+	current := abbrevs[scope][change.Abbrev]
+	if current == change.OldExpansion {
+		abbrevMutex.Unlock()
+		msg := fmt.Sprintf("rollbackAbbrev: abbreviation '%s' (%s) is already in its state before change %d", change.Abbrev, scope, id)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusConflict)
+		return
+	}
+	if current != change.NewExpansion && r.URL.Query().Get("force") != "true" {
+		abbrevMutex.Unlock()
+		msg := fmt.Sprintf("rollbackAbbrev: abbreviation '%s' (%s) has been changed since change %d (current expansion: '%s'). To roll back anyway, set force=true", change.Abbrev, scope, id, current)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusConflict)
+		return
+	}
+	if change.OldExpansion == "" {
+		delete(abbrevs[scope], change.Abbrev)
+	} else {
+		if _, ok := abbrevs[scope]; !ok {
+			abbrevs[scope] = make(map[string]string)
+		}
+		abbrevs[scope][change.Abbrev] = change.OldExpansion
+	}
+	err = persistAbbrevs()
+	abbrevMutex.Unlock()
+	if err != nil {
+		msg := fmt.Sprintf("rollbackAbbrev: failed to save abbrev map to file : %v", err)
+		log.Println(msg)
+		http.Error(w, "failed to save abbreviation(s)", http.StatusInternalServerError)
+		return
+	}
+
+	rb := newAbbrevChange(scope, change.Abbrev, current, change.OldExpansion)
+	rb.RollbackOf = id
+	_, err = logAbbrevChanges([]abbrevChange{rb}, requestUser(r), "rollback")
+	if err != nil {
+		msg := fmt.Sprintf("rollbackAbbrev: %v", err)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "rolled back change %d of abbbreviation '%s' (%s)\n", id, change.Abbrev, scope)
+}
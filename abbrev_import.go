@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/stts-se/rec"
+)
+
+// Bulk import and export of abbreviations, as CSV or TSV with two columns: abbreviation, expansion.
+// An optional header line (abbrev,expansion) is skipped on import.
+
+func abbrevFileFormat(r *http.Request) (string, error) {
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format == "" {
+		ct := r.Header.Get("Content-Type")
+		switch {
+		case strings.HasPrefix(ct, "text/csv"):
+			format = "csv"
+		default:
+			format = "tsv"
+		}
+	}
+	if format != "csv" && format != "tsv" {
+		return "", fmt.Errorf("unknown format '%s', expected csv or tsv", format)
+	}
+	return format, nil
+}
+
+// splitAbbrevLine splits a CSV or TSV line into fields. Since abbreviations cannot
+// contain newlines, each line is a separate record. Quoted fields are unquoted, as written by exportAbbrevs.
+func splitAbbrevLine(line string, format string) ([]string, error) {
+	cr := csv.NewReader(strings.NewReader(line))
+	cr.FieldsPerRecord = -1
+	if format == "tsv" {
+		cr.Comma = '\t'
+		// hand-written TSV may have quotes inside unquoted fields
+		cr.LazyQuotes = true
+	}
+	return cr.Read()
+}
+
+func exportAbbrevs(w http.ResponseWriter, r *http.Request) {
+	scope, err := scopeParam(r)
+	if err != nil {
+		msg := fmt.Sprintf("exportAbbrevs: %v", err)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	format, err := abbrevFileFormat(r)
+	if err != nil {
+		msg := fmt.Sprintf("exportAbbrevs: %v", err)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	if format == "tsv" {
+		cw.Comma = '\t'
+	}
+	cw.Write([]string{"abbrev", "expansion"})
+	abbrevMutex.RLock()
+	for _, k := range sortedKeys(abbrevs[scope]) {
+		cw.Write([]string{k, abbrevs[scope][k]})
+	}
+	abbrevMutex.RUnlock()
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		msg := fmt.Sprintf("exportAbbrevs: failed to write %s : %v", format, err)
+		log.Println(msg)
+		http.Error(w, "failed to export abbreviations", http.StatusInternalServerError)
+		return
+	}
+
+	fileName := strings.Replace(scope.String(), ":", "_", -1)
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/tab-separated-values; charset=utf-8")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"abbrevs_%s.%s\"", fileName, format))
+	w.Write(buf.Bytes())
+}
+
+type importIssue struct {
+	Line      int    `json:"line"`
+	Abbrev    string `json:"abbrev,omitempty"`
+	Expansion string `json:"expansion,omitempty"`
+	Message   string `json:"message"`
+}
+
+type abbrevConflict struct {
+	Abbrev       string `json:"abbrev"`
+	OldExpansion string `json:"old_expansion"`
+	NewExpansion string `json:"new_expansion"`
+}
+
+type importReport struct {
+	Scope      string           `json:"scope"`
+	Mode       string           `json:"mode"`
+	DryRun     bool             `json:"dry_run"`
+	Read       int              `json:"read"`
+	Added      int              `json:"added"`
+	Updated    int              `json:"updated"`
+	Unchanged  int              `json:"unchanged"`
+	Removed    int              `json:"removed"`
+	Duplicates []importIssue    `json:"duplicates"`
+	Conflicts  []abbrevConflict `json:"conflicts"`
+	Errors     []importIssue    `json:"errors"`
+	Message    string           `json:"message"`
+}
+
+// readAbbrevImport reads and validates abbreviations from CSV/TSV input.
+// Repeated abbreviations with the same expansion are reported as duplicates, and repeated
+// abbreviations with different expansions are reported as errors.
+func readAbbrevImport(r io.Reader, format string, report *importReport) map[string]string {
+	res := make(map[string]string)
+	lineOf := make(map[string]int)
+	sc := bufio.NewScanner(r)
+	n := 0
+	for sc.Scan() {
+		n++
+		l := strings.TrimRight(sc.Text(), "\r")
+		if n == 1 {
+			// Spreadsheet programs like to add a byte order mark
+			l = strings.TrimPrefix(l, "\ufeff")
+		}
+		if strings.TrimSpace(l) == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		fs, err := splitAbbrevLine(l, format)
+		if err != nil {
+			report.Errors = append(report.Errors, importIssue{Line: n, Message: err.Error()})
+			continue
+		}
+		if len(fs) != 2 {
+			report.Errors = append(report.Errors, importIssue{Line: n, Message: fmt.Sprintf("expected 2 fields, found %d", len(fs))})
+			continue
+		}
+		abbrev := strings.TrimSpace(fs[0])
+		expansion := strings.TrimSpace(fs[1])
+		if report.Read == 0 && len(report.Errors) == 0 && strings.EqualFold(abbrev, "abbrev") && strings.EqualFold(expansion, "expansion") {
+			// header
+			continue
+		}
+		report.Read++
+		if err := validateAbbrev(abbrev, expansion); err != nil {
+			report.Errors = append(report.Errors, importIssue{Line: n, Abbrev: abbrev, Expansion: expansion, Message: err.Error()})
+			continue
+		}
+		if prev, ok := res[abbrev]; ok {
+			if prev == expansion {
+				report.Duplicates = append(report.Duplicates, importIssue{Line: n, Abbrev: abbrev, Expansion: expansion, Message: fmt.Sprintf("duplicate of line %d", lineOf[abbrev])})
+			} else {
+				report.Errors = append(report.Errors, importIssue{Line: n, Abbrev: abbrev, Expansion: expansion, Message: fmt.Sprintf("conflicts with line %d: '%s'", lineOf[abbrev], prev)})
+			}
+			continue
+		}
+		res[abbrev] = expansion
+		lineOf[abbrev] = n
+	}
+	if err := sc.Err(); err != nil {
+		report.Errors = append(report.Errors, importIssue{Line: n, Message: fmt.Sprintf("failed to read input : %v", err)})
+	}
+	return res
+}
+
+// importAbbrevs reads CSV or TSV from the request body into the scope given by the 'scope' URL parameter.
+// With mode=merge (default), imported abbreviations are added to the scope, replacing existing ones with different expansions
+// (reported as conflicts). With mode=replace, the scope will contain the imported abbreviations only.
+// If the input contains errors, nothing is saved. With dry_run=true, the report is returned without saving anything.
+func importAbbrevs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	scope, err := scopeParam(r)
+	if err != nil {
+		msg := fmt.Sprintf("importAbbrevs: %v", err)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	format, err := abbrevFileFormat(r)
+	if err != nil {
+		msg := fmt.Sprintf("importAbbrevs: %v", err)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	mode := q.Get("mode")
+	if mode == "" {
+		mode = "merge"
+	}
+	if mode != "merge" && mode != "replace" {
+		msg := fmt.Sprintf("importAbbrevs: unknown mode '%s', expected merge or replace", mode)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	report := importReport{
+		Scope:      scope.String(),
+		Mode:       mode,
+		DryRun:     q.Get("dry_run") == "true",
+		Duplicates: []importIssue{},
+		Conflicts:  []abbrevConflict{},
+		Errors:     []importIssue{},
+	}
+	imported := readAbbrevImport(r.Body, format, &report)
+
+	status := http.StatusOK
+	switch {
+	case len(report.Errors) > 0:
+		status = http.StatusBadRequest
+		report.Message = fmt.Sprintf("found %d error(s), nothing saved", len(report.Errors))
+	case len(imported) == 0 && mode == "replace":
+		status = http.StatusBadRequest
+		report.Message = "no abbreviations found in input, nothing saved"
+	}
+
+	abbrevMutex.Lock()
+	old := abbrevs[scope]
+	for _, k := range sortedKeys(imported) {
+		v := imported[k]
+		prev, ok := old[k]
+		switch {
+		case !ok:
+			report.Added++
+		case prev == v:
+			report.Unchanged++
+		default:
+			report.Updated++
+			report.Conflicts = append(report.Conflicts, abbrevConflict{Abbrev: k, OldExpansion: prev, NewExpansion: v})
+		}
+	}
+	if mode == "replace" {
+		for k := range old {
+			if _, ok := imported[k]; !ok {
+				report.Removed++
+			}
+		}
+	}
+	save := status == http.StatusOK && !report.DryRun
+	var changes []abbrevChange
+	if save {
+		m := make(map[string]string)
+		if mode == "merge" {
+			for k, v := range old {
+				m[k] = v
+			}
+		}
+		for k, v := range imported {
+			m[k] = v
+		}
+		changes = diffAbbrevs(map[abbrevScope]map[string]string{scope: old}, map[abbrevScope]map[string]string{scope: m})
+		abbrevs[scope] = m
+		err = persistAbbrevs()
+	}
+	abbrevMutex.Unlock()
+
+	if save {
+		if err != nil {
+			msg := fmt.Sprintf("importAbbrevs: failed to save abbrev map to file : %v", err)
+			log.Println(msg)
+			http.Error(w, "failed to save abbreviation(s)", http.StatusInternalServerError)
+			return
+		}
+		_, err = logAbbrevChanges(changes, requestUser(r), "import")
+		if err != nil {
+			msg := fmt.Sprintf("importAbbrevs: %v", err)
+			log.Println(msg)
+			http.Error(w, msg, http.StatusInternalServerError)
+			return
+		}
+		report.Message = fmt.Sprintf("imported %d abbreviation(s) into %s", len(imported), scope)
+		log.Println(report.Message)
+	} else if report.DryRun && status == http.StatusOK {
+		report.Message = "dry run, nothing saved"
+	}
+
+	resJSON, err := rec.PrettyMarshal(report)
+	if err != nil {
+		msg := fmt.Sprintf("importAbbrevs: failed to create JSON from struct : %v", err)
+		log.Print(msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s\n", string(resJSON))
+}
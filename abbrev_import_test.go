@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAbbrevExportImportRoundTrip(t *testing.T) {
+	scope := abbrevScope{kind: "profile", name: "test_export"}
+	m := map[string]string{
+		"a":       "b",
+		`"q"`:     `say "hi"`,
+		`a"b`:     "x",
+		"c":       `"quoted"`,
+		"d":       "a  b",
+		"e":       `" padded "`,
+		"f, g":    "h; i",
+		"ö":       "å ä",
+		"a #":     "[x]",
+		"trail\"": "\"lead",
+	}
+	abbrevMutex.Lock()
+	abbrevs[scope] = m
+	abbrevMutex.Unlock()
+	defer func() {
+		abbrevMutex.Lock()
+		delete(abbrevs, scope)
+		abbrevMutex.Unlock()
+	}()
+
+	for _, format := range []string{"tsv", "csv"} {
+		w := httptest.NewRecorder()
+		exportAbbrevs(w, httptest.NewRequest("GET", "/abbrev/export?scope=profile:test_export&format="+format, nil))
+		if w.Code != 200 {
+			t.Fatalf("%s: export failed: %d %s", format, w.Code, w.Body.String())
+		}
+		var report importReport
+		res := readAbbrevImport(w.Body, format, &report)
+		if len(report.Errors) > 0 {
+			t.Errorf("%s: import errors: %+v", format, report.Errors)
+		}
+		if !reflect.DeepEqual(res, m) {
+			t.Errorf("%s: expected %v, got %v", format, m, res)
+		}
+	}
+}
+
+func TestReadAbbrevImport(t *testing.T) {
+	// the fields are trimmed, quoted or not, and quotes inside unquoted fields are kept
+	input := strings.Join([]string{
+		"abbrev\texpansion",
+		`" a "` + "\t" + `"  b  "`,
+		"  c  \t  d  ",
+		`e"f` + "\t" + `g "h"`,
+		`"i` + "\t" + "j",
+		"# comment",
+		"",
+	}, "\n")
+	var report importReport
+	res := readAbbrevImport(strings.NewReader(input), "tsv", &report)
+	expect := map[string]string{"a": "b", "c": "d", `e"f`: `g "h"`}
+	if !reflect.DeepEqual(res, expect) {
+		t.Errorf("expected %v, got %v", expect, res)
+	}
+	// an unterminated quoted field takes the rest of the line
+	if len(report.Errors) != 1 || report.Errors[0].Line != 5 {
+		t.Errorf("expected an error on line 5, got %+v", report.Errors)
+	}
+}
@@ -0,0 +1,569 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The abbreviation file is a plain text file, one abbreviation per line:
+//
+//	<abbreviation> TAB <expansion>
+//
+// Abbreviations at the top of the file belong to the global set. A line
+// with a scope name in brackets starts a new set, e.g.:
+//
+//	[lang:sv-SE]
+//	[session:meeting_2019-03-01]
+//	[profile:medical]
+//
+// Empty lines and lines starting with '#' are ignored. The file may be edited
+// by hand while the server is running, since it is reloaded on change (see watchAbbrevFile).
+// The file is used by the default store (fsStore), while sqliteStore keeps the abbreviations in the database.
+var abbrevFilePath = path.Join(baseDir, "abbrevs.tsv")
+
+// Binary gob file used by earlier versions. If found at startup, it is converted
+// into abbrevFilePath and renamed to <name>.BAK.
+var legacyAbbrevFilePath = path.Join(baseDir, "abbrevs.gob")
+
+// abbrevScope names a set of abbreviations. The zero value is the global set.
+type abbrevScope struct {
+	kind string // "session", "profile", "lang", or "" for global
+	name string
+}
+
+var globalScope = abbrevScope{}
+
+var abbrevScopeKinds = []string{"session", "profile", "lang"}
+
+func (s abbrevScope) String() string {
+	if s.kind == "" {
+		return "global"
+	}
+	return s.kind + ":" + s.name
+}
+
+func parseAbbrevScope(s string) (abbrevScope, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "global" {
+		return globalScope, nil
+	}
+	fs := strings.SplitN(s, ":", 2)
+	if len(fs) != 2 || !contains(abbrevScopeKinds, fs[0]) {
+		return globalScope, fmt.Errorf("invalid abbreviation scope '%s', expected global or one of %s followed by ':<name>'", s, strings.Join(abbrevScopeKinds, ", "))
+	}
+	name := strings.TrimSpace(fs[1])
+	if name == "" {
+		return globalScope, fmt.Errorf("invalid abbreviation scope '%s': empty name", s)
+	}
+	if strings.ContainsAny(name, "\t\r\n[]") {
+		return globalScope, fmt.Errorf("invalid abbreviation scope '%s': illegal character in name", s)
+	}
+	return abbrevScope{kind: fs[0], name: name}, nil
+}
+
+// lookupScopes returns the scopes to look for abbreviations in, most specific first:
+// session, profile, language (e.g. sv-SE, then sv), global.
+// Empty arguments are skipped.
+func lookupScopes(session, profile, lang string) []abbrevScope {
+	res := []abbrevScope{}
+	if session != "" {
+		res = append(res, abbrevScope{kind: "session", name: session})
+	}
+	if profile != "" {
+		res = append(res, abbrevScope{kind: "profile", name: profile})
+	}
+	if lang != "" {
+		res = append(res, abbrevScope{kind: "lang", name: lang})
+		if i := strings.Index(lang, "-"); i > 0 {
+			res = append(res, abbrevScope{kind: "lang", name: lang[:i]})
+		}
+	}
+	res = append(res, globalScope)
+	return res
+}
+
+// abbrevs holds one abbreviation map per scope
+var abbrevs = map[abbrevScope]map[string]string{globalScope: {}}
+var abbrevMutex = &sync.RWMutex{}
+
+// abbrevFileMutex guards the abbreviation file, and abbrevFileModTime,
+// which is used to tell our own writes from manual edits
+var abbrevFileMutex = &sync.Mutex{}
+var abbrevFileModTime time.Time
+
+// resolveAbbrevs returns the abbreviations of the scopes, each abbreviation taken from the
+// first scope in which it is found. Should be called with abbrevMutex locked.
+func resolveAbbrevs(scopes []abbrevScope) []Abbrev {
+	res := []Abbrev{}
+	seen := make(map[string]bool)
+	for _, s := range scopes {
+		for k, v := range abbrevs[s] {
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			res = append(res, Abbrev{Abbrev: k, Expansion: v, Scope: s.String()})
+		}
+	}
+	//Sort abbreviations alphabetically-ish
+	sort.Slice(res, func(i, j int) bool { return res[i].Abbrev < res[j].Abbrev })
+	return res
+}
+
+// persistAbbrevs saves the abbreviations. Should be called with abbrevMutex locked (for writing), so that concurrent
+// changes are saved in the order they were made.
+func persistAbbrevs() error {
+	return store.SaveAbbrevs(abbrevs)
+}
+
+func validateAbbrev(abbrev, expansion string) error {
+	if strings.TrimSpace(abbrev) == "" {
+		return fmt.Errorf("empty abbreviation")
+	}
+	if strings.TrimSpace(expansion) == "" {
+		return fmt.Errorf("empty expansion for abbreviation '%s'", abbrev)
+	}
+	if strings.ContainsAny(abbrev, "\t\r\n") || strings.ContainsAny(expansion, "\t\r\n") {
+		return fmt.Errorf("abbreviation '%s' contains tab or newline", abbrev)
+	}
+	if strings.HasPrefix(abbrev, "#") {
+		return fmt.Errorf("abbreviation '%s' cannot start with '#'", abbrev)
+	}
+	// would be read as a scope header in the abbreviation file
+	if strings.HasPrefix(strings.TrimSpace(abbrev), "[") {
+		return fmt.Errorf("abbreviation '%s' cannot start with '['", abbrev)
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	res := []string{}
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func abbrevs2TSVFile(m map[abbrevScope]map[string]string, fName string) error {
+
+	abbrevFileMutex.Lock()
+	defer abbrevFileMutex.Unlock()
+
+	scopes := []abbrevScope{}
+	for s := range m {
+		if s != globalScope {
+			scopes = append(scopes, s)
+		}
+	}
+	sort.Slice(scopes, func(i, j int) bool { return scopes[i].String() < scopes[j].String() })
+
+	err := writeAtomic(fName, 0644, func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		fmt.Fprintf(bw, "# abbreviation\texpansion\n")
+		for _, k := range sortedKeys(m[globalScope]) {
+			fmt.Fprintf(bw, "%s\t%s\n", k, m[globalScope][k])
+		}
+		for _, s := range scopes {
+			if len(m[s]) == 0 {
+				continue
+			}
+			fmt.Fprintf(bw, "\n[%s]\n", s)
+			for _, k := range sortedKeys(m[s]) {
+				fmt.Fprintf(bw, "%s\t%s\n", k, m[s][k])
+			}
+		}
+		return bw.Flush()
+	})
+	if err != nil {
+		return fmt.Errorf("abbrevs2TSVFile: failed to write file: %v", err)
+	}
+
+	if fi, err := os.Stat(fName); err == nil {
+		abbrevFileModTime = fi.ModTime()
+	}
+
+	return nil
+}
+
+func tsvFile2Abbrevs(fName string) (map[abbrevScope]map[string]string, error) {
+
+	abbrevFileMutex.Lock()
+	defer abbrevFileMutex.Unlock()
+
+	fh, err := os.Open(fName)
+	if err != nil {
+		return nil, fmt.Errorf("tsvFile2Abbrevs: failed to open file: %v", err)
+	}
+	defer fh.Close()
+
+	res := map[abbrevScope]map[string]string{globalScope: {}}
+	scope := globalScope
+	sc := bufio.NewScanner(fh)
+	n := 0
+	for sc.Scan() {
+		n++
+		l := strings.TrimRight(sc.Text(), "\r")
+		if strings.TrimSpace(l) == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		if t := strings.TrimSpace(l); strings.HasPrefix(t, "[") && strings.HasSuffix(t, "]") {
+			scope, err = parseAbbrevScope(strings.TrimSuffix(strings.TrimPrefix(t, "["), "]"))
+			if err != nil {
+				return nil, fmt.Errorf("tsvFile2Abbrevs: %s line %d: %v", fName, n, err)
+			}
+			if _, ok := res[scope]; !ok {
+				res[scope] = make(map[string]string)
+			}
+			continue
+		}
+		fs := strings.SplitN(l, "\t", 2)
+		if len(fs) != 2 {
+			return nil, fmt.Errorf("tsvFile2Abbrevs: %s line %d: expected two tab separated fields, found '%s'", fName, n, l)
+		}
+		abbrev := strings.TrimSpace(fs[0])
+		expansion := strings.TrimSpace(fs[1])
+		if err := validateAbbrev(abbrev, expansion); err != nil {
+			return nil, fmt.Errorf("tsvFile2Abbrevs: %s line %d: %v", fName, n, err)
+		}
+		if _, ok := res[scope][abbrev]; ok {
+			log.Printf("tsvFile2Abbrevs: %s line %d: duplicate abbreviation '%s' in %s, using last", fName, n, abbrev, scope)
+		}
+		res[scope][abbrev] = expansion
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("tsvFile2Abbrevs: failed to read file: %v", err)
+	}
+
+	if fi, err := fh.Stat(); err == nil {
+		abbrevFileModTime = fi.ModTime()
+	}
+
+	return res, nil
+}
+
+func gobFile2Map(fName string) (map[string]string, error) {
+
+	fh, err := os.Open(fName)
+	if err != nil {
+		return nil, fmt.Errorf("gobFile2Map: failed to open file: %v", err)
+	}
+	defer fh.Close()
+
+	decoder := gob.NewDecoder(fh)
+	m := make(map[string]string)
+	err = decoder.Decode(&m)
+	if err != nil {
+		return nil, fmt.Errorf("gobFile2Map: gob decoding failed: %v", err)
+	}
+
+	return m, nil
+}
+
+// loadAbbrevs reads the saved abbreviations into the abbrevs map. If there
+// are none, a legacy gob file is converted, or a default set is saved.
+func loadAbbrevs() error {
+	m, err := store.Abbrevs()
+	if err == nil {
+		abbrevMutex.Lock()
+		abbrevs = m
+		abbrevMutex.Unlock()
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	if _, err := os.Stat(legacyAbbrevFilePath); !os.IsNotExist(err) {
+		m, err := gobFile2Map(legacyAbbrevFilePath)
+		if err != nil {
+			return err
+		}
+		abbrevMutex.Lock()
+		abbrevs[globalScope] = m
+		err = persistAbbrevs()
+		abbrevMutex.Unlock()
+		if err != nil {
+			return err
+		}
+		bakPath := legacyAbbrevFilePath + ".BAK"
+		err = os.Rename(legacyAbbrevFilePath, bakPath)
+		if err != nil {
+			return fmt.Errorf("loadAbbrevs: failed to rename legacy abbrev file : %v", err)
+		}
+		log.Printf("converted %s (old file moved to %s)", legacyAbbrevFilePath, bakPath)
+		return nil
+	}
+
+	// no abbrev file exists, let's initialise one
+	abbrevMutex.Lock()
+	abbrevs[globalScope]["tst"] = "test"
+	abbrevs[globalScope]["tstn"] = "testing"
+	defer abbrevMutex.Unlock()
+	return persistAbbrevs()
+}
+
+// abbrevFileModified returns the modification time of the abbreviation file, and true if it has been modified since the
+// server last read or wrote it
+func abbrevFileModified() (time.Time, bool) {
+	fi, err := os.Stat(abbrevFilePath)
+	if err != nil {
+		return time.Time{}, false
+	}
+	abbrevFileMutex.Lock()
+	defer abbrevFileMutex.Unlock()
+	return fi.ModTime(), !fi.ModTime().Equal(abbrevFileModTime)
+}
+
+// watchAbbrevFile polls the abbreviation file, and reloads it if it has been modified by someone else.
+// If the modified file cannot be parsed, the error is logged, and the current abbreviations are kept.
+func watchAbbrevFile(interval time.Duration) {
+	for range time.Tick(interval) {
+		if _, modified := abbrevFileModified(); !modified {
+			continue
+		}
+		reloaded, changes, err := reloadAbbrevFile()
+		if err != nil {
+			log.Printf("watchAbbrevFile: failed to reload abbrev file : %v", err)
+			continue
+		}
+		if !reloaded {
+			continue
+		}
+		log.Printf("reloaded abbreviations from %s", abbrevFilePath)
+		_, err = logAbbrevChanges(changes, "unknown", "file")
+		if err != nil {
+			log.Printf("watchAbbrevFile: %v", err)
+		}
+	}
+}
+
+// reloadAbbrevFile reads the abbreviation file into the abbrevs map, if it has been modified since the server last
+// read or wrote it, and returns true along with the changes. The file is checked and read with abbrevMutex locked, so
+// that changes made through the API in the meantime are not overwritten.
+func reloadAbbrevFile() (bool, []abbrevChange, error) {
+	abbrevMutex.Lock()
+	defer abbrevMutex.Unlock()
+
+	modTime, modified := abbrevFileModified()
+	if !modified {
+		return false, nil, nil
+	}
+	m, err := tsvFile2Abbrevs(abbrevFilePath)
+	if err != nil {
+		// don't try again until the file has been modified again
+		abbrevFileMutex.Lock()
+		abbrevFileModTime = modTime
+		abbrevFileMutex.Unlock()
+		return false, nil, err
+	}
+	changes := diffAbbrevs(abbrevs, m)
+	abbrevs = m
+	return true, changes, nil
+}
+
+// scopeParam reads the optional 'scope' URL query parameter (global if not set)
+func scopeParam(r *http.Request) (abbrevScope, error) {
+	return parseAbbrevScope(r.URL.Query().Get("scope"))
+}
+
+// listAbbrevs lists the abbreviations of the scope given by the 'scope' URL parameter.
+// If instead any of the 'session', 'profile' or 'lang' parameters is set,
+// all abbreviations that apply are listed, looked up in the order given by lookupScopes.
+func listAbbrevs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var scopes []abbrevScope
+	if q.Get("session") != "" || q.Get("profile") != "" || q.Get("lang") != "" {
+		if q.Get("scope") != "" {
+			msg := "listAbbrevs: param 'scope' cannot be combined with 'session', 'profile' or 'lang'"
+			log.Println(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		scopes = lookupScopes(q.Get("session"), q.Get("profile"), q.Get("lang"))
+	} else {
+		scope, err := scopeParam(r)
+		if err != nil {
+			msg := fmt.Sprintf("listAbbrevs: %v", err)
+			log.Println(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		scopes = []abbrevScope{scope}
+	}
+
+	abbrevMutex.RLock()
+	res := resolveAbbrevs(scopes)
+	abbrevMutex.RUnlock()
+
+	resJSON, err := json.Marshal(res)
+	if err != nil {
+		msg := fmt.Sprintf("listAbbrevs: failed to marshal map of abbreviations : %v", err)
+		log.Println(msg)
+		http.Error(w, "failed to return list of abbreviations", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, string(resJSON))
+
+}
+
+// abbrevScopeCount is used to list the available abbreviation scopes
+type abbrevScopeCount struct {
+	Scope string `json:"scope"`
+	Count int    `json:"count"`
+}
+
+func listAbbrevScopes(w http.ResponseWriter, r *http.Request) {
+	res := []abbrevScopeCount{}
+
+	abbrevMutex.RLock()
+	for s, m := range abbrevs {
+		res = append(res, abbrevScopeCount{Scope: s.String(), Count: len(m)})
+	}
+	abbrevMutex.RUnlock()
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Scope < res[j].Scope })
+
+	resJSON, err := json.Marshal(res)
+	if err != nil {
+		msg := fmt.Sprintf("listAbbrevScopes: failed to marshal list of scopes : %v", err)
+		log.Println(msg)
+		http.Error(w, "failed to return list of abbreviation scopes", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, string(resJSON))
+}
+
+// addAbbrev adds a new abbreviation. If the abbreviation already exists in the scope, 409 Conflict is returned.
+func addAbbrev(w http.ResponseWriter, r *http.Request) {
+	setAbbrev(w, r, false)
+}
+
+// updateAbbrev changes the expansion of an existing abbreviation. If the abbreviation doesn't exist in the scope, 404 Not Found is returned.
+func updateAbbrev(w http.ResponseWriter, r *http.Request) {
+	setAbbrev(w, r, true)
+}
+
+func setAbbrev(w http.ResponseWriter, r *http.Request, update bool) {
+	params := mux.Vars(r)
+	abbrev := params["abbrev"]
+	expansion := params["expansion"]
+
+	scope, err := scopeParam(r)
+	if err != nil {
+		msg := fmt.Sprintf("setAbbrev: %v", err)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	if err := validateAbbrev(abbrev, expansion); err != nil {
+		msg := fmt.Sprintf("setAbbrev: %v", err)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	abbrevMutex.Lock()
+	old, exists := abbrevs[scope][abbrev]
+	if exists && !update {
+		abbrevMutex.Unlock()
+		msg := fmt.Sprintf("abbreviation '%s' already exists in %s: '%s'", abbrev, scope, old)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusConflict)
+		return
+	}
+	if !exists && update {
+		abbrevMutex.Unlock()
+		msg := fmt.Sprintf("no such abbreviation in %s: '%s'", scope, abbrev)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusNotFound)
+		return
+	}
+	if _, ok := abbrevs[scope]; !ok {
+		abbrevs[scope] = make(map[string]string)
+	}
+	abbrevs[scope][abbrev] = expansion
+	err = persistAbbrevs()
+	abbrevMutex.Unlock()
+	if err != nil {
+		msg := fmt.Sprintf("setAbbrev: failed to save abbrev map to file : %v", err)
+		log.Println(msg)
+		http.Error(w, "failed to save abbreviation(s)", http.StatusInternalServerError)
+		return
+	}
+
+	if old != expansion {
+		_, err = logAbbrevChanges([]abbrevChange{newAbbrevChange(scope, abbrev, old, expansion)}, requestUser(r), "api")
+		if err != nil {
+			msg := fmt.Sprintf("setAbbrev: %v", err)
+			log.Println(msg)
+			http.Error(w, msg, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	fmt.Fprintf(w, "saved abbbreviation '%s' '%s' (%s)\n", abbrev, expansion, scope)
+}
+
+// deleteAbbrev deletes an abbreviation. If the abbreviation doesn't exist in the scope, 404 Not Found is returned.
+func deleteAbbrev(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	abbrev := params["abbrev"]
+	//expansion := params["expansion"]
+
+	scope, err := scopeParam(r)
+	if err != nil {
+		msg := fmt.Sprintf("deleteAbbrev: %v", err)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	abbrevMutex.Lock()
+	old, exists := abbrevs[scope][abbrev]
+	if !exists {
+		abbrevMutex.Unlock()
+		msg := fmt.Sprintf("no such abbreviation in %s: '%s'", scope, abbrev)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusNotFound)
+		return
+	}
+	delete(abbrevs[scope], abbrev)
+	if scope != globalScope && len(abbrevs[scope]) == 0 {
+		delete(abbrevs, scope)
+	}
+	err = persistAbbrevs()
+	abbrevMutex.Unlock()
+	if err != nil {
+		msg := fmt.Sprintf("deleteAbbrev: failed to save abbrev map to file : %v", err)
+		log.Println(msg)
+		http.Error(w, "failed to save abbreviation(s)", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = logAbbrevChanges([]abbrevChange{newAbbrevChange(scope, abbrev, old, "")}, requestUser(r), "api")
+	if err != nil {
+		msg := fmt.Sprintf("deleteAbbrev: %v", err)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "deleted abbbreviation '%s' (%s)\n", abbrev, scope)
+}
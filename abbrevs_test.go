@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestValidateAbbrev(t *testing.T) {
+	invalid := []struct{ abbrev, expansion string }{
+		{"", "x"},
+		{"a", " "},
+		{"a\tb", "x"},
+		{"a", "x\ny"},
+		{"#a", "x"},
+		// would be read back as a scope header
+		{"[x", "y]"},
+		{" [x", "y]"},
+		{"[a]", "x"},
+	}
+	for _, test := range invalid {
+		if err := validateAbbrev(test.abbrev, test.expansion); err == nil {
+			t.Errorf("expected error for %q %q", test.abbrev, test.expansion)
+		}
+	}
+	for _, test := range []struct{ abbrev, expansion string }{{"a", "x"}, {"a#", "[x]"}, {"a[", "x]"}} {
+		if err := validateAbbrev(test.abbrev, test.expansion); err != nil {
+			t.Errorf("%q %q: %v", test.abbrev, test.expansion, err)
+		}
+	}
+}
+
+func TestAbbrevFileRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chromedictator_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fName := filepath.Join(dir, "abbrevs.tsv")
+
+	m := map[abbrevScope]map[string]string{
+		globalScope:                      {"tst": "test", "a[": "x]", "a#": "#x"},
+		{kind: "lang", name: "sv-SE"}:    {"tst": "testa"},
+		{kind: "session", name: "s 1"}:   {"mtg": "meeting"},
+		{kind: "profile", name: "med"}:   {"bp": "blood pressure"},
+		{kind: "profile", name: "empty"}: {},
+	}
+	err = abbrevs2TSVFile(m, fName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tsvFile2Abbrevs(fName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// empty scopes are not written
+	delete(m, abbrevScope{kind: "profile", name: "empty"})
+	if !reflect.DeepEqual(res, m) {
+		t.Errorf("expected %v, got %v", m, res)
+	}
+}
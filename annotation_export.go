@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Export of sessions to Praat TextGrid and ELAN EAF, with one tier for the recogniser text and one for the edited text
+
+// annotationInterval is a time interval of an annotation tier, in milliseconds
+type annotationInterval struct {
+	start int64
+	end   int64
+	text  string
+}
+
+// annotationTier builds non-overlapping intervals from the utterances (which should be sorted by start time), using
+// the given text function. If an utterance overlaps the next one, it is cut off where the next one starts. Utterances
+// starting at the same time are merged. Utterances without text or with invalid timecodes are skipped.
+func annotationTier(utts []sessionUtterance, text func(sessionUtterance) string) []annotationInterval {
+	res := []annotationInterval{}
+	for _, u := range utts {
+		t := strings.Join(strings.Fields(text(u)), " ")
+		if t == "" {
+			continue
+		}
+		if u.TimeCodeEnd <= u.TimeCodeStart || u.TimeCodeStart < 0 {
+			log.Printf("annotationTier: invalid timecodes for %s/%s: %d-%d, skipping", u.SessionID, u.Basename, u.TimeCodeStart, u.TimeCodeEnd)
+			continue
+		}
+		iv := annotationInterval{start: u.TimeCodeStart, end: u.TimeCodeEnd, text: t}
+		if n := len(res); n > 0 {
+			prev := &res[n-1]
+			if iv.start == prev.start {
+				if iv.end > prev.end {
+					prev.end = iv.end
+				}
+				prev.text = strings.TrimSpace(prev.text + " " + iv.text)
+				continue
+			}
+			if prev.end > iv.start {
+				prev.end = iv.start
+			}
+		}
+		res = append(res, iv)
+	}
+	return res
+}
+
+func recText(u sessionUtterance) string { return u.RecText }
+func ediText(u sessionUtterance) string { return u.EdiText }
+
+// annotationEnd returns the end time of the last utterance, in milliseconds
+func annotationEnd(utts []sessionUtterance) int64 {
+	var res int64
+	for _, u := range utts {
+		if u.TimeCodeEnd > res {
+			res = u.TimeCodeEnd
+		}
+	}
+	return res
+}
+
+// Praat TextGrid
+
+func textGridString(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+func textGridSeconds(ms int64) string {
+	return fmt.Sprintf("%.3f", float64(ms)/1000)
+}
+
+// fillTextGridTier fills the gaps between intervals with empty intervals, since
+// the intervals of a TextGrid interval tier must cover the whole TextGrid
+func fillTextGridTier(ivs []annotationInterval, end int64) []annotationInterval {
+	res := []annotationInterval{}
+	var t int64
+	for _, iv := range ivs {
+		if iv.start > t {
+			res = append(res, annotationInterval{start: t, end: iv.start})
+		}
+		res = append(res, iv)
+		t = iv.end
+	}
+	if t < end || len(res) == 0 {
+		res = append(res, annotationInterval{start: t, end: end})
+	}
+	return res
+}
+
+// writeTextGrid writes the utterances as a TextGrid (long text format), with the interval tiers 'recogniser' and 'edited'
+func writeTextGrid(w io.Writer, utts []sessionUtterance) error {
+	end := annotationEnd(utts)
+	tiers := []struct {
+		name      string
+		intervals []annotationInterval
+	}{
+		{"recogniser", fillTextGridTier(annotationTier(utts, recText), end)},
+		{"edited", fillTextGridTier(annotationTier(utts, ediText), end)},
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "File type = \"ooTextFile\"\nObject class = \"TextGrid\"\n\n")
+	fmt.Fprintf(bw, "xmin = 0\nxmax = %s\ntiers? <exists>\nsize = %d\nitem []:\n", textGridSeconds(end), len(tiers))
+	for i, tier := range tiers {
+		fmt.Fprintf(bw, "    item [%d]:\n", i+1)
+		fmt.Fprintf(bw, "        class = \"IntervalTier\"\n")
+		fmt.Fprintf(bw, "        name = %s\n", textGridString(tier.name))
+		fmt.Fprintf(bw, "        xmin = 0\n        xmax = %s\n", textGridSeconds(end))
+		fmt.Fprintf(bw, "        intervals: size = %d\n", len(tier.intervals))
+		for j, iv := range tier.intervals {
+			fmt.Fprintf(bw, "        intervals [%d]:\n", j+1)
+			fmt.Fprintf(bw, "            xmin = %s\n", textGridSeconds(iv.start))
+			fmt.Fprintf(bw, "            xmax = %s\n", textGridSeconds(iv.end))
+			fmt.Fprintf(bw, "            text = %s\n", textGridString(iv.text))
+		}
+	}
+	return bw.Flush()
+}
+
+// ELAN EAF
+
+type eafDocument struct {
+	XMLName         xml.Name            `xml:"ANNOTATION_DOCUMENT"`
+	Author          string              `xml:"AUTHOR,attr"`
+	Date            string              `xml:"DATE,attr"`
+	Format          string              `xml:"FORMAT,attr"`
+	Version         string              `xml:"VERSION,attr"`
+	XSI             string              `xml:"xmlns:xsi,attr"`
+	Schema          string              `xml:"xsi:noNamespaceSchemaLocation,attr"`
+	Header          eafHeader           `xml:"HEADER"`
+	TimeSlots       []eafTimeSlot       `xml:"TIME_ORDER>TIME_SLOT"`
+	Tiers           []eafTier           `xml:"TIER"`
+	LinguisticTypes []eafLinguisticType `xml:"LINGUISTIC_TYPE"`
+}
+
+type eafHeader struct {
+	MediaFile string               `xml:"MEDIA_FILE,attr"`
+	TimeUnits string               `xml:"TIME_UNITS,attr"`
+	Media     []eafMediaDescriptor `xml:"MEDIA_DESCRIPTOR"`
+}
+
+type eafMediaDescriptor struct {
+	MediaURL         string `xml:"MEDIA_URL,attr"`
+	MimeType         string `xml:"MIME_TYPE,attr"`
+	RelativeMediaURL string `xml:"RELATIVE_MEDIA_URL,attr,omitempty"`
+}
+
+type eafTimeSlot struct {
+	ID    string `xml:"TIME_SLOT_ID,attr"`
+	Value int64  `xml:"TIME_VALUE,attr"`
+}
+
+type eafTier struct {
+	ID                string          `xml:"TIER_ID,attr"`
+	LinguisticTypeRef string          `xml:"LINGUISTIC_TYPE_REF,attr"`
+	Annotations       []eafAnnotation `xml:"ANNOTATION"`
+}
+
+type eafAnnotation struct {
+	Alignable eafAlignableAnnotation `xml:"ALIGNABLE_ANNOTATION"`
+}
+
+type eafAlignableAnnotation struct {
+	ID       string `xml:"ANNOTATION_ID,attr"`
+	TimeRef1 string `xml:"TIME_SLOT_REF1,attr"`
+	TimeRef2 string `xml:"TIME_SLOT_REF2,attr"`
+	Value    string `xml:"ANNOTATION_VALUE"`
+}
+
+type eafLinguisticType struct {
+	ID                string `xml:"LINGUISTIC_TYPE_ID,attr"`
+	TimeAlignable     bool   `xml:"TIME_ALIGNABLE,attr"`
+	GraphicReferences bool   `xml:"GRAPHIC_REFERENCES,attr"`
+}
+
+// writeEAF writes the utterances as an ELAN annotation document, with the tiers 'recogniser' and 'edited'.
+// If mediaFile is set, it is referenced as the media file of the document: a URL, an absolute path (as a file:// URL), or a
+// path relative to the .eaf file.
+func writeEAF(w io.Writer, utts []sessionUtterance, mediaFile string) error {
+	doc := eafDocument{
+		Date:    time.Now().Format(time.RFC3339),
+		Format:  "3.0",
+		Version: "3.0",
+		XSI:     "http://www.w3.org/2001/XMLSchema-instance",
+		Schema:  "http://www.mpi.nl/tools/elan/EAFv3.0.xsd",
+		Header:  eafHeader{TimeUnits: "milliseconds"},
+		LinguisticTypes: []eafLinguisticType{
+			{ID: "default-lt", TimeAlignable: true},
+		},
+	}
+	if mediaFile != "" {
+		md := eafMediaDescriptor{MediaURL: mediaFile, MimeType: audioMimeType(mediaFile)}
+		switch {
+		case strings.Contains(mediaFile, "://"):
+		case strings.HasPrefix(mediaFile, "/"):
+			md.MediaURL = (&url.URL{Scheme: "file", Path: mediaFile}).String()
+		default:
+			// a relative path, which ELAN resolves relative to the .eaf file
+			rel := (&url.URL{Path: strings.TrimPrefix(mediaFile, "./")}).String()
+			md.MediaURL = rel
+			md.RelativeMediaURL = "./" + strings.TrimPrefix(rel, "./")
+		}
+		doc.Header.Media = append(doc.Header.Media, md)
+	}
+
+	tiers := []struct {
+		name      string
+		intervals []annotationInterval
+	}{
+		{"recogniser", annotationTier(utts, recText)},
+		{"edited", annotationTier(utts, ediText)},
+	}
+
+	// one time slot per distinct time value
+	slotValues := []int64{}
+	seen := make(map[int64]bool)
+	for _, tier := range tiers {
+		for _, iv := range tier.intervals {
+			for _, t := range []int64{iv.start, iv.end} {
+				if !seen[t] {
+					seen[t] = true
+					slotValues = append(slotValues, t)
+				}
+			}
+		}
+	}
+	sort.Slice(slotValues, func(i, j int) bool { return slotValues[i] < slotValues[j] })
+	slotIDs := make(map[int64]string)
+	for i, t := range slotValues {
+		id := fmt.Sprintf("ts%d", i+1)
+		slotIDs[t] = id
+		doc.TimeSlots = append(doc.TimeSlots, eafTimeSlot{ID: id, Value: t})
+	}
+
+	n := 0
+	for _, tier := range tiers {
+		t := eafTier{ID: tier.name, LinguisticTypeRef: "default-lt"}
+		for _, iv := range tier.intervals {
+			n++
+			t.Annotations = append(t.Annotations, eafAnnotation{eafAlignableAnnotation{
+				ID:       fmt.Sprintf("a%d", n),
+				TimeRef1: slotIDs[iv.start],
+				TimeRef2: slotIDs[iv.end],
+				Value:    iv.text,
+			}})
+		}
+		doc.Tiers = append(doc.Tiers, t)
+	}
+
+	bts, err := xml.MarshalIndent(doc, "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to create XML : %v", err)
+	}
+	_, err = fmt.Fprintf(w, "%s%s\n", xml.Header, bts)
+	return err
+}
+
+// exportSessionAnnotations returns a session as a Praat TextGrid or an ELAN .eaf file. For .eaf, the URL parameter
+// 'media' can be used to reference an audio file for the whole session (e.g. a concatenation of the session's audio files).
+func exportSessionAnnotations(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	format := vars["format"]
+	session, err := cleanSessionName(vars["session"])
+	if err != nil {
+		msg := fmt.Sprintf("exportSessionAnnotations: %v", err)
+		log.Print(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	utts, err := readSessionUtterances(session)
+	if err != nil {
+		msg := fmt.Sprintf("exportSessionAnnotations: %v", err)
+		log.Print(msg)
+		status := http.StatusInternalServerError
+		if !store.SessionExists(session) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, msg, status)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.%s\"", session, format))
+	if format == "eaf" {
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		err = writeEAF(w, utts, r.URL.Query().Get("media"))
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		err = writeTextGrid(w, utts)
+	}
+	if err != nil {
+		log.Printf("exportSessionAnnotations: failed to write %s : %v", format, err)
+	}
+}
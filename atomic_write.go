@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Crash safe writing of files. A file is written to a temporary file in the same folder, which is synced to disk and
+// renamed into place, so that a crash (or power failure) leaves either the old or the new file, never a partial one.
+// Temporary files end with tmpFileSuffix, so that they are not listed as session files, and left-over files are removed
+// at startup (see Store.Check).
+
+const tmpFileSuffix = ".tmp~"
+
+// writeFileAtomic is a crash safe version of ioutil.WriteFile
+func writeFileAtomic(fName string, data []byte, perm os.FileMode) error {
+	return writeAtomic(fName, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// copyFileAtomic writes the contents of r to a file, in a crash safe way
+func copyFileAtomic(fName string, r io.Reader, perm os.FileMode) error {
+	return writeAtomic(fName, perm, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
+
+// writeAtomic calls write with a temporary file, which replaces fName if there is no error
+func writeAtomic(fName string, perm os.FileMode, write func(io.Writer) error) error {
+	fh, err := ioutil.TempFile(filepath.Dir(fName), filepath.Base(fName)+".*"+tmpFileSuffix)
+	if err != nil {
+		return err
+	}
+	tmpFile := fh.Name()
+	err = write(fh)
+	if err == nil {
+		err = fh.Sync()
+	}
+	closeErr := fh.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpFile, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmpFile, fName)
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	syncDir(filepath.Dir(fName))
+	return nil
+}
+
+// renameAtomic moves a complete file (e.g. an uploaded file) into place, after syncing it to disk
+func renameAtomic(tmpFile, fName string) error {
+	err := syncFile(tmpFile)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpFile, fName)
+	if err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(fName))
+	return nil
+}
+
+func syncFile(fName string) error {
+	fh, err := os.OpenFile(fName, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	err = fh.Sync()
+	closeErr := fh.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// syncDir syncs a folder, so that a rename in it is on disk. This is not supported on all platforms (e.g. Windows),
+// so errors are ignored.
+func syncDir(dir string) {
+	fh, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	fh.Sync()
+	fh.Close()
+}
+
+// truncatePartialLine removes an incomplete last line (without newline) from a file that is only appended to, such
+// as a log file after a crash in the middle of a write. It returns true if the file was changed.
+func truncatePartialLine(fName string) (bool, error) {
+	data, err := ioutil.ReadFile(fName)
+	if err != nil || len(data) == 0 || bytes.HasSuffix(data, []byte("\n")) {
+		return false, err
+	}
+	return true, os.Truncate(fName, int64(bytes.LastIndexByte(data, '\n')+1))
+}
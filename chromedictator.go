@@ -1,38 +1,31 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/base64"
-	"encoding/gob"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
-	"sort"
-	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/stts-se/chromedictator/subtitle"
+	"github.com/stts-se/chromedictator/webm"
 	"github.com/stts-se/rec"
 )
 
-// TODO Hardwired GOB file should be changed to manually editable text file
-var abbrevFilePath = path.Join(baseDir, "abbrevs.gob")
-var abbrevs = make(map[string]string)
-var abbrevMutex = &sync.RWMutex{}
-
 // TODO Add  command line flag
 var baseDir = "audio_files" // This is where the session sub-dirs live
 
-var autosubCmd = "autosub"
-
 // for neater request param validation
 type param struct {
 	name  string
@@ -67,6 +60,7 @@ func requireParams(vars map[string]string, params ...*param) error {
 type Abbrev struct {
 	Abbrev    string `json:"abbrev"`
 	Expansion string `json:"expansion"`
+	Scope     string `json:"scope,omitempty"`
 }
 
 // SessionObject holds a session value
@@ -80,6 +74,19 @@ type TextObject struct {
 	FileName  string `json:"file_name"`
 	Data      string `json:"data"`
 	OverWrite bool   `json:"over_write"`
+
+	// ExpandAbbrevs: expand abbreviations in Data before saving, using the abbreviations for the session, profile and language
+	ExpandAbbrevs bool   `json:"expand_abbrevs,omitempty"`
+	Profile       string `json:"profile,omitempty"`
+
+	// Author and Comment: saved with the revision of an edited text (see revision). The default author is given by
+	// the user URL parameter or the X-User header (see requestUser).
+	Author  string `json:"author,omitempty"`
+	Comment string `json:"comment,omitempty"`
+
+	// BaseRevision: the revision of the edited text that the new text is based on. If the text has been changed since,
+	// the save is rejected (see checkTextVersion).
+	BaseRevision int `json:"base_revision,omitempty"`
 }
 
 // JSONObject holds values that can be used to produce a json file with a recording's metadata
@@ -97,6 +104,60 @@ type JSONObject struct {
 
 	// EndTime: end time in milliseconds, relative to session start
 	TimeCodeEnd int64 `json:"time_code_end"`
+
+	// Language: the recognition language (e.g. sv-SE)
+	Language string `json:"language,omitempty"`
+
+	// AudioInfo: properties of the audio file (set for WebM files only)
+	AudioInfo *AudioInfo `json:"audio_info,omitempty"`
+
+	// AudioSHA256: checksum of the audio file (hex encoded)
+	AudioSHA256 string `json:"audio_sha256,omitempty"`
+
+	// FileExtension: the extension of the uploaded audio file (e.g. webm), to tell it from converted versions
+	FileExtension string `json:"file_extension,omitempty"`
+}
+
+// AudioInfo holds the properties of an audio file, found by inspecting it
+type AudioInfo struct {
+	Codec      string `json:"codec"`
+	SampleRate int    `json:"sample_rate"`
+	Channels   int    `json:"channels"`
+	// Duration: the length of the audio in milliseconds
+	Duration int64 `json:"duration"`
+	// DurationMismatch: true if the length of the audio differs from time_code_end - time_code_start by more than durationTolerance
+	DurationMismatch bool `json:"duration_mismatch,omitempty"`
+}
+
+// max difference between the length of the audio and the length given by the time codes
+var durationTolerance = time.Second
+
+// inspectAudio checks that audio data in WebM format (by file extension or content) is valid, and returns its properties.
+// Other formats are not checked, and nil is returned.
+func inspectAudio(ext string, audio io.Reader, timeCodeStart, timeCodeEnd int64) (*AudioInfo, error) {
+	ext = strings.ToLower(ext)
+	br := bufio.NewReader(audio)
+	head, _ := br.Peek(4)
+	if !webm.IsEBML(head) && !strings.HasPrefix(ext, "webm") && !strings.HasPrefix(ext, "x-matroska") {
+		return nil, nil
+	}
+	info, err := webm.Inspect(br)
+	if err != nil {
+		return nil, fmt.Errorf("invalid WebM audio : %v", err)
+	}
+	res := &AudioInfo{
+		Codec:      info.Codec,
+		SampleRate: int(info.SampleRate),
+		Channels:   info.Channels,
+		Duration:   int64(info.Duration / time.Millisecond),
+	}
+	if timeCodeEnd > 0 {
+		diff := time.Duration(res.Duration-(timeCodeEnd-timeCodeStart)) * time.Millisecond
+		if diff > durationTolerance || diff < -durationTolerance {
+			res.DurationMismatch = true
+		}
+	}
+	return res, nil
 }
 
 // AudioObject holds values that can be used to produce an audio file
@@ -122,14 +183,28 @@ type textResponse struct {
 	FileType string `json:"file_type"`
 	Text     string `json:"text"`
 	Message  string `json:"message"`
+	// Revision: the latest revision of an edited text. The ETag of the text is returned in the ETag header.
+	Revision int `json:"revision,omitempty"`
 }
 
 type srtUnit struct {
 	ID       int64  `json:"id"`
 	TimeCode string `json:"time_code"`
+	Start    int64  `json:"start"` // milliseconds
+	End      int64  `json:"end"`   // milliseconds
 	Text     string `json:"text"`
 }
 
+func newSrtUnit(id int64, c subtitle.Cue) srtUnit {
+	return srtUnit{
+		ID:       id,
+		TimeCode: c.Timing(),
+		Start:    int64(c.Start / time.Millisecond),
+		End:      int64(c.End / time.Millisecond),
+		Text:     c.Text(),
+	}
+}
+
 type srtResponse struct {
 	SessionObject
 	FileName string    `json:"file_name"`
@@ -142,64 +217,12 @@ type listResponse struct {
 	Result []string `json:"result"`
 }
 
-func persistAbbrevs() error {
-	return map2GobFile(abbrevs, abbrevFilePath)
-}
-
-func map2GobFile(m map[string]string, fName string) error {
-
-	abbrevMutex.Lock()
-	defer abbrevMutex.Unlock()
-
-	fh, err := os.OpenFile(fName, os.O_RDWR|os.O_CREATE, 0755)
-	if err != nil {
-		return fmt.Errorf("map2GobFile: failed to open file: %v", err)
-	}
-	defer fh.Close()
-
-	encoder := gob.NewEncoder(fh)
-	err = encoder.Encode(m)
-	if err != nil {
-		return fmt.Errorf("map2GobFile: gob encoding failed: %v", err)
-	}
-
-	return nil
-}
-
-func gobFile2Map(fName string) (map[string]string, error) {
-
-	abbrevMutex.Lock()
-	defer abbrevMutex.Unlock()
-
-	fh, err := os.Open(fName)
-	if err != nil {
-		return nil, fmt.Errorf("gobFile2Map: failed to open file: %v", err)
-	}
-	defer fh.Close()
-
-	decoder := gob.NewDecoder(fh)
-	m := make(map[string]string)
-	err = decoder.Decode(&m)
-	if err != nil {
-		return nil, fmt.Errorf("gobFile2Map: gob decoding failed: %v", err)
-	}
-
-	return m, nil
-}
-
 func listSessions(w http.ResponseWriter, r *http.Request) {
-	files, err := ioutil.ReadDir(baseDir)
+	res, err := store.Sessions()
 	if err != nil {
 		http.Error(w, fmt.Sprintf("couldnt' list sessions : %v", err), http.StatusInternalServerError)
 		return
 	}
-	res := []string{}
-	for _, f := range files {
-		if f.IsDir() {
-			res = append(res, f.Name())
-		}
-	}
-	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
 
 	resJSON, err := json.Marshal(res)
 	if err != nil {
@@ -219,9 +242,14 @@ func listFilenames(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "param 'session' is required", http.StatusInternalServerError)
 		return
 	}
+	session, err := cleanSessionName(session)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	if sessionExists(session) {
-		files, err := listFiles(path.Join(baseDir, session))
+	if store.SessionExists(session) {
+		files, err := store.Files(session)
 		if err != nil {
 			msg := fmt.Sprintf("listFilenames: couldn't list files : %v", err)
 			log.Println(msg)
@@ -252,36 +280,6 @@ func contains(s []string, e string) bool {
 	return false
 }
 
-func sessionExists(sessionName string) bool {
-	if _, err := os.Stat(path.Join(baseDir, sessionName)); os.IsNotExist(err) {
-		return false
-	}
-	return true
-}
-
-func listFiles(sessionDir string) ([]string, error) {
-	res := []string{}
-	files, err := ioutil.ReadDir(sessionDir)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return res, fmt.Errorf("no such session: %s", sessionDir)
-		}
-		return res, err
-	}
-	for _, f := range files {
-		fName := f.Name()
-		if strings.HasSuffix(fName, ".BAK") {
-			continue
-		}
-		if strings.HasSuffix(fName, "~") {
-			continue
-		}
-		res = append(res, fName)
-	}
-	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
-	return res, nil
-}
-
 func listBasenames(w http.ResponseWriter, r *http.Request) {
 	res := listResponse{}
 	params := mux.Vars(r)
@@ -290,8 +288,13 @@ func listBasenames(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "param 'session' is required", http.StatusInternalServerError)
 		return
 	}
-	if sessionExists(session) {
-		fNames, err := listFiles(path.Join(baseDir, session))
+	session, err := cleanSessionName(session)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if store.SessionExists(session) {
+		fNames, err := store.Files(session)
 		if err != nil {
 			msg := fmt.Sprintf("listBasenames: couldn't list files : %v", err)
 			log.Println(msg)
@@ -318,87 +321,28 @@ func listBasenames(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, string(resJSON))
 }
 
-func listAbbrevs(w http.ResponseWriter, r *http.Request) {
-	res := []Abbrev{}
-
-	abbrevMutex.RLock()
-	defer abbrevMutex.RUnlock()
-
-	for k, v := range abbrevs {
-		res = append(res, Abbrev{Abbrev: k, Expansion: v})
-	}
-
-	//Sort abbreviations alphabetically-ish
-	sort.Slice(res, func(i, j int) bool { return res[i].Abbrev < res[j].Abbrev })
-
-	resJSON, err := json.Marshal(res)
-	if err != nil {
-		msg := fmt.Sprintf("listAbbrevs: failed to marshal map of abbreviations : %v", err)
-		log.Println(msg)
-		http.Error(w, "failed to return list of abbreviations", http.StatusInternalServerError)
-		return
-	}
-
-	fmt.Fprintf(w, string(resJSON))
-
-}
-
-func addAbbrev(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	abbrev := params["abbrev"]
-	expansion := params["expansion"]
-
-	// TODO Error check that abbrev doesn't already exist in map
-	abbrevMutex.Lock()
-	abbrevs[abbrev] = expansion
-	abbrevMutex.Unlock() // Can't use defer here, since call below uses
-	// locking
-
-	// This could be done consurrently, but easier to catch errors this way
-	err := persistAbbrevs()
-	if err != nil {
-		msg := fmt.Sprintf("addAbbrev: failed to save abbrev map to gob file : %v", err)
-		log.Println(msg)
-		http.Error(w, "failed to save abbreviation(s)", http.StatusInternalServerError)
-		return
-	}
-
-	fmt.Fprintf(w, "saved abbbreviation '%s' '%s'\n", abbrev, expansion)
-}
-
-func deleteAbbrev(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	abbrev := params["abbrev"]
-	//expansion := params["expansion"]
-
-	// TODO Error check that abbrev doesn't already exist in map
-	abbrevMutex.Lock()
-	delete(abbrevs, abbrev)
-	abbrevMutex.Unlock() // Can't use defer here, since call below uses
-	// locking
-
-	// This could be done concurrently, but easier to catch errors this way
-	err := persistAbbrevs()
-	if err != nil {
-		msg := fmt.Sprintf("deleteAbbrev: failed to save abbrev map to gob file : %v", err)
-		log.Println(msg)
-		http.Error(w, "failed to save abbreviation(s)", http.StatusInternalServerError)
-		return
+// validate checks the fields of a text object, and normalises the session id and file name (see cleanName)
+func (to *TextObject) validate() []string {
+	res := to.cleanNames()
+	if to.Data == "" {
+		res = append(res, "missing data")
 	}
-
-	fmt.Fprintf(w, "deleted abbbreviation '%s'\n", abbrev)
+	return res
 }
 
-func (to TextObject) validate() []string {
+// cleanNames checks and normalises the session id and file name
+func (to *TextObject) cleanNames() []string {
 	var res []string
+	var err error
 	if to.SessionID == "" {
 		res = append(res, "missing session_id")
+	} else if to.SessionID, err = cleanSessionName(to.SessionID); err != nil {
+		res = append(res, err.Error())
 	}
 	if to.FileName == "" {
 		res = append(res, "missing file_name")
-	}
-	if to.Data == "" {
-		res = append(res, "missing data")
+	} else if to.FileName, err = cleanFileName(to.FileName); err != nil {
+		res = append(res, err.Error())
 	}
 	return res
 }
@@ -428,17 +372,24 @@ func (jo JSONObject) validate() []string {
 	return res
 }
 
-func (ao AudioObject) validate() []string {
+// validate checks the fields of an audio object, and normalises the session id, file name and file extension
+func (ao *AudioObject) validate() []string {
 	res := ao.TextObject.validate()
+	return append(res, ao.cleanFileExtension()...)
+}
+
+// cleanFileExtension checks and normalises the file extension (see cleanFileExtension)
+func (ao *AudioObject) cleanFileExtension() []string {
+	var res []string
+	var err error
 	if ao.FileExtension == "" {
 		res = append(res, "missing file_extension")
+	} else if ao.FileExtension, err = cleanFileExtension(ao.FileExtension); err != nil {
+		res = append(res, err.Error())
 	}
 	return res
 }
 
-// Let's lock everything when writing a file
-var writeMutex = &sync.Mutex{}
-
 func saveRecogniserText(w http.ResponseWriter, r *http.Request) {
 	saveText(w, r, "rec")
 }
@@ -485,75 +436,51 @@ func getRecogniserText(w http.ResponseWriter, r *http.Request) {
 	getText(w, r, "rec")
 }
 
-func readJSONFile(fileName string) (JSONObject, error) {
-	res := JSONObject{}
-	if _, err := os.Stat(fileName); os.IsNotExist(err) {
-		return res, fmt.Errorf("no such file: %s", fileName)
-	}
-	bytes, err := ioutil.ReadFile(fileName)
-	if err != nil {
-		return res, err
-	}
-	err = json.Unmarshal(bytes, &res)
-	if err != nil {
-		return res, fmt.Errorf("couldn't unmarshal JSON : %v", err)
-	}
-
-	return res, nil
-}
-
 func getText(w http.ResponseWriter, r *http.Request, defaultExt string) {
 	var res textResponse
-	vars := mux.Vars(r)
-	session := vars["session"]
-	fileName := vars["filename"]
-	if fileName == "" {
-		msg := "text: missing param 'filename'"
+	session, fileName, err := sessionFileVars(r)
+	if err != nil {
+		msg := fmt.Sprintf("text: %v", err)
 		log.Print(msg)
 		http.Error(w, msg, http.StatusBadRequest)
 		return
-
 	}
-	if session == "" {
-		msg := "text: missing param 'session'"
+
+	basename, version := splitFileName(fileName, defaultExt)
+	text, err := store.Text(session, basename, version)
+	if os.IsNotExist(err) {
+		res.Message = fmt.Sprintf("no such file: %s", fileName)
+	} else if err != nil {
+		msg := fmt.Sprintf("get_text: failed to read text file : %v", err)
 		log.Print(msg)
-		http.Error(w, msg, http.StatusBadRequest)
+		http.Error(w, msg, http.StatusInternalServerError)
 		return
-
+	} else {
+		res.FileType = "text/plain"
+		res.Text = strings.TrimSpace(text)
+		w.Header().Set("ETag", textETag(text))
 	}
 
-	fullPath := filepath.Join(baseDir, session, fileName)
-	ext := filepath.Ext(fullPath)
-	if ext == "" {
-		fullPath = fmt.Sprintf("%s.%s", fullPath, defaultExt)
-	}
-	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
-		res.Message = fmt.Sprintf("no such file: %s", fileName)
-	} else {
-		bytes, err := ioutil.ReadFile(fullPath)
+	if version == "edi" {
+		res.Revision, err = latestRevisionID(session, basename)
 		if err != nil {
-			msg := fmt.Sprintf("get_text: failed to read audio file : %v", err)
+			msg := fmt.Sprintf("get_text: failed to read revisions : %v", err)
 			log.Print(msg)
 			http.Error(w, msg, http.StatusInternalServerError)
 			return
 		}
-		res.FileType = "text/plain"
-		res.Text = strings.TrimSpace(string(bytes))
 	}
-	basename := strings.TrimSuffix(fullPath, filepath.Ext(fullPath))
-	jsonFile := basename + ".json"
 
-	if _, err := os.Stat(jsonFile); os.IsNotExist(err) {
-		log.Printf("No json file for basename %s", basename)
+	jsonObj, err := store.Metadata(session, basename)
+	if os.IsNotExist(err) {
+		log.Printf("No json file for basename %s/%s", session, basename)
+	} else if err != nil {
+		msg := fmt.Sprintf("get_text: failed to read json file : %v", err)
+		log.Print(msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
 	} else {
-		JSONObject, err := readJSONFile(jsonFile)
-		if err != nil {
-			msg := fmt.Sprintf("get_text: failed to read json file : %v", err)
-			log.Print(msg)
-			http.Error(w, msg, http.StatusInternalServerError)
-			return
-		}
-		res.JSONObject = JSONObject
+		res.JSONObject = jsonObj
 	}
 
 	resJSON, err := rec.PrettyMarshal(res)
@@ -564,7 +491,7 @@ func getText(w http.ResponseWriter, r *http.Request, defaultExt string) {
 		return
 	}
 
-	log.Printf("Server served text file %s", fullPath)
+	log.Printf("Server served text file %s/%s.%s", session, basename, version)
 	w.Header().Set("Content-Type", "application/json")
 	fmt.Fprintf(w, "%s\n", string(resJSON))
 
@@ -572,33 +499,36 @@ func getText(w http.ResponseWriter, r *http.Request, defaultExt string) {
 
 func getAudio(w http.ResponseWriter, r *http.Request) {
 	var res audioResponse
-	vars := mux.Vars(r)
-	session := vars["session"]
-	fileName := vars["filename"]
-	if fileName == "" {
-		msg := "get_audio: missing param 'filename'"
-		log.Print(msg)
-		http.Error(w, msg, http.StatusBadRequest)
-		return
-
-	}
-	if session == "" {
-		msg := "get_audio: missing param 'session'"
+	session, fileName, err := sessionFileVars(r)
+	if err != nil {
+		msg := fmt.Sprintf("get_audio: %v", err)
 		log.Print(msg)
 		http.Error(w, msg, http.StatusBadRequest)
 		return
-
 	}
-	fullPath := filepath.Join(baseDir, session, fileName)
-	ext := filepath.Ext(fullPath)
-	if ext == "" {
-		fullPath = fmt.Sprintf("%s.%s", fullPath, "webm")
+	basename, ext := splitFileName(fileName, "webm")
+	if format := r.URL.Query().Get("format"); format != "" {
+		if !audioFormatRE.MatchString(format) {
+			msg := fmt.Sprintf("get_audio: invalid format '%s'", format)
+			log.Print(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		ext = format
 	}
 
-	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
-		res.Message = fmt.Sprintf("no such file: %s", fileName)
+	blob, err := store.Audio(session, basename, ext)
+	if os.IsNotExist(err) {
+		res.Message = fmt.Sprintf("no such file: %s.%s", basename, ext)
+		if audioTranscoder != nil && contains(audioTranscoder.formats, ext) {
+			res.Message += " (conversion may not be finished yet)"
+		}
 	} else {
-		bytes, err := ioutil.ReadFile(fullPath)
+		var bytes []byte
+		if err == nil {
+			bytes, err = ioutil.ReadAll(blob)
+			blob.Close()
+		}
 		if err != nil {
 			msg := fmt.Sprintf("get_audio: failed to read audio file : %v", err)
 			log.Print(msg)
@@ -606,7 +536,7 @@ func getAudio(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		res.FileType = audioMimeType(fullPath)
+		res.FileType = audioMimeType(blob.Name())
 		data := base64.StdEncoding.EncodeToString(bytes)
 		res.Data = data
 	}
@@ -623,86 +553,95 @@ func getAudio(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "%s\n", string(resJSON))
 }
 
-func autosubEnabled() error {
-	_, err := exec.LookPath(autosubCmd)
+// streamAudio serves an audio file as is, with support for range requests (so that audio players can seek),
+// and conditional requests using ETag and Last-Modified. Like getAudio, it takes an optional 'format' parameter.
+func streamAudio(w http.ResponseWriter, r *http.Request) {
+	session, fileName, err := sessionFileVars(r)
 	if err != nil {
-		return fmt.Errorf("external '%s' command does not exist", autosubCmd)
+		msg := fmt.Sprintf("audio: %v", err)
+		log.Print(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
 	}
-	return nil
+	basename, ext := splitFileName(fileName, "webm")
+	if format := r.URL.Query().Get("format"); format != "" {
+		if !audioFormatRE.MatchString(format) {
+			msg := fmt.Sprintf("audio: invalid format '%s'", format)
+			log.Print(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		ext = format
+	}
+
+	blob, err := store.Audio(session, basename, ext)
+	if os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("no such file: %s.%s", basename, ext), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		msg := fmt.Sprintf("audio: failed to open audio file : %v", err)
+		log.Print(msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	defer blob.Close()
+
+	if mimeType := audioMimeType(blob.Name()); mimeType != "" {
+		w.Header().Set("Content-Type", mimeType)
+	}
+	w.Header().Set("ETag", fmt.Sprintf("\"%x-%x\"", blob.ModTime().UnixNano(), blob.Size()))
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, blob.Name(), blob.ModTime(), blob)
+}
+
+// parseSRT parses the contents of an srt (or WebVTT) file
+func parseSRT(srt string) ([]srtUnit, error) {
+	res := []srtUnit{}
+	cues, err := subtitle.Parse(strings.NewReader(srt))
+	if err != nil {
+		return res, err
+	}
+	for i, c := range cues {
+		res = append(res, newSrtUnit(int64(i+1), c))
+	}
+	return res, nil
 }
 
+// autosub runs recognition using the autosub recogniser backend. Kept for backward compatibility, see recognise.
 func autosub(w http.ResponseWriter, r *http.Request) {
-	if err := autosubEnabled(); err != nil {
+	recognizer, err := getRecognizer(autosubConfig.Name)
+	if err != nil {
 		msg := fmt.Sprintf("autosub: %s", err)
 		log.Print(msg)
 		http.Error(w, msg, http.StatusBadRequest)
 		return
 	}
 
-	vars := mux.Vars(r)
-	var session = newParam("session")
-	var fileName = newParam("filename")
-	err := requireParams(vars, &session, &fileName)
+	session, fileName, _, lang, err := recogniseParams(r)
 	if err != nil {
 		msg := fmt.Sprintf("autosub: param check failed : %v", err)
 		log.Print(msg)
 		http.Error(w, msg, http.StatusInternalServerError)
 		return
 	}
-	var res = srtResponse{SessionObject: SessionObject{session.value},
-		FileName: fileName.value}
-
-	audioFile := filepath.Join(baseDir, session.value, fileName.value)
-	ext := filepath.Ext(audioFile)
-	if ext == "" {
-		audioFile = fmt.Sprintf("%s.%s", audioFile, "webm")
-	}
-	srtFile := strings.Replace(audioFile, ".webm", ".srt", -1)
-	lang := "sv"
+	var res = srtResponse{SessionObject: SessionObject{session},
+		FileName: fileName}
 
-	if _, err := os.Stat(audioFile); os.IsNotExist(err) {
+	rr, err := recogniseFile(r.Context(), recognizer, session, fileName, lang)
+	if os.IsNotExist(err) {
 		res.Message = fmt.Sprintf("no such file: %s", fileName)
 	} else {
-		cmd := exec.Command(autosubCmd, "-S", lang, "-D", lang, "-o", srtFile, audioFile)
-		var out bytes.Buffer
-		var sterr bytes.Buffer
-		cmd.Stdout = &out
-		cmd.Stderr = &sterr
-
-		err := cmd.Run()
 		if err != nil {
-			msg := fmt.Sprintf("autosub: internal command failure")
+			msg := fmt.Sprintf("autosub: %v", err)
 			log.Print(msg)
 			http.Error(w, msg, http.StatusInternalServerError)
 			return
 		}
-
-		bytes, err := ioutil.ReadFile(srtFile)
-		if err != nil {
-			msg := fmt.Sprintf("autosub: failed to read srt file : %v", err)
-			log.Print(msg)
-			http.Error(w, msg, http.StatusInternalServerError)
-			return
-		}
-
-		units := strings.Split(strings.TrimSpace(string(bytes)), "\n\n")
-		res.Text = []srtUnit{}
-		for _, unit := range units {
-			lines := strings.Split(unit, "\n")
-			if len(lines) != 3 {
-			}
-			idS := lines[0]
-			id, err := strconv.ParseInt(idS, 10, 64)
-			if err != nil {
-				msg := fmt.Sprintf("autosub: failed to parse srt file : %v", err)
-				log.Print(msg)
-				http.Error(w, msg, http.StatusInternalServerError)
-				return
-			}
-			timeCode := lines[1]
-			text := lines[2]
-			res.Text = append(res.Text, srtUnit{ID: id, TimeCode: timeCode, Text: text})
+		if r.URL.Query().Get("expand") == "true" {
+			expandRecognitionResult(&rr, session, lang)
 		}
+		res.Text = rr.Segments
 	}
 
 	resJSON, err := rec.PrettyMarshal(res)
@@ -717,14 +656,40 @@ func autosub(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "%s\n", string(resJSON))
 }
 
-func saveBackupCopy(filePath string, fileContent []byte) (string, error) {
-	newFilePath := filePath + ".BAK"
-	err := ioutil.WriteFile(newFilePath, fileContent, 0644)
+// backupFile saves a copy of a file of an utterance (the .json file, a text file or an audio file), before it is overwritten
+func backupFile(session, basename, ext string) (string, error) {
+	var r io.Reader
+	switch ext {
+	case "json":
+		jsonObj, err := store.Metadata(session, basename)
+		if err != nil {
+			return "", err
+		}
+		jsonPretty, err := prettyMarshal(jsonObj)
+		if err != nil {
+			return "", err
+		}
+		r = bytes.NewReader(jsonPretty)
+	case "rec", "edi":
+		text, err := store.Text(session, basename, ext)
+		if err != nil {
+			return "", err
+		}
+		r = strings.NewReader(text)
+	default:
+		blob, err := store.Audio(session, basename, ext)
+		if err != nil {
+			return "", err
+		}
+		defer blob.Close()
+		r = blob
+	}
+	newName, err := store.SaveBackup(session, basename+"."+ext, r)
 	if err != nil {
-		return newFilePath, fmt.Errorf("failed to create backup file '%s' : %v", newFilePath, err)
+		return newName, fmt.Errorf("failed to create backup file '%s' : %v", newName, err)
 	}
-	fmt.Printf("Server saved %s\n", newFilePath)
-	return newFilePath, nil
+	fmt.Printf("Server saved %s\n", newName)
+	return newName, nil
 }
 
 func saveText(w http.ResponseWriter, r *http.Request, ext string) {
@@ -773,15 +738,22 @@ func saveText(w http.ResponseWriter, r *http.Request, ext string) {
 		return
 	}
 
-	textFilePath := path.Join(baseDir, to.SessionID, to.FileName) + "." + ext
+	if to.ExpandAbbrevs {
+		var applied []appliedExpansion
+		to.Data, applied = expandAbbrevs(to.Data, to.SessionID, to.Profile, to.Language)
+		respMessages = append(respMessages, fmt.Sprintf("expanded %d abbreviation(s)", len(applied)))
+	}
+
+	textFileName := to.FileName + "." + ext
+	textFilePath := path.Join(to.SessionID, textFileName)
 
-	writeMutex.Lock()
-	defer writeMutex.Unlock()
+	unlock := lockUtterance(to.SessionID, to.FileName)
+	defer unlock()
 
 	msg, err := checkAudioDirs(to.SessionID)
 	if err != nil {
-		log.Println(msg)
-		http.Error(w, msg, http.StatusBadRequest)
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	if msg != "" {
@@ -790,35 +762,89 @@ func saveText(w http.ResponseWriter, r *http.Request, ext string) {
 
 	textBytes := []byte(to.Data + "\n")
 
-	if _, err := os.Stat(textFilePath); !os.IsNotExist(err) {
-		if !to.OverWrite {
-			msg := fmt.Sprintf("file with the same session ID and file name already exists: %s/%s.%s\nTo overwrite set over_write:true", to.SessionID, to.FileName, ext)
-			newName, err := saveBackupCopy(textFilePath, textBytes)
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch != "" || to.BaseRevision > 0 {
+		if to.BaseRevision > 0 && ext != "edi" {
+			msg := "base_revision is only used for edited texts"
+			log.Println(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		conflict, err := checkTextVersion(to.SessionID, to.FileName, ext, ifMatch, to.BaseRevision, string(textBytes))
+		if err != nil {
+			msg := fmt.Sprintf("failed to check version of '%s' : %v", textFilePath, err)
+			log.Println(msg)
+			http.Error(w, msg, http.StatusInternalServerError)
+			return
+		}
+		if conflict != nil {
+			log.Println(conflict.Message)
+			conflictJSON, err := json.Marshal(conflict)
 			if err != nil {
-				msg = fmt.Sprintf("%s\nCouldn't save backup file : %v", msg, err)
-			} else {
-				msg = fmt.Sprintf("%s\nSaved backup file %s", msg, newName)
+				msg := fmt.Sprintf("failed to marshal response struct to JSON : %v", err)
+				log.Println("[chromedictator] " + msg)
+				http.Error(w, msg, http.StatusInternalServerError)
+				return
 			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "%s\n", string(conflictJSON))
+			return
+		}
+		// the client has seen the current version
+		to.OverWrite = true
+	}
 
+	if store.Exists(to.SessionID, textFileName) {
+		if !to.OverWrite {
+			msg := fmt.Sprintf("file with the same session ID and file name already exists: %s/%s.%s\nTo overwrite set over_write:true", to.SessionID, to.FileName, ext)
 			log.Println(msg)
 			http.Error(w, msg, http.StatusBadRequest)
 			return
 		}
 		msg := fmt.Sprintf("overwriting existing file '%s/%s.%s'", to.SessionID, to.FileName, ext)
+		// earlier edited texts are kept as revisions
+		if ext != "edi" {
+			newName, err := backupFile(to.SessionID, to.FileName, ext)
+			if err != nil {
+				msg := fmt.Sprintf("couldn't save backup of '%s' : %v", textFilePath, err)
+				log.Println(msg)
+				http.Error(w, msg, http.StatusInternalServerError)
+				return
+			}
+			msg = fmt.Sprintf("%s (saved backup file %s)", msg, newName)
+		}
 		respMessages = append(respMessages, msg)
 	}
 
-	err = ioutil.WriteFile(textFilePath, textBytes, 0644)
-	if err != nil {
-		msg := fmt.Sprintf("failed to create file '%s' : %v", textFilePath, err)
-		log.Println(msg)
-		http.Error(w, msg, http.StatusInternalServerError)
-		return
+	var rev revision
+	if ext == "edi" {
+		rev = revision{Author: to.Author, Comment: to.Comment}
+		if rev.Author == "" {
+			rev.Author = requestUser(r)
+		}
+		var msgs []string
+		rev, msgs, err = saveEditedTextRevision(to.SessionID, to.FileName, string(textBytes), rev)
+		respMessages = append(respMessages, msgs...)
+		if err != nil {
+			msg := fmt.Sprintf("%s : %v", strings.Join(respMessages, " : "), err)
+			log.Println(msg)
+			http.Error(w, msg, http.StatusInternalServerError)
+			return
+		}
+	} else {
+		err = store.SaveText(to.SessionID, to.FileName, ext, string(textBytes))
+		if err != nil {
+			msg := fmt.Sprintf("failed to create file '%s' : %v", textFilePath, err)
+			log.Println(msg)
+			http.Error(w, msg, http.StatusInternalServerError)
+			return
+		}
 	}
 	fmt.Printf("Server saved %s\n", textFilePath)
 
 	respMessages = append(respMessages, fmt.Sprintf("saved text file '%s'", textFilePath))
-	resp := RequestResponse{Message: strings.Join(respMessages, " : ")}
+	resp := saveTextResponse{Message: strings.Join(respMessages, " : "), Revision: rev.ID}
 
 	respJSON, err := json.Marshal(resp)
 	if err != nil {
@@ -829,35 +855,31 @@ func saveText(w http.ResponseWriter, r *http.Request, ext string) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", textETag(string(textBytes)))
 
 	fmt.Fprintf(w, "%s\n", string(respJSON))
 
 }
 
-func writeJSON(jsonFilePath string, jsonObj JSONObject, overwrite bool) ([]string, error) {
+// writeJSON saves the .json file of an utterance. If the file exists, it is only overwritten if overwrite is true, and
+// a backup of the earlier file is saved.
+func writeJSON(session, basename string, jsonObj JSONObject, overwrite bool) ([]string, error) {
 	respMessages := []string{}
-	jsonPretty, err := prettyMarshal(jsonObj)
-	if _, err := os.Stat(jsonFilePath); !os.IsNotExist(err) {
-		if overwrite {
+	jsonFilePath := path.Join(session, basename+".json")
+	if store.Exists(session, basename+".json") {
+		if !overwrite {
 			msg := fmt.Sprintf("file with the same session ID and file name already exists: %s\nTo overwrite set over_write:true", jsonFilePath)
-			newName, err := saveBackupCopy(jsonFilePath, jsonPretty)
-			if err != nil {
-				msg = fmt.Sprintf("%s\nCouldn't save backup file : %v", msg, err)
-			} else {
-				msg = fmt.Sprintf("%s\nSaved backup file %s", msg, newName)
-			}
-
 			return respMessages, fmt.Errorf("%s", msg)
 		}
-		msg := fmt.Sprintf("overwriting existing file '%s'", jsonFilePath)
+		newName, err := backupFile(session, basename, "json")
+		if err != nil {
+			return respMessages, fmt.Errorf("couldn't save backup of '%s' : %v", jsonFilePath, err)
+		}
+		msg := fmt.Sprintf("overwriting existing file '%s' (saved backup file %s)", jsonFilePath, newName)
 		respMessages = append(respMessages, msg)
 
 	}
-	if err != nil {
-		msg := fmt.Sprintf("failed to marshal response struct to JSON : %v", err)
-		return respMessages, fmt.Errorf("%s", msg)
-	}
-	err = ioutil.WriteFile(jsonFilePath, jsonPretty, 0644)
+	err := store.SaveMetadata(session, basename, jsonObj)
 	if err != nil {
 		msg := fmt.Sprintf("failed to save json file '%s' : %v", jsonFilePath, err)
 		return respMessages, fmt.Errorf("%s", msg)
@@ -866,139 +888,75 @@ func writeJSON(jsonFilePath string, jsonObj JSONObject, overwrite bool) ([]strin
 	return respMessages, nil
 }
 
+// checkAudioDirs creates the session if it doesn't exist
 func checkAudioDirs(sessionID string) (string, error) {
-	if _, err := os.Stat(baseDir); os.IsNotExist(err) {
-		return "", fmt.Errorf("base dir not found: %v", err)
+	created, err := store.CreateSession(sessionID)
+	if err != nil {
+		return "", fmt.Errorf("failed to create session '%s' : %v", sessionID, err)
 	}
-
-	if _, err := os.Stat(path.Join(baseDir, sessionID)); os.IsNotExist(err) {
-		err := os.Mkdir(path.Join(baseDir, sessionID), os.ModePerm)
-		if err != nil {
-			return "", fmt.Errorf("failed to create session ID dir : %v", err)
-		}
-		return fmt.Sprintf("created new session id dir: '%s'", path.Join(baseDir, sessionID)), nil
+	if created {
+		return fmt.Sprintf("created new session: '%s'", sessionID), nil
 	}
 	return "", nil
 }
 
+// saveAudio saves an audio file sent as JSON, with the audio base64 encoded in the data field. The audio is decoded into a
+// temporary file, and saved by saveUpload, as for uploadAudio.
 func saveAudio(w http.ResponseWriter, r *http.Request) {
-	var respMessages []string
+	fail := func(status int, msg string) {
+		log.Println("[chromedictator] saveAudio: " + msg)
+		http.Error(w, msg, status)
+	}
 
+	// base64 encoding makes the audio a third bigger
+	r.Body = http.MaxBytesReader(w, r.Body, (maxUploadSize+2)/3*4+maxMetadataSize)
 	body, err := ioutil.ReadAll(r.Body)
-
+	if isBodyTooLarge(err) {
+		fail(http.StatusRequestEntityTooLarge, fmt.Sprintf("audio file too large (max %d bytes)", maxUploadSize))
+		return
+	}
 	if err != nil {
-		msg := fmt.Sprintf("failed to read request body : %v", err)
-		log.Println(msg)
-		// or return JSON response with error message?
-		//res.Message = msg
-		http.Error(w, msg, http.StatusBadRequest)
+		fail(http.StatusBadRequest, fmt.Sprintf("failed to read request body : %v", err))
 		return
 	}
 
 	ao := AudioObject{}
 	err = json.Unmarshal(body, &ao)
 	if err != nil {
-		msg := fmt.Sprintf("failed to unmarshal incoming JSON : %v", err)
-		log.Println("[chromedictator] " + msg)
-		//log.Printf("[chromedictator] incoming JSON string : %s\n", string(body))
-		http.Error(w, msg, http.StatusBadRequest)
+		fail(http.StatusBadRequest, fmt.Sprintf("failed to unmarshal incoming JSON : %v", err))
 		return
 	}
+	body = nil
 
 	vali := ao.validate()
 	if len(vali) > 0 {
-		msg := "Incomplete incoming JSON: " + strings.Join(vali, " : ")
-		log.Println("[chromedictator] " + msg)
-		http.Error(w, msg, http.StatusBadRequest)
-		return
-
-	}
-
-	var audio []byte
-	audio, err = base64.StdEncoding.DecodeString(ao.Data)
-	if err != nil {
-		msg := fmt.Sprintf("server failed to decode base 64 audio data : %v", err)
-		log.Println("[chromedictator] " + msg)
-		http.Error(w, msg, http.StatusInternalServerError)
+		fail(http.StatusBadRequest, "Incomplete incoming JSON: "+strings.Join(vali, " : "))
 		return
 	}
 
-	writeMutex.Lock()
-	defer writeMutex.Unlock()
-
-	msg, err := checkAudioDirs(ao.SessionID)
-	if err != nil {
-		log.Println(msg)
-		http.Error(w, msg, http.StatusBadRequest)
+	tmpFile, size, checksum, err := streamToFile(base64.NewDecoder(base64.StdEncoding, strings.NewReader(ao.Data)))
+	if err == errTooLarge {
+		fail(http.StatusRequestEntityTooLarge, fmt.Sprintf("audio file too large (max %d bytes)", maxUploadSize))
 		return
 	}
-	if msg != "" {
-		respMessages = append(respMessages, msg)
-	}
-
-	jsonObj := JSONObject{
-		SessionObject: ao.SessionObject,
-		StartTime:     ao.StartTime,
-		EndTime:       ao.EndTime,
-		TimeCodeStart: ao.TimeCodeStart,
-		TimeCodeEnd:   ao.TimeCodeEnd,
-	}
-	jsonFilePath := path.Join(baseDir, ao.SessionID, ao.FileName) + ".json"
-	jsonResps, err := writeJSON(jsonFilePath, jsonObj, ao.OverWrite)
 	if err != nil {
-		msg := fmt.Sprintf("failed to save json file '%s' : %v", jsonFilePath, err)
-		log.Println("[chromedictator] " + msg)
-		http.Error(w, msg, http.StatusInternalServerError)
+		fail(http.StatusBadRequest, fmt.Sprintf("server failed to decode base 64 audio data : %v", err))
 		return
 	}
-	for _, msg := range jsonResps {
-		respMessages = append(respMessages, msg)
-	}
+	ao.Data = ""
 
-	ext := strings.TrimPrefix(ao.FileExtension, "audio/")
-
-	audioFilePath := path.Join(baseDir, ao.SessionID, ao.FileName)
-	audioFilePath = audioFilePath + "." + ext
-
-	if _, err := os.Stat(audioFilePath); !os.IsNotExist(err) {
-		if !ao.OverWrite {
-			msg := fmt.Sprintf("file with the same session ID and file name already exists: %s/%s.%s\nTo overwrite set over_write:true", ao.SessionID, ao.FileName, ao.FileExtension)
-			newName, err := saveBackupCopy(audioFilePath, audio)
-			if err != nil {
-				msg = fmt.Sprintf("%s\nCouldn't save backup file : %v", msg, err)
-			} else {
-				msg = fmt.Sprintf("%s\nSaved backup file %s", msg, newName)
-			}
-
-			log.Println(msg)
-			http.Error(w, msg, http.StatusBadRequest)
-			return
-		}
-		msg := fmt.Sprintf("overwriting existing file '%s/%s.%s'", ao.SessionID, ao.FileName, ao.FileExtension)
-		respMessages = append(respMessages, msg)
-	}
-	err = ioutil.WriteFile(audioFilePath, audio, 0644)
+	resp, status, err := saveUpload(ao, tmpFile, size, checksum)
 	if err != nil {
-		msg := fmt.Sprintf("failed to save audio file '%s' : %v", audioFilePath, err)
-		log.Println("[chromedictator] " + msg)
-		http.Error(w, msg, http.StatusInternalServerError)
+		os.Remove(tmpFile)
+		fail(status, err.Error())
 		return
 	}
-	fmt.Printf("Server saved %s\n", audioFilePath)
-
-	respMessages = append(respMessages, fmt.Sprintf("server saved audio file '%s'", audioFilePath))
-	// TODO Copypaste
-	resp := RequestResponse{Message: strings.Join(respMessages, " : ")}
 	respJSON, err := json.Marshal(resp)
 	if err != nil {
-		msg := fmt.Sprintf("failed to marshal response struct to JSON : %v", err)
-		log.Println("[chromedictator] " + msg)
-		http.Error(w, msg, http.StatusInternalServerError)
+		fail(http.StatusInternalServerError, fmt.Sprintf("failed to marshal response struct to JSON : %v", err))
 		return
 	}
-
 	w.Header().Set("Content-Type", "application/json")
-
 	fmt.Fprintf(w, "%s\n", string(respJSON))
 }
 
@@ -1014,6 +972,19 @@ func generateDoc(w http.ResponseWriter, r *http.Request) {
 
 func main() {
 
+	var recogniserConfig = flag.String("recognisers", "", "JSON file listing speech recogniser backends (default: autosub, if installed)")
+	var recognitionWorkers = flag.Int("recognition-workers", 2, "max number of recognition jobs to run in parallel")
+	var maxUploadMB = flag.Int64("max-upload-size", 100, "max size of uploaded audio files, in MB")
+	var requestTimeout = flag.Duration("request-timeout", 2*time.Minute, "max time for reading a request and writing its response (e.g. audio uploads and exports)")
+	var maxWavExportFlag = flag.Int("max-wav-export", maxWavExport, "max number of utterances in a dataset export with audio converted to wav, which must be done within -request-timeout")
+	var transcodeFormats = flag.String("transcode", "", "comma-separated list of audio formats (e.g. wav,flac) to convert uploaded audio to, in the background (default: no conversion)")
+	var transcodeCommand = flag.String("transcode-command", defaultTranscodeCommand, "command for converting audio, with the placeholders {input}, {output} and {format}")
+	var storeType = flag.String("store", "fs", "where to keep sessions and abbreviations: fs (session folders in "+baseDir+") or sqlite (a database file)")
+	var sqliteDB = flag.String("sqlite-db", path.Join(baseDir, "chromedictator.db"), "database file for -store sqlite")
+	flag.Parse()
+	maxUploadSize = *maxUploadMB * 1024 * 1024
+	maxWavExport = *maxWavExportFlag
+
 	if _, err := os.Stat(baseDir); os.IsNotExist(err) {
 
 		err := os.Mkdir(baseDir, os.ModePerm)
@@ -1027,21 +998,49 @@ func main() {
 		fmt.Fprintf(os.Stderr, "[chromdictator] created base dir '%s'\n", baseDir)
 	}
 
-	// load abbreviations gob
-	if _, err := os.Stat(abbrevFilePath); !os.IsNotExist(err) {
-
-		m, err := gobFile2Map(abbrevFilePath)
+	switch *storeType {
+	case "fs":
+		store = newFSStore(baseDir)
+	case "sqlite":
+		s, err := newSQLiteStore(*sqliteDB, baseDir)
 		if err != nil {
 			fmt.Printf("Major disaster: %v\n", err)
 			return
 		}
+		store = s
+		log.Printf("using database %s", *sqliteDB)
+	default:
+		fmt.Printf("Major disaster: invalid store '%s' (expected fs or sqlite)\n", *storeType)
+		return
+	}
 
-		abbrevs = m
+	report, err := store.Check()
+	if err != nil {
+		log.Printf("consistency check failed : %v", err)
+	}
+	for _, msg := range report {
+		log.Printf("consistency check: %s", msg)
+	}
+
+	err = loadAbbrevs()
+	if err != nil {
+		fmt.Printf("Major disaster: %v\n", err)
+		return
+	}
+	err = loadAbbrevLog()
+	if err != nil {
+		fmt.Printf("Major disaster: %v\n", err)
+		return
+	}
+	if _, ok := localDir(store); ok {
+		go watchAbbrevFile(2 * time.Second)
 	} else {
-		// no abbrev file exists, let's initialise one
-		abbrevs["tst"] = "test"
-		abbrevs["tstn"] = "testing"
-		persistAbbrevs()
+		log.Printf("abbreviations are kept in the database, %s is not used", abbrevFilePath)
+	}
+
+	err = cleanChunkedUploads()
+	if err != nil {
+		log.Printf("failed to remove old chunked uploads : %v", err)
 	}
 
 	p := "7654"
@@ -1049,24 +1048,75 @@ func main() {
 	r.StrictSlash(true)
 
 	r.HandleFunc("/get_audio/{session}/{filename}", getAudio).Methods("GET")
+	r.HandleFunc("/audio/{session}/{filename}", streamAudio).Methods("GET", "HEAD")
 	r.HandleFunc("/get_edited_text/{session}/{filename}", getEditedText).Methods("GET")
 	r.HandleFunc("/get_recogniser_text/{session}/{filename}", getRecogniserText).Methods("GET")
 	r.HandleFunc("/save_audio", saveAudio).Methods("POST")
+	r.HandleFunc("/upload_audio", uploadAudio).Methods("POST")
+	r.HandleFunc("/upload_audio/chunked", createChunkedUpload).Methods("POST")
+	r.HandleFunc("/upload_audio/chunked/{id}", chunkedUploadStatusHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/upload_audio/chunked/{id}", appendChunk).Methods("PATCH", "PUT")
+	r.HandleFunc("/upload_audio/chunked/{id}", abortChunkedUpload).Methods("DELETE")
+	r.HandleFunc("/upload_audio/chunked/{id}/complete", completeChunkedUpload).Methods("POST")
+	r.HandleFunc("/live_audio", liveAudio).Methods("GET")
 	r.HandleFunc("/save_recogniser_text", saveRecogniserText).Methods("POST")
 	r.HandleFunc("/save_edited_text", saveEditedText).Methods("POST")
 	r.HandleFunc("/save_recogniser_text/{text_object}", saveRecogniserText).Methods("GET")
 	r.HandleFunc("/save_edited_text/{text_object}", saveEditedText).Methods("GET")
 
-	if err := autosubEnabled(); err == nil {
-		log.Println("chromedictator autosub enabled")
+	r.HandleFunc("/history/{session}/{filename}", listRevisions).Methods("GET")
+	r.HandleFunc("/history/{session}/{filename}/diff", diffRevisions).Methods("GET")
+	r.HandleFunc("/history/{session}/{filename}/{revision:[0-9]+}", getRevision).Methods("GET")
+	r.HandleFunc("/history/{session}/{filename}/{revision:[0-9]+}/restore", restoreRevision).Methods("POST")
+
+	if *transcodeFormats != "" {
+		audioTranscoder, err = newTranscoder(*transcodeFormats, *transcodeCommand)
+		if err != nil {
+			fmt.Printf("Major disaster: failed to initialise audio conversion : %v\n", err)
+			return
+		}
+	}
+
+	err = loadRecognizers(*recogniserConfig)
+	if err != nil {
+		fmt.Printf("Major disaster: %v\n", err)
+		return
+	}
+	if _, err := getRecognizer(autosubConfig.Name); err == nil {
 		r.HandleFunc("/autosub/{session}/{filename}", autosub).Methods("GET")
-	} else {
-		log.Println("chromedictator autosub disabled")
 	}
+	r.HandleFunc("/recognise/backends", listRecognizers).Methods("GET")
+	r.HandleFunc("/recognise/{session}/{filename}", recognise).Methods("GET")
+
+	recognitionJobs, err = newJobQueue(*recognitionWorkers)
+	if err != nil {
+		fmt.Printf("Major disaster: %v\n", err)
+		return
+	}
+	r.HandleFunc("/jobs/list", listRecognitionJobs).Methods("GET")
+	r.HandleFunc("/jobs/recognise/{session}/{filename}", submitRecognitionJob).Methods("GET", "POST")
+	r.HandleFunc("/jobs/{id}", recognitionJobStatus).Methods("GET")
+	r.HandleFunc("/jobs/{id}/result", recognitionJobResult).Methods("GET")
+	r.HandleFunc("/jobs/{id}/cancel", cancelRecognitionJob).Methods("GET", "POST")
 
 	r.HandleFunc("/abbrev/list", listAbbrevs)
+	r.HandleFunc("/abbrev/scopes", listAbbrevScopes)
+	r.HandleFunc("/abbrev/export", exportAbbrevs).Methods("GET")
+	r.HandleFunc("/abbrev/import", importAbbrevs).Methods("POST")
+	r.HandleFunc("/abbrev/expand", expandAbbrevsHandler).Methods("GET", "POST")
 	r.HandleFunc("/abbrev/add/{abbrev}/{expansion}", addAbbrev)
+	r.HandleFunc("/abbrev/update/{abbrev}/{expansion}", updateAbbrev)
 	r.HandleFunc("/abbrev/delete/{abbrev}", deleteAbbrev)
+	r.HandleFunc("/abbrev/history", abbrevHistory).Methods("GET")
+	r.HandleFunc("/abbrev/rollback/{id}", rollbackAbbrev)
+
+	r.HandleFunc("/export/{session}.{format:srt|vtt}", exportSessionSubtitles).Methods("GET")
+	r.HandleFunc("/export/{session}.{format:TextGrid|eaf}", exportSessionAnnotations).Methods("GET")
+	r.HandleFunc("/export/kaldi", exportKaldi).Methods("GET")
+	r.HandleFunc("/export/dataset", exportDataset).Methods("GET")
+
+	r.HandleFunc("/wer", reportWER).Methods("GET")
+	r.HandleFunc("/wer/{session}/{filename}", utteranceWER).Methods("GET")
 
 	r.HandleFunc("/admin/list/sessions", listSessions)
 	r.HandleFunc("/admin/list/files/{session}", listFilenames)
@@ -1090,10 +1140,11 @@ func main() {
 	r.PathPrefix("/").Handler(http.StripPrefix("/", http.FileServer(http.Dir("static/"))))
 
 	srv := &http.Server{
-		Handler:      r,
-		Addr:         "127.0.0.1:" + p,
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
+		Handler:           r,
+		Addr:              "127.0.0.1:" + p,
+		WriteTimeout:      *requestTimeout,
+		ReadTimeout:       *requestTimeout,
+		ReadHeaderTimeout: 15 * time.Second,
 	}
 	log.Println("chromedictator server started on localhost:" + p)
 	log.Fatal(srv.ListenAndServe())
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Resumable uploads of audio in chunks, for long recordings over unreliable connections. An upload is created with
+// the metadata of the audio file, and the client then appends chunks at given offsets. If a request fails, the client
+// asks for the current offset, and continues from there. When all chunks are sent, the upload is completed, and the
+// audio file is saved in the same way as by uploadAudio.
+//
+// Unfinished uploads are saved in the base dir as upload-<id>.part~ (audio) and upload-<id>.json~ (metadata).
+
+// unfinished uploads older than this are removed at startup
+var chunkedUploadRetention = 7 * 24 * time.Hour
+
+var uploadIDRE = regexp.MustCompile("^[0-9a-f]{16}$")
+
+type chunkedUpload struct {
+	ID        string            `json:"id"`
+	Metadata  map[string]string `json:"metadata"`
+	AudioType string            `json:"audio_type,omitempty"`
+	Created   string            `json:"created"`
+	Updated   string            `json:"updated"`
+}
+
+type chunkedUploadStatus struct {
+	ID      string `json:"id"`
+	Offset  int64  `json:"offset"`
+	MaxSize int64  `json:"max_size"`
+	Created string `json:"created"`
+	Updated string `json:"updated"`
+}
+
+// locks by upload id, so that chunks of the same upload are written one at a time
+var chunkedUploadLocks = newKeyLocks()
+
+// chunkedUploadPaths returns the paths of the audio received so far and the upload info. Uploads in progress are kept in
+// baseDir, outside of the store, until completeChunkedUpload imports the audio.
+func chunkedUploadPaths(id string) (string, string) {
+	p := path.Join(baseDir, "upload-"+id)
+	return p + ".part~", p + ".json~"
+}
+
+// removeChunkedUpload removes the files of an upload (the audio file is kept if keepAudio is set)
+func removeChunkedUpload(id string, keepAudio bool) {
+	partFile, metaFile := chunkedUploadPaths(id)
+	if !keepAudio {
+		os.Remove(partFile)
+	}
+	os.Remove(metaFile)
+}
+
+func readChunkedUpload(id string) (chunkedUpload, error) {
+	var res chunkedUpload
+	_, metaFile := chunkedUploadPaths(id)
+	bts, err := ioutil.ReadFile(metaFile)
+	if err != nil {
+		return res, err
+	}
+	err = json.Unmarshal(bts, &res)
+	if err != nil {
+		return res, fmt.Errorf("couldn't unmarshal JSON : %v", err)
+	}
+	return res, nil
+}
+
+func writeChunkedUpload(u chunkedUpload) error {
+	_, metaFile := chunkedUploadPaths(u.ID)
+	bts, err := json.Marshal(u)
+	if err != nil {
+		return fmt.Errorf("failed to marshal upload : %v", err)
+	}
+	return writeFileAtomic(metaFile, bts, 0644)
+}
+
+func (u chunkedUpload) status() (chunkedUploadStatus, error) {
+	partFile, _ := chunkedUploadPaths(u.ID)
+	info, err := os.Stat(partFile)
+	if err != nil {
+		return chunkedUploadStatus{}, err
+	}
+	return chunkedUploadStatus{ID: u.ID, Offset: info.Size(), MaxSize: maxUploadSize, Created: u.Created, Updated: u.Updated}, nil
+}
+
+// cleanChunkedUploads removes unfinished uploads that haven't been updated for chunkedUploadRetention
+func cleanChunkedUploads() error {
+	files, err := ioutil.ReadDir(baseDir)
+	if err != nil {
+		return err
+	}
+	n := 0
+	for _, f := range files {
+		if f.IsDir() || !strings.HasPrefix(f.Name(), "upload-") || time.Since(f.ModTime()) < chunkedUploadRetention {
+			continue
+		}
+		if strings.HasSuffix(f.Name(), ".part~") || strings.HasSuffix(f.Name(), ".json~") {
+			id := strings.TrimSuffix(strings.TrimPrefix(f.Name(), "upload-"), filepath.Ext(f.Name()))
+			partFile, _ := chunkedUploadPaths(id)
+			// the audio file is updated on every chunk, so it decides if the upload is stale
+			if info, err := os.Stat(partFile); err == nil && time.Since(info.ModTime()) < chunkedUploadRetention {
+				continue
+			}
+			err := os.Remove(path.Join(baseDir, f.Name()))
+			if err != nil {
+				return err
+			}
+			n++
+		}
+	}
+	if n > 0 {
+		log.Printf("removed %d file(s) of unfinished chunked uploads", n)
+	}
+	return nil
+}
+
+func writeChunkedUploadStatus(w http.ResponseWriter, s chunkedUploadStatus, status int) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(s.Offset, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	resJSON, err := json.Marshal(s)
+	if err != nil {
+		msg := fmt.Sprintf("failed to marshal upload status : %v", err)
+		log.Println("[chromedictator] " + msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s\n", string(resJSON))
+}
+
+// createChunkedUpload starts a new chunked upload. The metadata is given as URL parameters, with the same fields as
+// for uploadAudio. If the audio file already exists, and over_write isn't set, the upload is rejected before any chunks
+// are sent. The response is the status of the upload, with the upload id.
+func createChunkedUpload(w http.ResponseWriter, r *http.Request) {
+	values := make(map[string]string)
+	for k := range r.URL.Query() {
+		values[k] = r.URL.Query().Get(k)
+	}
+	audioType := r.Header.Get("Content-Type")
+	ao, err := uploadMetadata(values, audioType)
+	if err != nil {
+		msg := "createChunkedUpload: Incomplete upload metadata: " + err.Error()
+		log.Println("[chromedictator] " + msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	if err := checkOverwrite(ao); err != nil {
+		msg := "createChunkedUpload: " + err.Error()
+		log.Println("[chromedictator] " + msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		msg := fmt.Sprintf("createChunkedUpload: %v", err)
+		log.Println("[chromedictator] " + msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	u := chunkedUpload{ID: id, Metadata: values, AudioType: audioType, Created: now, Updated: now}
+	partFile, _ := chunkedUploadPaths(id)
+	err = ioutil.WriteFile(partFile, []byte{}, 0644)
+	if err == nil {
+		err = writeChunkedUpload(u)
+	}
+	if err != nil {
+		removeChunkedUpload(id, false)
+		msg := fmt.Sprintf("createChunkedUpload: failed to save upload : %v", err)
+		log.Println("[chromedictator] " + msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", "/upload_audio/chunked/"+id)
+	writeChunkedUploadStatus(w, chunkedUploadStatus{ID: id, MaxSize: maxUploadSize, Created: now, Updated: now}, http.StatusCreated)
+}
+
+// lookupChunkedUpload locks and reads the upload given by the URL variable 'id'. If it doesn't exist, an error response is written,
+// and false is returned. Otherwise, the caller must unlock the upload, using the returned function.
+func lookupChunkedUpload(w http.ResponseWriter, r *http.Request, funcName string) (chunkedUpload, func(), bool) {
+	id := mux.Vars(r)["id"]
+	if !uploadIDRE.MatchString(id) {
+		msg := fmt.Sprintf("%s: invalid upload id '%s'", funcName, id)
+		log.Println("[chromedictator] " + msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return chunkedUpload{}, nil, false
+	}
+	unlock := chunkedUploadLocks.lock(id)
+	u, err := readChunkedUpload(id)
+	if err != nil {
+		status := http.StatusInternalServerError
+		msg := fmt.Sprintf("%s: failed to read upload %s : %v", funcName, id, err)
+		if os.IsNotExist(err) {
+			status = http.StatusNotFound
+			msg = fmt.Sprintf("%s: no such upload: %s", funcName, id)
+		}
+		unlock()
+		log.Println("[chromedictator] " + msg)
+		http.Error(w, msg, status)
+		return u, nil, false
+	}
+	return u, unlock, true
+}
+
+// chunkedUploadStatusHandler returns the status of an upload. The offset is the number of bytes received so far,
+// and is where the next chunk should start.
+func chunkedUploadStatusHandler(w http.ResponseWriter, r *http.Request) {
+	u, unlock, ok := lookupChunkedUpload(w, r, "chunkedUploadStatus")
+	if !ok {
+		return
+	}
+	defer unlock()
+	s, err := u.status()
+	if err != nil {
+		msg := fmt.Sprintf("chunkedUploadStatus: %v", err)
+		log.Println("[chromedictator] " + msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	writeChunkedUploadStatus(w, s, http.StatusOK)
+}
+
+// appendChunk appends the request body to an upload. The URL parameter 'offset' (or the header Upload-Offset) must be equal to
+// the current offset of the upload, otherwise the chunk is rejected with status 409 Conflict and the current offset.
+// If the connection is lost during a chunk, the data received is kept, and the client continues from the new offset.
+func appendChunk(w http.ResponseWriter, r *http.Request) {
+	fail := func(status int, msg string) {
+		log.Println("[chromedictator] appendChunk: " + msg)
+		http.Error(w, msg, status)
+	}
+
+	u, unlock, ok := lookupChunkedUpload(w, r, "appendChunk")
+	if !ok {
+		return
+	}
+	defer unlock()
+	s, err := u.status()
+	if err != nil {
+		fail(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	offsetParam := r.URL.Query().Get("offset")
+	if offsetParam == "" {
+		offsetParam = r.Header.Get("Upload-Offset")
+	}
+	offset, err := strconv.ParseInt(offsetParam, 10, 64)
+	if err != nil {
+		fail(http.StatusBadRequest, fmt.Sprintf("missing or invalid offset '%s'", offsetParam))
+		return
+	}
+	if offset != s.Offset {
+		log.Printf("[chromedictator] appendChunk: offset mismatch for upload %s: %d (expected %d)", u.ID, offset, s.Offset)
+		writeChunkedUploadStatus(w, s, http.StatusConflict)
+		return
+	}
+	if r.ContentLength > maxUploadSize-offset {
+		fail(http.StatusRequestEntityTooLarge, fmt.Sprintf("audio file too large (max %d bytes)", maxUploadSize))
+		return
+	}
+
+	partFile, _ := chunkedUploadPaths(u.ID)
+	fh, err := os.OpenFile(partFile, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		fail(http.StatusInternalServerError, fmt.Sprintf("failed to open upload file : %v", err))
+		return
+	}
+	n, err := io.Copy(fh, io.LimitReader(r.Body, maxUploadSize-offset+1))
+	if err == nil {
+		// the new offset is returned to the client, so the chunk must be on disk
+		err = fh.Sync()
+	}
+	closeErr := fh.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if offset+n > maxUploadSize {
+		// remove the data past the limit, so that the upload stays valid
+		os.Truncate(partFile, maxUploadSize)
+		fail(http.StatusRequestEntityTooLarge, fmt.Sprintf("audio file too large (max %d bytes)", maxUploadSize))
+		return
+	}
+	u.Updated = time.Now().UTC().Format(time.RFC3339)
+	if mErr := writeChunkedUpload(u); mErr != nil {
+		log.Printf("[chromedictator] appendChunk: failed to save upload %s : %v", u.ID, mErr)
+	}
+	if err != nil {
+		fail(http.StatusBadRequest, fmt.Sprintf("failed to read chunk after %d bytes : %v", n, err))
+		return
+	}
+	s.Offset = offset + n
+	s.Updated = u.Updated
+	writeChunkedUploadStatus(w, s, http.StatusOK)
+}
+
+// completeChunkedUpload saves the audio file of an upload in the session folder, along with its .json file.
+// If the URL parameter 'size' is given, it must be equal to the number of bytes received. The URL parameter 'over_write'
+// replaces the value given when the upload was created, since the file may have been created since then.
+func completeChunkedUpload(w http.ResponseWriter, r *http.Request) {
+	fail := func(status int, msg string) {
+		log.Println("[chromedictator] completeChunkedUpload: " + msg)
+		http.Error(w, msg, status)
+	}
+
+	u, unlock, ok := lookupChunkedUpload(w, r, "completeChunkedUpload")
+	if !ok {
+		return
+	}
+	defer unlock()
+	s, err := u.status()
+	if err != nil {
+		fail(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if sizeParam := r.URL.Query().Get("size"); sizeParam != "" {
+		size, err := strconv.ParseInt(sizeParam, 10, 64)
+		if err != nil {
+			fail(http.StatusBadRequest, fmt.Sprintf("invalid size '%s'", sizeParam))
+			return
+		}
+		if size != s.Offset {
+			log.Printf("[chromedictator] completeChunkedUpload: size mismatch for upload %s: %d (received %d)", u.ID, size, s.Offset)
+			writeChunkedUploadStatus(w, s, http.StatusConflict)
+			return
+		}
+	}
+	if s.Offset == 0 {
+		fail(http.StatusBadRequest, "missing audio (no chunks received)")
+		return
+	}
+
+	ao, err := uploadMetadata(u.Metadata, u.AudioType)
+	if err != nil {
+		fail(http.StatusBadRequest, "Incomplete upload metadata: "+err.Error())
+		return
+	}
+	if ow := r.URL.Query().Get("over_write"); ow != "" {
+		ao.OverWrite = ow == "true"
+	}
+
+	partFile, _ := chunkedUploadPaths(u.ID)
+	checksum, err := fileSHA256(partFile)
+	if err != nil {
+		fail(http.StatusInternalServerError, fmt.Sprintf("failed to read upload file : %v", err))
+		return
+	}
+
+	resp, status, err := saveUpload(ao, partFile, s.Offset, checksum)
+	if err != nil {
+		// the chunks are kept if the audio was rejected, or couldn't be saved, so that the client may try again
+		// (e.g. with the URL parameter over_write=true, or after a server error)
+		if _, statErr := os.Stat(partFile); os.IsNotExist(statErr) {
+			removeChunkedUpload(u.ID, true)
+		}
+		fail(status, err.Error())
+		return
+	}
+	removeChunkedUpload(u.ID, true)
+
+	respJSON, err := json.Marshal(resp)
+	if err != nil {
+		fail(http.StatusInternalServerError, fmt.Sprintf("failed to marshal response struct to JSON : %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s\n", string(respJSON))
+}
+
+// abortChunkedUpload removes an unfinished upload
+func abortChunkedUpload(w http.ResponseWriter, r *http.Request) {
+	u, unlock, ok := lookupChunkedUpload(w, r, "abortChunkedUpload")
+	if !ok {
+		return
+	}
+	defer unlock()
+	removeChunkedUpload(u.ID, false)
+	fmt.Fprintf(w, "removed upload %s\n", u.ID)
+}
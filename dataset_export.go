@@ -0,0 +1,355 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Export of sessions as a speech dataset in the style of Common Voice / HuggingFace: a manifest file
+// (CSV or JSONL) with one line per utterance, and the audio files, packed in a zip or tar archive.
+
+// max number of utterances converted to wav in one export, since the export must be written within the server's
+// request timeout. Set by the -max-wav-export flag.
+var maxWavExport = 500
+
+// max time for converting one audio file to wav
+var wavConversionTimeout = 30 * time.Second
+
+type datasetItem struct {
+	Path      string  `json:"path"`
+	Sentence  string  `json:"sentence"`
+	Duration  float64 `json:"duration"` // seconds
+	Locale    string  `json:"locale"`
+	SessionID string  `json:"session_id"`
+	StartTime float64 `json:"start_time"` // seconds, relative to session start
+	EndTime   float64 `json:"end_time"`   // seconds, relative to session start
+
+	audioFile string // <basename>.<ext> in the session
+}
+
+var datasetColumns = []string{"path", "sentence", "duration", "locale", "session_id", "start_time", "end_time"}
+
+func (it datasetItem) csvRecord() []string {
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+	return []string{it.Path, it.Sentence, f(it.Duration), it.Locale, it.SessionID, f(it.StartTime), f(it.EndTime)}
+}
+
+// archiveWriter is a zip or tar archive
+type archiveWriter interface {
+	add(name string, size int64, r io.Reader) error
+	Close() error
+}
+
+type zipArchive struct {
+	*zip.Writer
+}
+
+func (a zipArchive) add(name string, size int64, r io.Reader) error {
+	w, err := a.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+type tarArchive struct {
+	*tar.Writer
+}
+
+func (a tarArchive) add(name string, size int64, r io.Reader) error {
+	err := a.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(a, r)
+	return err
+}
+
+func addFileToArchive(a archiveWriter, name, fName string) error {
+	fh, err := os.Open(fName)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	info, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+	return a.add(name, info.Size(), fh)
+}
+
+// addAudioToArchive adds an audio file of a session to the archive
+func addAudioToArchive(a archiveWriter, name, session, fileName string) error {
+	basename, ext := splitFileName(fileName, "")
+	blob, err := store.Audio(session, basename, ext)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	return a.add(name, blob.Size(), blob)
+}
+
+// conversionError is an error converting an audio file, as opposed to an error writing the archive
+type conversionError struct {
+	error
+}
+
+// addWavToArchive converts an audio file of a session to wav (see convertToWav), and adds it to the archive.
+// The converted file is written to tmpDir, and removed when it has been added.
+func addWavToArchive(ctx context.Context, a archiveWriter, name, session, fileName, tmpDir string, sampleRate int) error {
+	basename, ext := splitFileName(fileName, "")
+	inFile, release, err := store.AudioPath(session, basename, ext)
+	if err != nil {
+		return conversionError{err}
+	}
+	outFile := filepath.Join(tmpDir, "converted.wav")
+	err = convertToWav(ctx, inFile, outFile, sampleRate)
+	release()
+	defer os.Remove(outFile)
+	if err != nil {
+		return conversionError{err}
+	}
+	return addFileToArchive(a, name, outFile)
+}
+
+// convertToWav converts an audio file to a mono wav file with the given sample rate, using ffmpeg. The conversion is
+// stopped if ctx is cancelled, or after wavConversionTimeout.
+func convertToWav(ctx context.Context, inFile, outFile string, sampleRate int) error {
+	ctx, cancel := context.WithTimeout(ctx, wavConversionTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-loglevel", "error", "-y", "-i", inFile, "-ar", strconv.Itoa(sampleRate), "-ac", "1", "-f", "wav", outFile)
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("ffmpeg timed out after %v for %s", wavConversionTimeout, inFile)
+	}
+	if err != nil {
+		return fmt.Errorf("ffmpeg failed for %s : %v : %s", inFile, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// datasetItems lists the utterances of the sessions. Utterances without an audio file, without text or with invalid
+// timecodes are skipped. Utterances without edited text are skipped, unless useRec is set, in which case the recogniser text is used.
+func datasetItems(sessions []string, useRec bool, audioExt string) ([]datasetItem, error) {
+	res := []datasetItem{}
+	for _, session := range sessions {
+		utts, err := readSessionUtterances(session)
+		if err != nil {
+			return res, err
+		}
+		for _, u := range utts {
+			if u.AudioFile == "" || u.TimeCodeEnd <= u.TimeCodeStart || (!u.HasEdi && !useRec) {
+				continue
+			}
+			text := strings.Join(strings.Fields(u.text()), " ")
+			if text == "" {
+				continue
+			}
+			ext := audioExt
+			if ext == "" {
+				ext = filepath.Ext(u.AudioFile)
+			}
+			res = append(res, datasetItem{
+				Path:      path.Join("clips", session, u.Basename+ext),
+				Sentence:  text,
+				Duration:  float64(u.TimeCodeEnd-u.TimeCodeStart) / 1000,
+				Locale:    u.Language,
+				SessionID: session,
+				StartTime: float64(u.TimeCodeStart) / 1000,
+				EndTime:   float64(u.TimeCodeEnd) / 1000,
+				audioFile: u.AudioFile,
+			})
+		}
+	}
+	return res, nil
+}
+
+func datasetManifest(items []datasetItem, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	if format == "jsonl" {
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		for _, it := range items {
+			err := enc.Encode(it)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return buf.Bytes(), nil
+	}
+	cw := csv.NewWriter(&buf)
+	cw.Write(datasetColumns)
+	for _, it := range items {
+		cw.Write(it.csvRecord())
+	}
+	cw.Flush()
+	return buf.Bytes(), cw.Error()
+}
+
+// exportDataset returns an archive with a manifest file and the audio files of the sessions given by the URL parameter 'session'
+// (default: all sessions). URL parameters:
+// 'format' (csv or jsonl, default csv) is the manifest format,
+// 'archive' (zip or tar, default zip) the archive format,
+// 'audio' (copy or wav, default copy) decides if audio files are copied as is, or converted to wav using ffmpeg,
+// one at a time while the archive is written. Exports of more than maxWavExport utterances are rejected with wav.
+// Utterances that fail to convert are left out of the manifest, and listed in errors.txt. The manifest is added after
+// the audio files, so that it only lists the exported utterances.
+// 'sample_rate' is the sample rate of converted audio (default 16000), and
+// 'unedited' (skip or rec, default skip) decides if utterances without edited text are skipped, or exported with the recogniser text.
+func exportDataset(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	badRequest := func(msg string) {
+		msg = "exportDataset: " + msg
+		log.Print(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+	}
+	param := func(name, defaultValue string, values ...string) (string, bool) {
+		v := q.Get(name)
+		if v == "" {
+			return defaultValue, true
+		}
+		if !contains(values, v) {
+			badRequest(fmt.Sprintf("invalid value for %s: '%s' (expected %s)", name, v, strings.Join(values, " or ")))
+			return v, false
+		}
+		return v, true
+	}
+	format, ok := param("format", "csv", "csv", "jsonl")
+	if !ok {
+		return
+	}
+	archive, ok := param("archive", "zip", "zip", "tar")
+	if !ok {
+		return
+	}
+	audio, ok := param("audio", "copy", "copy", "wav")
+	if !ok {
+		return
+	}
+	unedited, ok := param("unedited", "skip", "skip", "rec")
+	if !ok {
+		return
+	}
+	sampleRate := 16000
+	if q.Get("sample_rate") != "" {
+		sr, err := strconv.Atoi(q.Get("sample_rate"))
+		if err != nil || sr <= 0 {
+			badRequest(fmt.Sprintf("invalid sample_rate '%s'", q.Get("sample_rate")))
+			return
+		}
+		sampleRate = sr
+	}
+	if audio == "wav" {
+		if _, err := exec.LookPath("ffmpeg"); err != nil {
+			badRequest("audio conversion requires ffmpeg, which is not installed")
+			return
+		}
+	}
+
+	sessions, err := exportSessionNames(r)
+	if err != nil {
+		badRequest(err.Error())
+		return
+	}
+	audioExt := ""
+	if audio == "wav" {
+		audioExt = ".wav"
+	}
+	items, err := datasetItems(sessions, unedited == "rec", audioExt)
+	if err != nil {
+		msg := fmt.Sprintf("exportDataset: %v", err)
+		log.Print(msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	if audio == "wav" && len(items) > maxWavExport {
+		msg := fmt.Sprintf("exportDataset: too many utterances to convert to wav: %d (max %d). Export fewer sessions, or use audio=copy", len(items), maxWavExport)
+		log.Print(msg)
+		http.Error(w, msg, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	tmpDir := ""
+	if audio == "wav" {
+		tmpDir, err = ioutil.TempDir("", "chromedictator_export")
+		if err != nil {
+			msg := fmt.Sprintf("exportDataset: failed to create temp dir : %v", err)
+			log.Print(msg)
+			http.Error(w, msg, http.StatusInternalServerError)
+			return
+		}
+		defer os.RemoveAll(tmpDir)
+	}
+
+	var a archiveWriter
+	if archive == "tar" {
+		w.Header().Set("Content-Type", "application/x-tar")
+		a = tarArchive{tar.NewWriter(w)}
+	} else {
+		w.Header().Set("Content-Type", "application/zip")
+		a = zipArchive{zip.NewWriter(w)}
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"dataset.%s\"", archive))
+
+	exported := []datasetItem{}
+	var convertErrs []string
+	for _, it := range items {
+		if audio == "wav" {
+			err = addWavToArchive(r.Context(), a, path.Join("dataset", it.Path), it.SessionID, it.audioFile, tmpDir, sampleRate)
+			if r.Context().Err() != nil {
+				log.Printf("exportDataset: export cancelled : %v", r.Context().Err())
+				return
+			}
+			if _, ok := err.(conversionError); ok {
+				log.Printf("exportDataset: %v", err)
+				convertErrs = append(convertErrs, fmt.Sprintf("%s: %v", it.Path, err))
+				continue
+			}
+		} else {
+			err = addAudioToArchive(a, path.Join("dataset", it.Path), it.SessionID, it.audioFile)
+		}
+		if err != nil {
+			log.Printf("exportDataset: failed to write archive : %v", err)
+			return
+		}
+		exported = append(exported, it)
+	}
+
+	manifest, err := datasetManifest(exported, format)
+	if err != nil {
+		log.Printf("exportDataset: failed to create manifest : %v", err)
+		return
+	}
+	err = a.add(path.Join("dataset", "metadata."+format), int64(len(manifest)), bytes.NewReader(manifest))
+	if err == nil && len(convertErrs) > 0 {
+		errs := []byte(strings.Join(convertErrs, "\n") + "\n")
+		err = a.add(path.Join("dataset", "errors.txt"), int64(len(errs)), bytes.NewReader(errs))
+	}
+	if err != nil {
+		log.Printf("exportDataset: failed to write archive : %v", err)
+		return
+	}
+	err = a.Close()
+	if err != nil {
+		log.Printf("exportDataset: failed to write archive : %v", err)
+	}
+}
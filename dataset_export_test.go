@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConvertToWavTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as ffmpeg")
+	}
+	dir, err := ioutil.TempDir("", "chromedictator_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// an ffmpeg that never finishes
+	err = ioutil.WriteFile(filepath.Join(dir, "ffmpeg"), []byte("#!/bin/sh\nexec sleep 60\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPath, oldTimeout := os.Getenv("PATH"), wavConversionTimeout
+	defer func() {
+		os.Setenv("PATH", oldPath)
+		wavConversionTimeout = oldTimeout
+	}()
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+oldPath)
+	wavConversionTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	err = convertToWav(context.Background(), "in.webm", filepath.Join(dir, "out.wav"), 16000)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("conversion was not stopped: took %v", d)
+	}
+
+	// cancelled by the caller, e.g. when the client disconnects
+	ctx, cancel := context.WithCancel(context.Background())
+	wavConversionTimeout = time.Minute
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start = time.Now()
+	err = convertToWav(ctx, "in.webm", filepath.Join(dir, "out.wav"), 16000)
+	if err == nil {
+		t.Errorf("expected error for cancelled conversion")
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("conversion was not stopped: took %v", d)
+	}
+}
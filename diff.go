@@ -0,0 +1,98 @@
+package main
+
+import "strings"
+
+// diffOp is a part of a diff: words that are in both texts (=), only in the new text (+), or only in the old text (-)
+type diffOp struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// maxDiffCells limits the size of the table used to compare the differing parts of two texts.
+// Larger differences are reported as the old part removed and the new part added.
+var maxDiffCells = 4000000
+
+// diffWords compares two word sequences, using the longest common subsequence, and returns the differences.
+// Consecutive words with the same op are joined by spaces.
+func diffWords(old, new []string) []diffOp {
+	res := []diffOp{}
+	var words []string
+	op := ""
+	add := func(o, w string) {
+		if o != op && len(words) > 0 {
+			res = append(res, diffOp{Op: op, Text: strings.Join(words, " ")})
+			words = nil
+		}
+		op = o
+		words = append(words, w)
+	}
+
+	// the common prefix and suffix are not part of the table
+	prefix := 0
+	for prefix < len(old) && prefix < len(new) && old[prefix] == new[prefix] {
+		add("=", old[prefix])
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(old)-prefix && suffix < len(new)-prefix && old[len(old)-1-suffix] == new[len(new)-1-suffix] {
+		suffix++
+	}
+	oldSuffix := old[len(old)-suffix:]
+	old, new = old[prefix:len(old)-suffix], new[prefix:len(new)-suffix]
+
+	if len(old) > 0 && len(new) > 0 && len(old) > maxDiffCells/len(new) {
+		for _, w := range old {
+			add("-", w)
+		}
+		for _, w := range new {
+			add("+", w)
+		}
+		old, new = nil, nil
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of old[i:] and new[j:]
+	lcs := make([][]int, len(old)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(new)+1)
+	}
+	for i := len(old) - 1; i >= 0; i-- {
+		for j := len(new) - 1; j >= 0; j-- {
+			if old[i] == new[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(old) && j < len(new) {
+		switch {
+		case old[i] == new[j]:
+			add("=", old[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			add("-", old[i])
+			i++
+		default:
+			add("+", new[j])
+			j++
+		}
+	}
+	for ; i < len(old); i++ {
+		add("-", old[i])
+	}
+	for ; j < len(new); j++ {
+		add("+", new[j])
+	}
+	for _, w := range oldSuffix {
+		add("=", w)
+	}
+	if len(words) > 0 {
+		res = append(res, diffOp{Op: op, Text: strings.Join(words, " ")})
+	}
+	return res
+}
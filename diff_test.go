@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffWords(t *testing.T) {
+	tests := []struct {
+		old, new string
+		expect   []diffOp
+	}{
+		{"", "", []diffOp{}},
+		{"a b c", "a b c", []diffOp{{"=", "a b c"}}},
+		{"", "a b", []diffOp{{"+", "a b"}}},
+		{"a b", "", []diffOp{{"-", "a b"}}},
+		{"a b c d", "a x c d", []diffOp{{"=", "a"}, {"-", "b"}, {"+", "x"}, {"=", "c d"}}},
+		{"a b c", "b c d", []diffOp{{"-", "a"}, {"=", "b c"}, {"+", "d"}}},
+		{"a a a", "a a", []diffOp{{"=", "a a"}, {"-", "a"}}},
+		{"x a y b z", "a b", []diffOp{{"-", "x"}, {"=", "a"}, {"-", "y"}, {"=", "b"}, {"-", "z"}}},
+	}
+	for _, test := range tests {
+		res := diffWords(strings.Fields(test.old), strings.Fields(test.new))
+		if !reflect.DeepEqual(res, test.expect) {
+			t.Errorf("'%s' -> '%s': expected %v, got %v", test.old, test.new, test.expect, res)
+		}
+	}
+}
+
+// differences too large to compare are reported as a replacement, keeping the common prefix and suffix
+func TestDiffWordsLimit(t *testing.T) {
+	defer func(n int) { maxDiffCells = n }(maxDiffCells)
+	maxDiffCells = 3
+
+	res := diffWords(strings.Fields("a b c d e"), strings.Fields("a c x d e"))
+	expect := []diffOp{{"=", "a"}, {"-", "b c"}, {"+", "c x"}, {"=", "d e"}}
+	if !reflect.DeepEqual(res, expect) {
+		t.Errorf("expected %v, got %v", expect, res)
+	}
+	// within the limit
+	maxDiffCells = 4
+	res = diffWords(strings.Fields("a b c e"), strings.Fields("a c x e"))
+	expect = []diffOp{{"=", "a"}, {"-", "b"}, {"=", "c"}, {"+", "x"}, {"=", "e"}}
+	if !reflect.DeepEqual(res, expect) {
+		t.Errorf("expected %v, got %v", expect, res)
+	}
+}
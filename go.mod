@@ -4,5 +4,8 @@ go 1.12
 
 require (
 	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/websocket v1.4.2
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/stts-se/rec v0.0.0-20200309103614-e11d9ccfaf2c
+	golang.org/x/text v0.13.0
 )
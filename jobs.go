@@ -0,0 +1,514 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stts-se/rec"
+)
+
+// Asynchronous speech recognition. Jobs are run in the background by a fixed number of workers,
+// and the job list is saved to disk on every change, so that unfinished jobs can be restarted
+// if the server is restarted. The results are saved in a file per job (see jobResultPath), so that
+// the job list stays small.
+
+var jobFilePath = path.Join(baseDir, "recognition_jobs.json")
+
+// jobResultPath returns the path of the result file of a job
+func jobResultPath(id string) string {
+	return path.Join(baseDir, "recognition_job-"+id+".json")
+}
+
+// finished jobs older than this are removed, along with their results
+var jobRetention = 7 * 24 * time.Hour
+
+// max number of queued jobs
+const jobQueueSize = 1000
+
+// Job status values
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+type recognitionJob struct {
+	ID        string `json:"id"`
+	SessionID string `json:"session_id"`
+	FileName  string `json:"file_name"`
+	Backend   string `json:"backend"`
+	Language  string `json:"language"`
+	Expand    bool   `json:"expand"`
+
+	Status string `json:"status"`
+	// Progress: the estimated share of the job done, from 0 (queued) to 1 (done). Recognisers don't report their
+	// progress, so it's estimated from the running time and the audio duration (see jobQueue.progress).
+	Progress float64 `json:"progress"`
+	Error    string  `json:"error,omitempty"`
+	// AudioDuration: the length of the audio in milliseconds, or 0 if not known
+	AudioDuration int64 `json:"audio_duration,omitempty"`
+
+	Created string `json:"created"`
+	Started string `json:"started,omitempty"`
+	Updated string `json:"updated"`
+
+	cancel context.CancelFunc
+}
+
+func (j *recognitionJob) finished() bool {
+	return j.Status == jobDone || j.Status == jobFailed || j.Status == jobCancelled
+}
+
+// expired returns true for a finished job that was last updated before the retention time
+func (j *recognitionJob) expired() bool {
+	if !j.finished() {
+		return false
+	}
+	t, err := time.Parse(time.RFC3339, j.Updated)
+	return err == nil && time.Since(t) > jobRetention
+}
+
+func (j *recognitionJob) setStatus(status string) {
+	j.Status = status
+	j.Updated = time.Now().UTC().Format(time.RFC3339)
+}
+
+type jobQueue struct {
+	mutex *sync.Mutex
+	jobs  map[string]*recognitionJob
+	queue chan string
+	// realTimeFactor: the running time of recent jobs divided by their audio duration
+	realTimeFactor float64
+}
+
+// the real time factor used until a job has been done
+const defaultRealTimeFactor = 1.0
+
+var recognitionJobs *jobQueue
+
+func newJobID() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("failed to create job id : %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// newJobQueue loads saved jobs (if any), and starts the workers. Unfinished jobs are queued again.
+func newJobQueue(workers int) (*jobQueue, error) {
+	q := &jobQueue{
+		mutex:          &sync.Mutex{},
+		jobs:           make(map[string]*recognitionJob),
+		queue:          make(chan string, jobQueueSize),
+		realTimeFactor: defaultRealTimeFactor,
+	}
+
+	saved := []*recognitionJob{}
+	if _, err := os.Stat(jobFilePath); !os.IsNotExist(err) {
+		bts, err := ioutil.ReadFile(jobFilePath)
+		if err != nil {
+			return q, fmt.Errorf("newJobQueue: failed to read job file : %v", err)
+		}
+		err = json.Unmarshal(bts, &saved)
+		if err != nil {
+			return q, fmt.Errorf("newJobQueue: couldn't unmarshal JSON : %v", err)
+		}
+	}
+	restarted := 0
+	for _, j := range saved {
+		if j.finished() {
+			q.jobs[j.ID] = j
+			continue
+		}
+		if len(q.queue) == cap(q.queue) {
+			j.setStatus(jobFailed)
+			j.Error = "job queue full at restart"
+			q.jobs[j.ID] = j
+			continue
+		}
+		j.setStatus(jobQueued)
+		j.Progress = 0
+		j.Started = ""
+		q.jobs[j.ID] = j
+		q.queue <- j.ID
+		restarted++
+	}
+	if restarted > 0 {
+		log.Printf("restarted %d unfinished recognition job(s)", restarted)
+	}
+
+	q.mutex.Lock()
+	q.expire()
+	err := q.save()
+	q.mutex.Unlock()
+	if err != nil {
+		return q, err
+	}
+
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+	return q, nil
+}
+
+// expire removes expired jobs and their results. Should be called with q.mutex locked.
+func (q *jobQueue) expire() {
+	for id, j := range q.jobs {
+		if j.expired() {
+			delete(q.jobs, id)
+			if err := os.Remove(jobResultPath(id)); err != nil && !os.IsNotExist(err) {
+				log.Printf("recognition job %s: failed to remove result : %v", id, err)
+			}
+		}
+	}
+}
+
+// save writes all jobs (without results) to disk. Should be called with q.mutex locked.
+func (q *jobQueue) save() error {
+	list := []*recognitionJob{}
+	for _, j := range q.jobs {
+		list = append(list, j)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created < list[j].Created })
+	bts, err := json.Marshal(list)
+	if err != nil {
+		return fmt.Errorf("failed to marshal jobs : %v", err)
+	}
+	err = writeFileAtomic(jobFilePath, bts, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to save job file : %v", err)
+	}
+	return nil
+}
+
+func (q *jobQueue) submit(j *recognitionJob) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	id, err := newJobID()
+	if err != nil {
+		return err
+	}
+	j.ID = id
+	j.Created = time.Now().UTC().Format(time.RFC3339Nano)
+	j.setStatus(jobQueued)
+	select {
+	case q.queue <- j.ID:
+	default:
+		return fmt.Errorf("job queue is full")
+	}
+	q.jobs[j.ID] = j
+	q.expire()
+	return q.save()
+}
+
+// progress returns the progress of a job. A running job's progress is estimated as the running time divided by the
+// expected running time (the audio duration times the real time factor of earlier jobs), and is at most 0.99 until the
+// job is done. If the audio duration isn't known, it's 0. Should be called with q.mutex locked.
+func (q *jobQueue) progress(j *recognitionJob, now time.Time) float64 {
+	if j.Status != jobRunning {
+		return j.Progress
+	}
+	started, err := time.Parse(time.RFC3339Nano, j.Started)
+	if err != nil || j.AudioDuration <= 0 {
+		return 0
+	}
+	expected := float64(j.AudioDuration) * q.realTimeFactor
+	res := float64(now.Sub(started)/time.Millisecond) / expected
+	if res > 0.99 {
+		res = 0.99
+	}
+	return res
+}
+
+// copyJob returns a copy of a job, with the current progress. Should be called with q.mutex locked.
+func (q *jobQueue) copyJob(j *recognitionJob) recognitionJob {
+	res := *j
+	res.Progress = q.progress(j, time.Now())
+	return res
+}
+
+// get returns a copy of a job
+func (q *jobQueue) get(id string) (recognitionJob, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	j, ok := q.jobs[id]
+	if !ok {
+		return recognitionJob{}, false
+	}
+	return q.copyJob(j), true
+}
+
+func (q *jobQueue) cancel(id string) (recognitionJob, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	j, ok := q.jobs[id]
+	if !ok {
+		return recognitionJob{}, fmt.Errorf("no such job: %s", id)
+	}
+	if j.finished() {
+		return *j, fmt.Errorf("job %s is already %s", id, j.Status)
+	}
+	if j.cancel != nil {
+		// running job, status is set by the worker when the recogniser returns
+		j.cancel()
+	}
+	j.Progress = q.progress(j, time.Now())
+	j.setStatus(jobCancelled)
+	return *j, q.save()
+}
+
+func (q *jobQueue) worker() {
+	for id := range q.queue {
+		q.run(id)
+	}
+}
+
+func (q *jobQueue) run(id string) {
+	q.mutex.Lock()
+	j, ok := q.jobs[id]
+	if !ok || j.Status != jobQueued {
+		// cancelled while queued
+		q.mutex.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j.cancel = cancel
+	j.setStatus(jobRunning)
+	j.Started = time.Now().UTC().Format(time.RFC3339Nano)
+	if err := q.save(); err != nil {
+		log.Printf("recognition job %s: %v", id, err)
+	}
+	backend, fileName, lang, session, expand := j.Backend, j.FileName, j.Language, j.SessionID, j.Expand
+	q.mutex.Unlock()
+
+	var res RecognitionResult
+	recognizer, err := getRecognizer(backend)
+	if err == nil {
+		res, err = recogniseFile(ctx, recognizer, session, fileName, lang)
+	}
+	if err == nil && expand {
+		expandRecognitionResult(&res, session, lang)
+	}
+	if err == nil && ctx.Err() == nil {
+		err = saveJobResult(id, res)
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	j.cancel = nil
+	now := time.Now()
+	switch {
+	case ctx.Err() == context.Canceled:
+		// cancel has set the status and progress
+		j.setStatus(jobCancelled)
+	case err != nil:
+		j.Progress = q.progress(j, now)
+		j.setStatus(jobFailed)
+		j.Error = err.Error()
+		log.Printf("recognition job %s failed : %v", id, err)
+	default:
+		q.updateRealTimeFactor(j, now)
+		j.setStatus(jobDone)
+		j.Progress = 1
+	}
+	if err := q.save(); err != nil {
+		log.Printf("recognition job %s: %v", id, err)
+	}
+}
+
+// updateRealTimeFactor adds the running time of a finished job to the real time factor, as a moving average. Should be
+// called with q.mutex locked.
+func (q *jobQueue) updateRealTimeFactor(j *recognitionJob, now time.Time) {
+	started, err := time.Parse(time.RFC3339Nano, j.Started)
+	if err != nil || j.AudioDuration <= 0 {
+		return
+	}
+	rtf := float64(now.Sub(started)/time.Millisecond) / float64(j.AudioDuration)
+	q.realTimeFactor = 0.8*q.realTimeFactor + 0.2*rtf
+}
+
+func saveJobResult(id string, res RecognitionResult) error {
+	bts, err := json.Marshal(res)
+	if err != nil {
+		return fmt.Errorf("failed to marshal result : %v", err)
+	}
+	err = writeFileAtomic(jobResultPath(id), bts, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to save result : %v", err)
+	}
+	return nil
+}
+
+func readJobResult(id string) (RecognitionResult, error) {
+	var res RecognitionResult
+	bts, err := ioutil.ReadFile(jobResultPath(id))
+	if err != nil {
+		return res, err
+	}
+	err = json.Unmarshal(bts, &res)
+	if err != nil {
+		return res, fmt.Errorf("couldn't unmarshal JSON : %v", err)
+	}
+	return res, nil
+}
+
+func writeJobJSON(w http.ResponseWriter, status int, v interface{}) {
+	resJSON, err := rec.PrettyMarshal(v)
+	if err != nil {
+		msg := fmt.Sprintf("failed to create JSON from struct : %v", err)
+		log.Print(msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s\n", string(resJSON))
+}
+
+// submitRecognitionJob queues a recognition job, and returns the job (with its id) with status 202 Accepted.
+// Same parameters as recognise.
+func submitRecognitionJob(w http.ResponseWriter, r *http.Request) {
+	session, fileName, backend, lang, err := recogniseParams(r)
+	if err != nil {
+		msg := fmt.Sprintf("submitRecognitionJob: param check failed : %v", err)
+		log.Print(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	recognizer, err := getRecognizer(backend)
+	if err != nil {
+		msg := fmt.Sprintf("submitRecognitionJob: %v", err)
+		log.Print(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	basename, ext := splitFileName(fileName, "webm")
+	if !store.Exists(session, basename+"."+ext) {
+		msg := fmt.Sprintf("submitRecognitionJob: no such file: %s", fileName)
+		log.Print(msg)
+		http.Error(w, msg, http.StatusNotFound)
+		return
+	}
+
+	j := &recognitionJob{
+		SessionID:     session,
+		FileName:      fileName,
+		Backend:       recognizer.Name(),
+		Language:      lang,
+		Expand:        r.URL.Query().Get("expand") == "true",
+		AudioDuration: audioDuration(session, basename),
+	}
+	err = recognitionJobs.submit(j)
+	if err != nil {
+		msg := fmt.Sprintf("submitRecognitionJob: %v", err)
+		log.Print(msg)
+		http.Error(w, msg, http.StatusServiceUnavailable)
+		return
+	}
+	job, _ := recognitionJobs.get(j.ID)
+	writeJobJSON(w, http.StatusAccepted, job)
+}
+
+// audioDuration returns the length in milliseconds of an utterance's audio, from the .json file (0 if not known)
+func audioDuration(session, basename string) int64 {
+	jsonObj, err := store.Metadata(session, basename)
+	if err != nil {
+		return 0
+	}
+	if jsonObj.AudioInfo != nil && jsonObj.AudioInfo.Duration > 0 {
+		return jsonObj.AudioInfo.Duration
+	}
+	if jsonObj.TimeCodeEnd > jsonObj.TimeCodeStart {
+		return jsonObj.TimeCodeEnd - jsonObj.TimeCodeStart
+	}
+	return 0
+}
+
+// listRecognitionJobs lists all jobs, optionally filtered by the 'status' and 'session' URL parameters
+func listRecognitionJobs(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	session := r.URL.Query().Get("session")
+	res := []recognitionJob{}
+	recognitionJobs.mutex.Lock()
+	for _, j := range recognitionJobs.jobs {
+		if (status == "" || j.Status == status) && (session == "" || j.SessionID == session) {
+			res = append(res, recognitionJobs.copyJob(j))
+		}
+	}
+	recognitionJobs.mutex.Unlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].Created < res[j].Created })
+	writeJobJSON(w, http.StatusOK, res)
+}
+
+// recognitionJobStatus returns a job
+func recognitionJobStatus(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	j, ok := recognitionJobs.get(id)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no such job: %s", id), http.StatusNotFound)
+		return
+	}
+	writeJobJSON(w, http.StatusOK, j)
+}
+
+// recognitionJobResult returns the result of a finished job. If the job isn't done, 409 Conflict is returned.
+func recognitionJobResult(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	j, ok := recognitionJobs.get(id)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no such job: %s", id), http.StatusNotFound)
+		return
+	}
+	if j.Status != jobDone {
+		http.Error(w, fmt.Sprintf("job %s is %s", id, j.Status), http.StatusConflict)
+		return
+	}
+	result, err := readJobResult(id)
+	if err != nil {
+		msg := fmt.Sprintf("recognitionJobResult: failed to read result of job %s : %v", id, err)
+		log.Print(msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	res := recogniseResponse{
+		SessionObject:     SessionObject{j.SessionID},
+		FileName:          j.FileName,
+		Backend:           j.Backend,
+		Language:          j.Language,
+		RecognitionResult: result,
+	}
+	writeJobJSON(w, http.StatusOK, res)
+}
+
+func cancelRecognitionJob(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, ok := recognitionJobs.get(id); !ok {
+		http.Error(w, fmt.Sprintf("no such job: %s", id), http.StatusNotFound)
+		return
+	}
+	j, err := recognitionJobs.cancel(id)
+	if err != nil {
+		msg := fmt.Sprintf("cancelRecognitionJob: %v", err)
+		log.Print(msg)
+		http.Error(w, msg, http.StatusConflict)
+		return
+	}
+	writeJobJSON(w, http.StatusOK, j)
+}
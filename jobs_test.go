@@ -0,0 +1,41 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestJobProgress(t *testing.T) {
+	q := &jobQueue{realTimeFactor: defaultRealTimeFactor}
+	now := time.Now()
+	started := now.Add(-time.Second).UTC().Format(time.RFC3339Nano)
+	tests := []struct {
+		name   string
+		job    recognitionJob
+		rtf    float64
+		expect float64
+	}{
+		{"queued", recognitionJob{Status: jobQueued, AudioDuration: 2000}, 1, 0},
+		{"done", recognitionJob{Status: jobDone, Progress: 1, AudioDuration: 2000}, 1, 1},
+		{"half way", recognitionJob{Status: jobRunning, Started: started, AudioDuration: 2000}, 1, 0.5},
+		{"slow recogniser", recognitionJob{Status: jobRunning, Started: started, AudioDuration: 2000}, 2, 0.25},
+		{"longer than expected", recognitionJob{Status: jobRunning, Started: started, AudioDuration: 500}, 1, 0.99},
+		{"unknown duration", recognitionJob{Status: jobRunning, Started: started}, 1, 0},
+		{"failed", recognitionJob{Status: jobFailed, Progress: 0.3, Started: started, AudioDuration: 2000}, 1, 0.3},
+	}
+	for _, test := range tests {
+		q.realTimeFactor = test.rtf
+		if res := q.progress(&test.job, now); res != test.expect {
+			t.Errorf("%s: expected progress %v, got %v", test.name, test.expect, res)
+		}
+	}
+
+	// the real time factor moves towards that of finished jobs
+	q.realTimeFactor = 1
+	j := recognitionJob{Status: jobRunning, Started: started, AudioDuration: 500}
+	q.updateRealTimeFactor(&j, now)
+	if expect := 1.2; math.Abs(q.realTimeFactor-expect) > 1e-9 {
+		t.Errorf("expected real time factor %v, got %v", expect, q.realTimeFactor)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Export of sessions as a Kaldi data directory, for ASR training. Each utterance is its own recording,
+// and the session is used as speaker id, since speakers are not known.
+
+type kaldiUtterance struct {
+	uttID     string
+	spkID     string
+	audioFile string // <session>/<basename>.<ext>
+	text      string
+	dur       float64 // seconds
+	unedited  bool
+}
+
+// kaldiID replaces white space, which can't be used in Kaldi ids
+func kaldiID(s string) string {
+	return strings.Join(strings.Fields(s), "_")
+}
+
+func kaldiQuote(s string) string {
+	if strings.ContainsAny(s, " \t'") {
+		return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+	}
+	return s
+}
+
+// wavScpEntry returns the wav.scp entry of an audio file: the file itself for .wav files, otherwise an ffmpeg command converting it to wav
+func wavScpEntry(audioFile string, sampleRate int) string {
+	if strings.ToLower(filepath.Ext(audioFile)) == ".wav" {
+		if strings.ContainsAny(audioFile, " \t") {
+			return fmt.Sprintf("cat %s |", kaldiQuote(audioFile))
+		}
+		return audioFile
+	}
+	return fmt.Sprintf("ffmpeg -loglevel error -i %s -f wav -ar %d -ac 1 - |", kaldiQuote(audioFile), sampleRate)
+}
+
+// kaldiUtterances reads the utterances of the sessions. Utterances without an audio file, without text or with invalid
+// timecodes are skipped. The unedited parameter decides what to do with utterances without edited text:
+// skip them (skip), use the recogniser text (rec), or use the recogniser text and list them in the file 'unedited' (mark).
+func kaldiUtterances(sessions []string, unedited string) ([]kaldiUtterance, error) {
+	res := []kaldiUtterance{}
+	for _, session := range sessions {
+		utts, err := readSessionUtterances(session)
+		if err != nil {
+			return res, err
+		}
+		for _, u := range utts {
+			if u.AudioFile == "" {
+				log.Printf("kaldiUtterances: no audio file for %s/%s, skipping", session, u.Basename)
+				continue
+			}
+			if u.TimeCodeEnd <= u.TimeCodeStart {
+				log.Printf("kaldiUtterances: invalid timecodes for %s/%s: %d-%d, skipping", session, u.Basename, u.TimeCodeStart, u.TimeCodeEnd)
+				continue
+			}
+			if !u.HasEdi && unedited == "skip" {
+				continue
+			}
+			ku := kaldiUtterance{
+				spkID:     kaldiID(session),
+				audioFile: path.Join(session, u.audioFileWithExt("wav")),
+				text:      strings.Join(strings.Fields(u.text()), " "),
+				dur:       float64(u.TimeCodeEnd-u.TimeCodeStart) / 1000,
+				unedited:  !u.HasEdi && unedited == "mark",
+			}
+			if ku.text == "" {
+				continue
+			}
+			ku.uttID = ku.spkID + "-" + kaldiID(u.Basename)
+			res = append(res, ku)
+		}
+	}
+	// Kaldi requires files sorted on id
+	sort.Slice(res, func(i, j int) bool { return res[i].uttID < res[j].uttID })
+	return res, nil
+}
+
+// kaldiDataDir returns the files of a Kaldi data directory (file name -> contents).
+// Audio files in wav.scp are given as paths in audioDir, which should have the session folders.
+func kaldiDataDir(utts []kaldiUtterance, audioDir string, sampleRate int) map[string]string {
+	var wavScp, text, segments, utt2spk, utt2dur, spk2utt, uneditedList strings.Builder
+	spks := []string{}
+	spkUtts := make(map[string][]string)
+	for _, u := range utts {
+		audioFile := path.Join(audioDir, u.audioFile)
+		fmt.Fprintf(&wavScp, "%s %s\n", u.uttID, wavScpEntry(audioFile, sampleRate))
+		fmt.Fprintf(&text, "%s %s\n", u.uttID, u.text)
+		fmt.Fprintf(&segments, "%s %s 0.000 %.3f\n", u.uttID, u.uttID, u.dur)
+		fmt.Fprintf(&utt2spk, "%s %s\n", u.uttID, u.spkID)
+		fmt.Fprintf(&utt2dur, "%s %.3f\n", u.uttID, u.dur)
+		if u.unedited {
+			fmt.Fprintf(&uneditedList, "%s\n", u.uttID)
+		}
+		if _, ok := spkUtts[u.spkID]; !ok {
+			spks = append(spks, u.spkID)
+		}
+		spkUtts[u.spkID] = append(spkUtts[u.spkID], u.uttID)
+	}
+	sort.Strings(spks)
+	for _, spk := range spks {
+		fmt.Fprintf(&spk2utt, "%s %s\n", spk, strings.Join(spkUtts[spk], " "))
+	}
+	res := map[string]string{
+		"wav.scp":  wavScp.String(),
+		"text":     text.String(),
+		"segments": segments.String(),
+		"utt2spk":  utt2spk.String(),
+		"spk2utt":  spk2utt.String(),
+		"utt2dur":  utt2dur.String(),
+	}
+	if uneditedList.Len() > 0 {
+		res["unedited"] = uneditedList.String()
+	}
+	return res
+}
+
+// exportKaldi returns a zip archive with a Kaldi data directory for the sessions given by the URL parameter 'session' (default: all sessions).
+// The URL parameter 'unedited' (skip, rec or mark) decides what to do with utterances without edited text (see kaldiUtterances),
+// 'audio_dir' sets the directory of the session folders in wav.scp (default: the server's audio_files directory, required
+// if the audio files are kept in a database), and
+// 'sample_rate' the sample rate of converted audio (default 16000).
+func exportKaldi(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	unedited := q.Get("unedited")
+	if unedited == "" {
+		unedited = "skip"
+	}
+	if unedited != "skip" && unedited != "rec" && unedited != "mark" {
+		msg := fmt.Sprintf("exportKaldi: invalid value for unedited: '%s' (expected skip, rec or mark)", unedited)
+		log.Print(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	sampleRate := 16000
+	if q.Get("sample_rate") != "" {
+		sr, err := strconv.Atoi(q.Get("sample_rate"))
+		if err != nil || sr <= 0 {
+			msg := fmt.Sprintf("exportKaldi: invalid sample_rate '%s'", q.Get("sample_rate"))
+			log.Print(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		sampleRate = sr
+	}
+	audioDir := q.Get("audio_dir")
+	if audioDir == "" {
+		dir, ok := localDir(store)
+		if !ok {
+			msg := "exportKaldi: missing param 'audio_dir' (required when the audio files are kept in a database)"
+			log.Print(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			msg := fmt.Sprintf("exportKaldi: %v", err)
+			log.Print(msg)
+			http.Error(w, msg, http.StatusInternalServerError)
+			return
+		}
+		audioDir = filepath.ToSlash(abs)
+	}
+
+	sessions, err := exportSessionNames(r)
+	if err != nil {
+		msg := fmt.Sprintf("exportKaldi: %v", err)
+		log.Print(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	utts, err := kaldiUtterances(sessions, unedited)
+	if err != nil {
+		msg := fmt.Sprintf("exportKaldi: %v", err)
+		log.Print(msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	files := kaldiDataDir(utts, audioDir, sampleRate)
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"kaldi_data.zip\"")
+	zw := zip.NewWriter(w)
+	fNames := []string{}
+	for fName := range files {
+		fNames = append(fNames, fName)
+	}
+	sort.Strings(fNames)
+	for _, fName := range fNames {
+		fw, err := zw.Create(path.Join("data", fName))
+		if err == nil {
+			_, err = fw.Write([]byte(files[fName]))
+		}
+		if err != nil {
+			log.Printf("exportKaldi: failed to write %s : %v", fName, err)
+			return
+		}
+	}
+	err = zw.Close()
+	if err != nil {
+		log.Printf("exportKaldi: failed to write zip file : %v", err)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stts-se/chromedictator/webm"
+)
+
+// Live streaming of audio over a WebSocket during recording. The audio frames (e.g. from MediaRecorder with a timeslice)
+// are appended to a temporary file (see Store.TempFile) as they arrive, so that a recording isn't lost if the browser crashes.
+// The file is saved, in the same way as by uploadAudio, when the client sends a stop message or disconnects.
+
+// the connection is closed if no message is received for this long
+var liveIdleTimeout = time.Minute
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+// recordings being streamed (session/basename), so that the same file isn't streamed twice at the same time
+var liveRecordings = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+// liveMessage is a text message from the client: stop (save the recording) or cancel (remove it)
+type liveMessage struct {
+	Type        string `json:"type"`
+	EndTime     string `json:"end_time"`
+	TimeCodeEnd int64  `json:"time_code_end"`
+}
+
+// liveResponse is a text message to the client: saved, cancelled or error
+type liveResponse struct {
+	Type string `json:"type"`
+	uploadResponse
+}
+
+// same timestamp format as JavaScript's Date.toISOString()
+const jsTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// repairTruncated cuts an incomplete element off the end of a WebM file, as when the connection is lost in the
+// middle of a frame, and returns the duration of the audio. Other files are left as they are, and the duration is 0.
+func repairTruncated(fName string) (time.Duration, error) {
+	fh, err := os.Open(fName)
+	if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+	head := make([]byte, 4)
+	fh.Read(head)
+	if !webm.IsEBML(head) {
+		return 0, nil
+	}
+	_, err = fh.Seek(0, 0)
+	if err != nil {
+		return 0, err
+	}
+	info, err := webm.Inspect(fh)
+	if err == webm.ErrTruncated && info.ValidSize > 0 {
+		log.Printf("repairTruncated: truncating incomplete file %s at %d bytes", fName, info.ValidSize)
+		return info.Duration, os.Truncate(fName, info.ValidSize)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Duration, nil
+}
+
+// liveAudio receives audio over a WebSocket. The metadata is given as URL parameters when connecting, with the same
+// fields as for uploadAudio (except end_time and time_code_end), and file_extension is required. Binary messages are
+// audio data, which are appended to the file. The text message {"type":"stop"} (optionally with end_time and
+// time_code_end) saves the file, and {"type":"cancel"} removes it. If the client disconnects, or is silent for
+// liveIdleTimeout, the audio received so far is saved, with the end time of the last audio frame, and the time code end
+// computed from the length of the audio. If the audio file already exists, and over_write isn't set, the request is
+// rejected before the connection is upgraded, so that no audio is sent in vain.
+func liveAudio(w http.ResponseWriter, r *http.Request) {
+	values := make(map[string]string)
+	for k := range r.URL.Query() {
+		values[k] = r.URL.Query().Get(k)
+	}
+	ao, err := uploadMetadata(values, "")
+	if err != nil {
+		msg := "liveAudio: Incomplete upload metadata: " + err.Error()
+		log.Println("[chromedictator] " + msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	if err := checkOverwrite(ao); err != nil {
+		msg := "liveAudio: " + err.Error()
+		log.Println("[chromedictator] " + msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	key := path.Join(ao.SessionID, ao.FileName)
+	liveRecordings.Lock()
+	if liveRecordings.m[key] {
+		liveRecordings.Unlock()
+		msg := fmt.Sprintf("liveAudio: %s is already being recorded", key)
+		log.Println("[chromedictator] " + msg)
+		http.Error(w, msg, http.StatusConflict)
+		return
+	}
+	liveRecordings.m[key] = true
+	liveRecordings.Unlock()
+	defer func() {
+		liveRecordings.Lock()
+		delete(liveRecordings.m, key)
+		liveRecordings.Unlock()
+	}()
+
+	msg, err := checkAudioDirs(ao.SessionID)
+	if err != nil {
+		msg := fmt.Sprintf("liveAudio: %v", err)
+		log.Println("[chromedictator] " + msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	if msg != "" {
+		log.Printf("liveAudio: %s", msg)
+	}
+
+	fh, err := store.TempFile(ao.SessionID, ao.FileName+"."+ao.FileExtension+".live*~")
+	if err != nil {
+		msg := fmt.Sprintf("liveAudio: failed to create audio file : %v", err)
+		log.Println("[chromedictator] " + msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	liveFile := fh.Name()
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already sent an error response
+		log.Printf("liveAudio: %v", err)
+		fh.Close()
+		os.Remove(liveFile)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(maxUploadSize)
+
+	reply := func(resp liveResponse) {
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if err := conn.WriteJSON(resp); err != nil {
+			log.Printf("liveAudio: failed to send message : %v", err)
+		}
+	}
+	replyError := func(msg string) {
+		log.Printf("liveAudio: %s: %s", key, msg)
+		reply(liveResponse{Type: "error", uploadResponse: uploadResponse{Message: msg}})
+	}
+
+	started := time.Now()
+	lastFrame := started
+	var size int64
+	var stop *liveMessage
+	var writeErr error
+
+	for stop == nil {
+		conn.SetReadDeadline(time.Now().Add(liveIdleTimeout))
+		msgType, data, err := conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("liveAudio: %s: connection lost : %v", key, err)
+			}
+			break
+		}
+		if msgType == websocket.BinaryMessage {
+			if size+int64(len(data)) > maxUploadSize {
+				replyError(fmt.Sprintf("audio file too large (max %d bytes), saving the audio received so far", maxUploadSize))
+				break
+			}
+			_, writeErr = fh.Write(data)
+			if writeErr != nil {
+				replyError(fmt.Sprintf("failed to write audio file : %v", writeErr))
+				break
+			}
+			size += int64(len(data))
+			lastFrame = time.Now()
+			continue
+		}
+		var m liveMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			replyError(fmt.Sprintf("couldn't unmarshal message : %v", err))
+			continue
+		}
+		switch m.Type {
+		case "stop":
+			stop = &m
+		case "cancel":
+			fh.Close()
+			os.Remove(liveFile)
+			log.Printf("liveAudio: %s: recording cancelled", key)
+			reply(liveResponse{Type: "cancelled", uploadResponse: uploadResponse{Message: "recording cancelled"}})
+			return
+		default:
+			replyError(fmt.Sprintf("unknown message type '%s'", m.Type))
+		}
+	}
+
+	err = fh.Close()
+	if writeErr == nil && err != nil {
+		replyError(fmt.Sprintf("failed to write audio file : %v", err))
+	}
+	if size == 0 {
+		os.Remove(liveFile)
+		replyError("no audio received")
+		return
+	}
+
+	if stop != nil && stop.EndTime != "" {
+		ao.EndTime = stop.EndTime
+	} else {
+		ao.EndTime = lastFrame.UTC().Format(jsTimeFormat)
+	}
+	duration, err := repairTruncated(liveFile)
+	if err != nil {
+		log.Printf("liveAudio: failed to read %s : %v", liveFile, err)
+	}
+	if duration == 0 {
+		duration = lastFrame.Sub(started)
+	}
+	if stop != nil && stop.TimeCodeEnd > 0 {
+		ao.TimeCodeEnd = stop.TimeCodeEnd
+	} else {
+		ao.TimeCodeEnd = ao.TimeCodeStart + int64(duration/time.Millisecond)
+	}
+
+	info, err := os.Stat(liveFile)
+	var checksum string
+	if err == nil {
+		checksum, err = fileSHA256(liveFile)
+	}
+	if err != nil {
+		replyError(fmt.Sprintf("failed to read audio file : %v", err))
+		return
+	}
+	resp, _, err := saveUpload(ao, liveFile, info.Size(), checksum)
+	if err != nil {
+		if _, statErr := os.Stat(liveFile); statErr == nil {
+			log.Printf("liveAudio: kept unsaved audio in %s", liveFile)
+		}
+		replyError(err.Error())
+		return
+	}
+	log.Printf("liveAudio: %s: saved %d bytes", key, resp.Size)
+	reply(liveResponse{Type: "saved", uploadResponse: resp})
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"path"
+	"sync"
+)
+
+// keyLocks is a set of mutexes by key, which are created when needed, and removed when no longer used
+type keyLocks struct {
+	mutex sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int // number of goroutines holding or waiting for the lock
+}
+
+func newKeyLocks() *keyLocks {
+	return &keyLocks{locks: make(map[string]*keyLock)}
+}
+
+// lock locks the key, and returns a function that unlocks it
+func (k *keyLocks) lock(key string) func() {
+	k.mutex.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mutex.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		k.mutex.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mutex.Unlock()
+	}
+}
+
+// utteranceLocks are held while writing the files of an utterance (session and basename), so that writes to
+// the same utterance are done one at a time, while writes to other utterances and sessions run in parallel
+var utteranceLocks = newKeyLocks()
+
+// lockUtterance locks an utterance, and returns a function that unlocks it
+func lockUtterance(session, basename string) func() {
+	return utteranceLocks.lock(path.Join(session, basename))
+}
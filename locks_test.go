@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingStore is an fsStore where SaveText blocks until release is closed
+type blockingStore struct {
+	fsStore
+	entered chan string
+	release chan struct{}
+}
+
+func (s blockingStore) SaveText(session, basename, version, text string) error {
+	s.entered <- session
+	<-s.release
+	return s.fsStore.SaveText(session, basename, version, text)
+}
+
+func TestSavesToDifferentSessionsRunConcurrently(t *testing.T) {
+	_, cleanup := testStore(t)
+	defer cleanup()
+	const n = 8
+	bs := blockingStore{fsStore: store.(fsStore), entered: make(chan string, n), release: make(chan struct{})}
+	store = bs
+	router := testRouter()
+
+	var wg sync.WaitGroup
+	codes := make([]int, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			text := TextObject{JSONObject: JSONObject{SessionObject: SessionObject{SessionID: fmt.Sprintf("s%d", i)}}, FileName: "a", Data: "text"}
+			codes[i] = doRequest(router, "POST", "/save_recogniser_text", text).Code
+		}(i)
+	}
+
+	// all saves must be inside SaveText at the same time, which is impossible if they are run one at a time
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < n; i++ {
+		select {
+		case <-bs.entered:
+		case <-timeout:
+			close(bs.release)
+			wg.Wait()
+			t.Fatalf("only %d of %d saves to different sessions are running at the same time", i, n)
+		}
+	}
+	close(bs.release)
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("save %d: expected status %d, got %d", i, http.StatusOK, code)
+		}
+	}
+}
+
+func TestConcurrentTextAndAudioSaves(t *testing.T) {
+	dir, cleanup := testStore(t)
+	defer cleanup()
+	router := testRouter()
+	router.HandleFunc("/upload_audio", uploadAudio).Methods("POST")
+
+	const n = 10
+	checksums := make(map[string]bool)
+	texts := make(map[string]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		// audio of different lengths, so that a mix of writes would be noticed
+		audio := bytes.Repeat([]byte(fmt.Sprintf("audio %d ", i)), 1000*(i+1))
+		checksums[fmt.Sprintf("%x", sha256.Sum256(audio))] = true
+		text := fmt.Sprintf("text %d", i)
+		texts[text] = true
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			target := "/upload_audio?session_id=s&file_name=a&file_extension=wav&start_time=x&end_time=y&over_write=true"
+			req := httptest.NewRequest("POST", target, bytes.NewReader(audio))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Errorf("upload: expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			to := TextObject{JSONObject: JSONObject{SessionObject: SessionObject{SessionID: "s"}}, FileName: "a", Data: text, OverWrite: true}
+			w := doRequest(router, "POST", "/save_edited_text", to)
+			if w.Code != http.StatusOK {
+				t.Errorf("save text: expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+
+	jsonObj, err := store.Metadata("s", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := store.Audio("s", "a", "wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio, err := ioutil.ReadAll(blob)
+	blob.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum := fmt.Sprintf("%x", sha256.Sum256(audio))
+	if !checksums[checksum] {
+		t.Errorf("the audio file is not one of the uploaded files (%d bytes)", len(audio))
+	}
+	if jsonObj.AudioSHA256 != checksum {
+		t.Errorf("the .json file doesn't belong to the audio file: checksum %s, expected %s", jsonObj.AudioSHA256, checksum)
+	}
+	text, err := store.Text("s", "a", "edi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !texts[strings.TrimSpace(text)] {
+		t.Errorf("the edited text is not one of the saved texts: %q", text)
+	}
+
+	// no temporary files left, in the base dir (uploads) or in the session folder
+	for _, d := range []string{baseDir, filepath.Join(baseDir, "s")} {
+		files, err := ioutil.ReadDir(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range files {
+			if strings.HasSuffix(f.Name(), "~") {
+				t.Errorf("temporary file left: %s/%s", d, f.Name())
+			}
+		}
+	}
+	checkNoFilesOutside(t, dir)
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stts-se/chromedictator/subtitle"
+	"github.com/stts-se/rec"
+)
+
+// Recognizer is a speech recogniser backend, used for server side recognition of saved audio files
+type Recognizer interface {
+	// Name is used to select the backend in requests
+	Name() string
+
+	// Recognise runs speech recognition on an audio file. lang is a language code such as sv-SE.
+	Recognise(ctx context.Context, audioFile string, lang string) (RecognitionResult, error)
+}
+
+// RecognitionResult holds the output of a Recognizer
+type RecognitionResult struct {
+	Text     string    `json:"text"`
+	Segments []srtUnit `json:"segments"`
+}
+
+// RecognizerConfig is used to configure the recogniser backends at startup, from a JSON file containing a list of configs.
+type RecognizerConfig struct {
+	Name string `json:"name"`
+
+	// Type is one of command, http or stub
+	Type string `json:"type"`
+
+	// Command backend: the command to run, and its arguments.
+	// The arguments may contain the placeholders {input} (audio file), {output} (output file),
+	// {lang} (e.g. sv-SE) and {lang_base} (e.g. sv).
+	Command string   `json:"command,omitempty"`
+	Args    []string `json:"args,omitempty"`
+	// Output is the format of the command's output: srt (written to {output}) or text (written to stdout)
+	Output string `json:"output,omitempty"`
+
+	// HTTP backend: the audio file is posted to URL, with the language in the URL parameter 'lang'.
+	// The response should be a JSON RecognitionResult.
+	URL string `json:"url,omitempty"`
+
+	// Stub backend: the text to return, and a delay in seconds before returning it
+	Text  string `json:"text,omitempty"`
+	Delay int    `json:"delay,omitempty"`
+
+	// Timeout in seconds (default 300)
+	Timeout int `json:"timeout,omitempty"`
+}
+
+func (c RecognizerConfig) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return 300 * time.Second
+	}
+	return time.Duration(c.Timeout) * time.Second
+}
+
+var recognizers = make(map[string]Recognizer)
+var defaultRecognizer string
+var recognizerMutex = &sync.RWMutex{}
+
+func registerRecognizer(r Recognizer) error {
+	recognizerMutex.Lock()
+	defer recognizerMutex.Unlock()
+	if _, ok := recognizers[r.Name()]; ok {
+		return fmt.Errorf("recogniser already registered: %s", r.Name())
+	}
+	recognizers[r.Name()] = r
+	if defaultRecognizer == "" {
+		defaultRecognizer = r.Name()
+	}
+	return nil
+}
+
+// getRecognizer returns the named recogniser, or the default one if name is empty
+func getRecognizer(name string) (Recognizer, error) {
+	recognizerMutex.RLock()
+	defer recognizerMutex.RUnlock()
+	if name == "" {
+		name = defaultRecognizer
+	}
+	if len(recognizers) == 0 {
+		return nil, fmt.Errorf("no recogniser backends configured")
+	}
+	r, ok := recognizers[name]
+	if !ok {
+		return nil, fmt.Errorf("no such recogniser backend: %s", name)
+	}
+	return r, nil
+}
+
+func newRecognizer(c RecognizerConfig) (Recognizer, error) {
+	if c.Name == "" {
+		return nil, fmt.Errorf("missing name for recogniser of type '%s'", c.Type)
+	}
+	switch c.Type {
+	case "command":
+		if c.Command == "" {
+			return nil, fmt.Errorf("recogniser %s: missing command", c.Name)
+		}
+		if _, err := exec.LookPath(c.Command); err != nil {
+			return nil, fmt.Errorf("recogniser %s: external '%s' command does not exist", c.Name, c.Command)
+		}
+		if c.Output == "" {
+			c.Output = "srt"
+		}
+		if c.Output != "srt" && c.Output != "text" {
+			return nil, fmt.Errorf("recogniser %s: unknown output format '%s'", c.Name, c.Output)
+		}
+		return commandRecognizer{config: c}, nil
+	case "http":
+		if _, err := url.Parse(c.URL); err != nil || c.URL == "" {
+			return nil, fmt.Errorf("recogniser %s: invalid url '%s'", c.Name, c.URL)
+		}
+		return httpRecognizer{config: c, client: &http.Client{Timeout: c.timeout()}}, nil
+	case "stub":
+		return stubRecognizer{config: c}, nil
+	}
+	return nil, fmt.Errorf("recogniser %s: unknown type '%s'", c.Name, c.Type)
+}
+
+// autosubConfig is used if no recogniser config file is given, and the autosub command is available
+var autosubConfig = RecognizerConfig{
+	Name:    "autosub",
+	Type:    "command",
+	Command: "autosub",
+	Args:    []string{"-S", "{lang_base}", "-D", "{lang_base}", "-o", "{output}", "{input}"},
+	Output:  "srt",
+}
+
+// loadRecognizers registers the recogniser backends listed in a JSON config file.
+// If fName is empty, the autosub backend is registered if available.
+func loadRecognizers(fName string) error {
+	if fName == "" {
+		r, err := newRecognizer(autosubConfig)
+		if err != nil {
+			log.Printf("chromedictator autosub disabled: %v", err)
+			return nil
+		}
+		log.Println("chromedictator autosub enabled")
+		return registerRecognizer(r)
+	}
+
+	bts, err := ioutil.ReadFile(fName)
+	if err != nil {
+		return fmt.Errorf("loadRecognizers: failed to read config file : %v", err)
+	}
+	var configs []RecognizerConfig
+	err = json.Unmarshal(bts, &configs)
+	if err != nil {
+		return fmt.Errorf("loadRecognizers: couldn't unmarshal JSON : %v", err)
+	}
+	for _, c := range configs {
+		r, err := newRecognizer(c)
+		if err != nil {
+			return fmt.Errorf("loadRecognizers: %v", err)
+		}
+		err = registerRecognizer(r)
+		if err != nil {
+			return fmt.Errorf("loadRecognizers: %v", err)
+		}
+		log.Printf("chromedictator registered %s recogniser '%s'", c.Type, c.Name)
+	}
+	return nil
+}
+
+func langBase(lang string) string {
+	if i := strings.Index(lang, "-"); i > 0 {
+		return lang[:i]
+	}
+	return lang
+}
+
+// commandRecognizer runs an external command
+type commandRecognizer struct {
+	config RecognizerConfig
+}
+
+func (r commandRecognizer) Name() string { return r.config.Name }
+
+func (r commandRecognizer) Recognise(ctx context.Context, audioFile string, lang string) (RecognitionResult, error) {
+	var res RecognitionResult
+
+	// the output file is written to a folder of its own, outside the session folder, so that concurrent calls for the
+	// same audio file don't overwrite each other's output
+	outDir, err := ioutil.TempDir("", "recognise")
+	if err != nil {
+		return res, fmt.Errorf("failed to create temporary folder : %v", err)
+	}
+	defer os.RemoveAll(outDir)
+	outFile := filepath.Join(outDir, strings.TrimSuffix(filepath.Base(audioFile), filepath.Ext(audioFile))+".srt")
+	replacer := strings.NewReplacer("{input}", audioFile, "{output}", outFile, "{lang}", lang, "{lang_base}", langBase(lang))
+	args := []string{}
+	for _, a := range r.config.Args {
+		args = append(args, replacer.Replace(a))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.config.timeout())
+	defer cancel()
+	cmd := exec.CommandContext(ctx, r.config.Command, args...)
+	var out bytes.Buffer
+	var sterr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &sterr
+
+	err = cmd.Run()
+	if err != nil {
+		log.Printf("%s: command failed : %v : %s", r.Name(), err, sterr.String())
+		return res, fmt.Errorf("internal command failure")
+	}
+
+	if r.config.Output == "text" {
+		res.Text = strings.TrimSpace(out.String())
+		res.Segments = []srtUnit{}
+		return res, nil
+	}
+
+	bts, err := ioutil.ReadFile(outFile)
+	if err != nil {
+		return res, fmt.Errorf("failed to read srt file : %v", err)
+	}
+	res.Segments, err = parseSRT(string(bts))
+	if err != nil {
+		return res, fmt.Errorf("failed to parse srt file : %v", err)
+	}
+	texts := []string{}
+	for _, s := range res.Segments {
+		texts = append(texts, strings.Join(strings.Fields(s.Text), " "))
+	}
+	res.Text = strings.Join(texts, " ")
+	return res, nil
+}
+
+// httpRecognizer posts the audio to an ASR server
+type httpRecognizer struct {
+	config RecognizerConfig
+	client *http.Client
+}
+
+func (r httpRecognizer) Name() string { return r.config.Name }
+
+func (r httpRecognizer) Recognise(ctx context.Context, audioFile string, lang string) (RecognitionResult, error) {
+	var res RecognitionResult
+
+	fh, err := os.Open(audioFile)
+	if err != nil {
+		return res, fmt.Errorf("failed to open audio file : %v", err)
+	}
+	defer fh.Close()
+
+	u, _ := url.Parse(r.config.URL)
+	q := u.Query()
+	q.Set("lang", lang)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("POST", u.String(), fh)
+	if err != nil {
+		return res, fmt.Errorf("failed to create request : %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", audioMimeType(audioFile))
+	if fi, err := fh.Stat(); err == nil {
+		req.ContentLength = fi.Size()
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return res, fmt.Errorf("request to ASR server failed : %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return res, fmt.Errorf("failed to read response from ASR server : %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return res, fmt.Errorf("ASR server returned %s : %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	err = json.Unmarshal(body, &res)
+	if err != nil {
+		return res, fmt.Errorf("couldn't unmarshal response from ASR server : %v", err)
+	}
+	if res.Segments == nil {
+		res.Segments = []srtUnit{}
+	}
+	return res, nil
+}
+
+// stubRecognizer returns a fixed text, for testing
+type stubRecognizer struct {
+	config RecognizerConfig
+}
+
+func (r stubRecognizer) Name() string { return r.config.Name }
+
+func (r stubRecognizer) Recognise(ctx context.Context, audioFile string, lang string) (RecognitionResult, error) {
+	text := r.config.Text
+	if text == "" {
+		text = fmt.Sprintf("stub recognition of %s (%s)", filepath.Base(audioFile), lang)
+	}
+	if _, err := os.Stat(audioFile); os.IsNotExist(err) {
+		return RecognitionResult{}, fmt.Errorf("no such file: %s", audioFile)
+	}
+	select {
+	case <-time.After(time.Duration(r.config.Delay) * time.Second):
+	case <-ctx.Done():
+		return RecognitionResult{}, ctx.Err()
+	}
+	return RecognitionResult{
+		Text:     text,
+		Segments: []srtUnit{newSrtUnit(1, subtitle.Cue{End: time.Second, Lines: []string{text}})},
+	}, nil
+}
+
+type recogniseResponse struct {
+	SessionObject
+	FileName string `json:"file_name"`
+	Backend  string `json:"backend"`
+	Language string `json:"language"`
+	RecognitionResult
+	Message string `json:"message"`
+}
+
+// recogniseParams reads the session, filename, backend and language of a recognition request.
+// If the 'lang' URL parameter is not set, the language of the recording's .json file is used (or sv, if there is none).
+func recogniseParams(r *http.Request) (session, fileName, backend, lang string, err error) {
+	vars := mux.Vars(r)
+	var sessionParam = newParam("session")
+	var fileNameParam = newParam("filename")
+	err = requireParams(vars, &sessionParam, &fileNameParam)
+	if err != nil {
+		return
+	}
+	session, err = cleanSessionName(sessionParam.value)
+	if err != nil {
+		return
+	}
+	fileName, err = cleanFileName(fileNameParam.value)
+	if err != nil {
+		return
+	}
+	backend = r.URL.Query().Get("backend")
+	lang = r.URL.Query().Get("lang")
+	if lang == "" {
+		basename := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+		if jo, err := store.Metadata(session, basename); err == nil {
+			lang = jo.Language
+		}
+	}
+	if lang == "" {
+		lang = "sv"
+	}
+	return
+}
+
+// recognise runs server side recognition on a saved audio file.
+// URL parameters: backend (default: first configured backend), lang, expand (true to expand abbreviations).
+func recognise(w http.ResponseWriter, r *http.Request) {
+	session, fileName, backend, lang, err := recogniseParams(r)
+	if err != nil {
+		msg := fmt.Sprintf("recognise: param check failed : %v", err)
+		log.Print(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	recognizer, err := getRecognizer(backend)
+	if err != nil {
+		msg := fmt.Sprintf("recognise: %v", err)
+		log.Print(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	res := recogniseResponse{SessionObject: SessionObject{session}, FileName: fileName, Backend: recognizer.Name(), Language: lang}
+	res.RecognitionResult, err = recogniseFile(r.Context(), recognizer, session, fileName, lang)
+	if os.IsNotExist(err) {
+		res.Message = fmt.Sprintf("no such file: %s", fileName)
+	} else {
+		if err != nil {
+			msg := fmt.Sprintf("recognise: %s : %v", recognizer.Name(), err)
+			log.Print(msg)
+			http.Error(w, msg, http.StatusInternalServerError)
+			return
+		}
+		if r.URL.Query().Get("expand") == "true" {
+			expandRecognitionResult(&res.RecognitionResult, session, lang)
+		}
+	}
+
+	resJSON, err := rec.PrettyMarshal(res)
+	if err != nil {
+		msg := fmt.Sprintf("recognise: failed to create JSON from struct : %v", res)
+		log.Print(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s\n", string(resJSON))
+}
+
+// recogniseFile runs a recogniser on an audio file of a session. If fileName has no extension, .webm is used.
+// If there is no such file, the error satisfies os.IsNotExist.
+func recogniseFile(ctx context.Context, recognizer Recognizer, session, fileName, lang string) (RecognitionResult, error) {
+	basename, ext := splitFileName(fileName, "webm")
+	audioFile, release, err := store.AudioPath(session, basename, ext)
+	if err != nil {
+		return RecognitionResult{}, err
+	}
+	defer release()
+	return recognizer.Recognise(ctx, audioFile, lang)
+}
+
+func expandRecognitionResult(res *RecognitionResult, session, lang string) {
+	res.Text, _ = expandAbbrevs(res.Text, session, "", lang)
+	for i, s := range res.Segments {
+		res.Segments[i].Text, _ = expandAbbrevs(s.Text, session, "", lang)
+	}
+}
+
+type recognizerInfo struct {
+	Name    string `json:"name"`
+	Default bool   `json:"default"`
+}
+
+func listRecognizers(w http.ResponseWriter, r *http.Request) {
+	res := []recognizerInfo{}
+	recognizerMutex.RLock()
+	for name := range recognizers {
+		res = append(res, recognizerInfo{Name: name, Default: name == defaultRecognizer})
+	}
+	recognizerMutex.RUnlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+
+	resJSON, err := json.Marshal(res)
+	if err != nil {
+		msg := fmt.Sprintf("listRecognizers: failed to marshal list of recognisers : %v", err)
+		log.Println(msg)
+		http.Error(w, "failed to return list of recognisers", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s\n", string(resJSON))
+}
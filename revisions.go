@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stts-se/rec"
+)
+
+// Revision history of the edited text (.edi) of an utterance. Each save of an edited text is kept as a revision,
+// numbered from 1, along with the time of the save, the author and an optional comment. Earlier revisions can be
+// listed, compared and restored. Restoring a revision saves its text as a new revision.
+
+// revision holds the info of a saved version of an edited text
+type revision struct {
+	ID      int    `json:"id"`
+	Time    string `json:"time"`
+	Author  string `json:"author,omitempty"`
+	Comment string `json:"comment,omitempty"`
+	// RestoredFrom is set if the revision was created by restoring an earlier revision
+	RestoredFrom int `json:"restored_from,omitempty"`
+}
+
+type revisionResponse struct {
+	revision
+	Text string `json:"text"`
+}
+
+type revisionDiffResponse struct {
+	From int      `json:"from"`
+	To   int      `json:"to"`
+	Diff []diffOp `json:"diff"`
+}
+
+// saveEditedTextRevision saves the edited text of an utterance, and adds it to the revision history. If the text is
+// unchanged, no new revision is added. If there is an edited text saved before the revision history was kept, it is
+// added as the first revision. The saved revision (or the latest revision, if the text is unchanged) is returned.
+// The caller should hold the utterance lock (see lockUtterance).
+func saveEditedTextRevision(session, basename, text string, rev revision) (revision, []string, error) {
+	var respMessages []string
+	revs, err := store.Revisions(session, basename)
+	if err != nil {
+		return rev, respMessages, fmt.Errorf("failed to read revisions : %v", err)
+	}
+	old, err := store.Text(session, basename, "edi")
+	if err != nil && !os.IsNotExist(err) {
+		return rev, respMessages, fmt.Errorf("failed to read text file : %v", err)
+	}
+	exists := err == nil
+
+	if exists && old == text && len(revs) > 0 && rev.RestoredFrom == 0 {
+		latest := revs[len(revs)-1]
+		respMessages = append(respMessages, fmt.Sprintf("text unchanged since revision %d", latest.ID))
+		return latest, respMessages, nil
+	}
+	if exists && len(revs) == 0 && old != text {
+		first := revision{Time: time.Now().UTC().Format(time.RFC3339), Comment: "saved before the revision history was kept"}
+		first, err = store.SaveRevision(session, basename, first, old)
+		if err != nil {
+			return rev, respMessages, fmt.Errorf("failed to save revision : %v", err)
+		}
+		respMessages = append(respMessages, fmt.Sprintf("saved earlier text as revision %d", first.ID))
+	}
+
+	err = store.SaveText(session, basename, "edi", text)
+	if err != nil {
+		return rev, respMessages, fmt.Errorf("failed to create file '%s/%s.edi' : %v", session, basename, err)
+	}
+	rev.Time = time.Now().UTC().Format(time.RFC3339)
+	rev, err = store.SaveRevision(session, basename, rev, text)
+	if err != nil {
+		return rev, respMessages, fmt.Errorf("saved text file, but failed to save revision : %v", err)
+	}
+	respMessages = append(respMessages, fmt.Sprintf("saved revision %d", rev.ID))
+	return rev, respMessages, nil
+}
+
+// revisionVars returns the session and basename of a revision request. The file name may be given with or without the
+// .edi extension.
+func revisionVars(r *http.Request) (string, string, error) {
+	session, fileName, err := sessionFileVars(r)
+	if err != nil {
+		return "", "", err
+	}
+	basename, ext := splitFileName(fileName, "edi")
+	if ext != "edi" {
+		return "", "", fmt.Errorf("only edited text (edi) files have revisions: %s", fileName)
+	}
+	return session, basename, nil
+}
+
+// findRevision returns the revision with the given id, or the latest revision for id 0
+func findRevision(revs []revision, id int) (revision, bool) {
+	if id == 0 && len(revs) > 0 {
+		return revs[len(revs)-1], true
+	}
+	for _, rev := range revs {
+		if rev.ID == id {
+			return rev, true
+		}
+	}
+	return revision{}, false
+}
+
+func revisionIDParam(s string) (int, error) {
+	id, err := strconv.Atoi(s)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid revision '%s'", s)
+	}
+	return id, nil
+}
+
+func writeRevisionJSON(w http.ResponseWriter, caller string, res interface{}) {
+	resJSON, err := rec.PrettyMarshal(res)
+	if err != nil {
+		msg := fmt.Sprintf("%s: failed to create JSON from struct : %v", caller, err)
+		log.Print(msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s\n", string(resJSON))
+}
+
+// listRevisions lists the revisions of an edited text, oldest first
+func listRevisions(w http.ResponseWriter, r *http.Request) {
+	session, basename, err := revisionVars(r)
+	if err != nil {
+		msg := fmt.Sprintf("listRevisions: %v", err)
+		log.Print(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	revs, err := store.Revisions(session, basename)
+	if err != nil {
+		msg := fmt.Sprintf("listRevisions: failed to read revisions : %v", err)
+		log.Print(msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	writeRevisionJSON(w, "listRevisions", revs)
+}
+
+// getRevision returns a revision of an edited text, along with its text
+func getRevision(w http.ResponseWriter, r *http.Request) {
+	fail := func(status int, msg string) {
+		msg = "getRevision: " + msg
+		log.Print(msg)
+		http.Error(w, msg, status)
+	}
+	session, basename, err := revisionVars(r)
+	if err != nil {
+		fail(http.StatusBadRequest, err.Error())
+		return
+	}
+	id, err := revisionIDParam(mux.Vars(r)["revision"])
+	if err != nil {
+		fail(http.StatusBadRequest, err.Error())
+		return
+	}
+	res, err := readRevision(session, basename, id)
+	if os.IsNotExist(err) {
+		fail(http.StatusNotFound, fmt.Sprintf("no such revision: %s/%s.edi revision %d", session, basename, id))
+		return
+	}
+	if err != nil {
+		fail(http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeRevisionJSON(w, "getRevision", res)
+}
+
+// readRevision reads a revision and its text. For id 0, the latest revision is read.
+func readRevision(session, basename string, id int) (revisionResponse, error) {
+	var res revisionResponse
+	revs, err := store.Revisions(session, basename)
+	if err != nil {
+		return res, fmt.Errorf("failed to read revisions : %v", err)
+	}
+	rev, ok := findRevision(revs, id)
+	if !ok {
+		return res, notExist(fmt.Sprintf("%s/%s.edi revision %d", session, basename, id))
+	}
+	text, err := store.RevisionText(session, basename, rev.ID)
+	if err != nil {
+		return res, err
+	}
+	return revisionResponse{revision: rev, Text: text}, nil
+}
+
+// diffRevisions compares two revisions of an edited text, word by word. The revisions are given by the URL parameters
+// from and to. By default, to is the latest revision, and from is the revision before to.
+func diffRevisions(w http.ResponseWriter, r *http.Request) {
+	fail := func(status int, msg string) {
+		msg = "diffRevisions: " + msg
+		log.Print(msg)
+		http.Error(w, msg, status)
+	}
+	session, basename, err := revisionVars(r)
+	if err != nil {
+		fail(http.StatusBadRequest, err.Error())
+		return
+	}
+	q := r.URL.Query()
+	var from, to int
+	if q.Get("to") != "" {
+		if to, err = revisionIDParam(q.Get("to")); err != nil {
+			fail(http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if q.Get("from") != "" {
+		if from, err = revisionIDParam(q.Get("from")); err != nil {
+			fail(http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	toRev, err := readRevision(session, basename, to)
+	if os.IsNotExist(err) && to == 0 {
+		fail(http.StatusNotFound, fmt.Sprintf("no revisions of %s/%s.edi", session, basename))
+		return
+	}
+	if os.IsNotExist(err) {
+		fail(http.StatusNotFound, fmt.Sprintf("no such revision: %s/%s.edi revision %d", session, basename, to))
+		return
+	}
+	if err != nil {
+		fail(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if from == 0 {
+		from = toRev.ID - 1
+	}
+	var fromText string
+	if from > 0 {
+		fromRev, err := readRevision(session, basename, from)
+		if os.IsNotExist(err) {
+			fail(http.StatusNotFound, fmt.Sprintf("no such revision: %s/%s.edi revision %d", session, basename, from))
+			return
+		}
+		if err != nil {
+			fail(http.StatusInternalServerError, err.Error())
+			return
+		}
+		fromText = fromRev.Text
+	}
+
+	res := revisionDiffResponse{
+		From: from,
+		To:   toRev.ID,
+		Diff: diffWords(strings.Fields(fromText), strings.Fields(toRev.Text)),
+	}
+	writeRevisionJSON(w, "diffRevisions", res)
+}
+
+// restoreRevision saves the text of an earlier revision as the edited text, which adds a new revision. The author and
+// comment of the new revision are given by the URL parameters author (or user, see requestUser) and comment.
+func restoreRevision(w http.ResponseWriter, r *http.Request) {
+	fail := func(status int, msg string) {
+		msg = "restoreRevision: " + msg
+		log.Print(msg)
+		http.Error(w, msg, status)
+	}
+	session, basename, err := revisionVars(r)
+	if err != nil {
+		fail(http.StatusBadRequest, err.Error())
+		return
+	}
+	id, err := revisionIDParam(mux.Vars(r)["revision"])
+	if err != nil {
+		fail(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	unlock := lockUtterance(session, basename)
+	defer unlock()
+
+	old, err := readRevision(session, basename, id)
+	if os.IsNotExist(err) {
+		fail(http.StatusNotFound, fmt.Sprintf("no such revision: %s/%s.edi revision %d", session, basename, id))
+		return
+	}
+	if err != nil {
+		fail(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	q := r.URL.Query()
+	rev := revision{Author: q.Get("author"), Comment: q.Get("comment"), RestoredFrom: id}
+	if rev.Author == "" {
+		rev.Author = requestUser(r)
+	}
+	if rev.Comment == "" {
+		rev.Comment = fmt.Sprintf("restored revision %d", id)
+	}
+	rev, respMessages, err := saveEditedTextRevision(session, basename, old.Text, rev)
+	if err != nil {
+		fail(http.StatusInternalServerError, err.Error())
+		return
+	}
+	fmt.Printf("Server restored %s/%s.edi revision %d\n", session, basename, id)
+	w.Header().Set("ETag", textETag(old.Text))
+	res := saveTextResponse{Message: strings.Join(respMessages, " : "), Revision: rev.ID}
+	writeRevisionJSON(w, "restoreRevision", res)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stts-se/chromedictator/subtitle"
+)
+
+// sessionUtterance is a saved utterance of a session: the contents of its .json file, the
+// recogniser (.rec) and edited (.edi) text, and the name of its audio file
+type sessionUtterance struct {
+	Basename string
+	JSONObject
+	RecText   string
+	EdiText   string
+	HasRec    bool
+	HasEdi    bool
+	AudioFile string // the uploaded audio file, <basename>.<ext>, or empty if there is no audio file
+
+	// audioFiles: all audio files of the utterance, the uploaded file and any converted versions (see transcoder)
+	audioFiles []string
+}
+
+// audioFileWithExt returns the audio file with the given extension (e.g. wav) if there is one, otherwise the uploaded audio file
+func (u sessionUtterance) audioFileWithExt(ext string) string {
+	for _, f := range u.audioFiles {
+		if strings.EqualFold(filepath.Ext(f), "."+ext) {
+			return f
+		}
+	}
+	return u.AudioFile
+}
+
+// nonAudioExtensions are the extensions of the utterance files that are not audio
+var nonAudioExtensions = []string{".json", ".rec", ".edi", ".srt", ".vtt"}
+
+// uploadedAudioFile returns the uploaded audio file among the (sorted) audio files of an utterance: the one with the
+// extension saved in the .json file, or for .json files saved without it, the first one that is not converted by the
+// transcoder
+func uploadedAudioFile(basename string, jsonObj JSONObject, audioFiles []string) string {
+	if jsonObj.FileExtension != "" && contains(audioFiles, basename+"."+jsonObj.FileExtension) {
+		return basename + "." + jsonObj.FileExtension
+	}
+	for _, f := range audioFiles {
+		ext := strings.TrimPrefix(filepath.Ext(f), ".")
+		if audioTranscoder == nil || !audioTranscoder.converts(ext) {
+			return f
+		}
+	}
+	if len(audioFiles) > 0 {
+		return audioFiles[0]
+	}
+	return ""
+}
+
+// text returns the edited text if there is one, otherwise the recogniser text
+func (u sessionUtterance) text() string {
+	if u.HasEdi {
+		return u.EdiText
+	}
+	return u.RecText
+}
+
+// readText returns a text version of an utterance, and false if there is none
+func readText(session, basename, version string) (string, bool, error) {
+	text, err := store.Text(session, basename, version)
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return strings.TrimSpace(text), true, nil
+}
+
+// readSessionUtterances reads all utterances of a session, sorted by start time.
+// Utterances without a .json file have no timing information, and are skipped.
+func readSessionUtterances(session string) ([]sessionUtterance, error) {
+	res := []sessionUtterance{}
+	if !store.SessionExists(session) {
+		return res, fmt.Errorf("no such session: %s", session)
+	}
+	fNames, err := store.Files(session)
+	if err != nil {
+		return res, err
+	}
+
+	// fNames are sorted, and so are the audio files of each basename
+	audioFiles := make(map[string][]string)
+	basenames := []string{}
+	for _, fName := range fNames {
+		ext := filepath.Ext(fName)
+		basename := strings.TrimSuffix(fName, ext)
+		switch {
+		case ext == ".json":
+			basenames = append(basenames, basename)
+		case ext == "" || contains(nonAudioExtensions, strings.ToLower(ext)):
+		default:
+			audioFiles[basename] = append(audioFiles[basename], fName)
+		}
+	}
+
+	for _, basename := range basenames {
+		u := sessionUtterance{Basename: basename, audioFiles: audioFiles[basename]}
+		p := path.Join(session, basename)
+		u.JSONObject, err = store.Metadata(session, basename)
+		if err != nil {
+			return res, fmt.Errorf("failed to read %s.json : %v", p, err)
+		}
+		u.AudioFile = uploadedAudioFile(basename, u.JSONObject, u.audioFiles)
+		u.RecText, u.HasRec, err = readText(session, basename, "rec")
+		if err != nil {
+			return res, fmt.Errorf("failed to read %s.rec : %v", p, err)
+		}
+		u.EdiText, u.HasEdi, err = readText(session, basename, "edi")
+		if err != nil {
+			return res, fmt.Errorf("failed to read %s.edi : %v", p, err)
+		}
+		res = append(res, u)
+	}
+	for basename := range audioFiles {
+		if !contains(basenames, basename) {
+			log.Printf("readSessionUtterances: no json file for %s/%s, skipping", session, basename)
+		}
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].TimeCodeStart == res[j].TimeCodeStart {
+			return res[i].Basename < res[j].Basename
+		}
+		return res[i].TimeCodeStart < res[j].TimeCodeStart
+	})
+	return res, nil
+}
+
+// exportSessionNames returns the sessions given by the (repeatable) URL parameter 'session', or all sessions if none are given
+func exportSessionNames(r *http.Request) ([]string, error) {
+	res := []string{}
+	for _, s := range r.URL.Query()["session"] {
+		for _, ss := range strings.Split(s, ",") {
+			if ss = strings.TrimSpace(ss); ss != "" {
+				ss, err := cleanSessionName(ss)
+				if err != nil {
+					return res, err
+				}
+				if !store.SessionExists(ss) {
+					return res, fmt.Errorf("no such session: %s", ss)
+				}
+				res = append(res, ss)
+			}
+		}
+	}
+	if len(res) > 0 {
+		return res, nil
+	}
+	res, err := store.Sessions()
+	if err != nil {
+		return res, fmt.Errorf("couldn't list sessions : %v", err)
+	}
+	return res, nil
+}
+
+// sessionCues builds subtitle cues from the utterances of a session, in start time order. Utterances
+// without text or with invalid timecodes are skipped. Unless keepOverlaps is set, a cue that overlaps
+// the next one is cut off at the start of the next cue.
+func sessionCues(utts []sessionUtterance, keepOverlaps bool) []subtitle.Cue {
+	res := []subtitle.Cue{}
+	for _, u := range utts {
+		text := u.text()
+		if text == "" {
+			continue
+		}
+		if u.TimeCodeEnd <= u.TimeCodeStart || u.TimeCodeStart < 0 {
+			log.Printf("sessionCues: invalid timecodes for %s/%s: %d-%d, skipping", u.SessionID, u.Basename, u.TimeCodeStart, u.TimeCodeEnd)
+			continue
+		}
+		c := subtitle.Cue{
+			ID:    u.Basename,
+			Start: time.Duration(u.TimeCodeStart) * time.Millisecond,
+			End:   time.Duration(u.TimeCodeEnd) * time.Millisecond,
+			Lines: strings.Split(text, "\n"),
+		}
+		if n := len(res); n > 0 && !keepOverlaps {
+			prev := &res[n-1]
+			if prev.End > c.Start && c.Start > prev.Start {
+				prev.End = c.Start
+			}
+		}
+		res = append(res, c)
+	}
+	return res
+}
+
+// exportSessionSubtitles returns a session as a single subtitle file, in SRT or WebVTT format.
+// Overlapping utterances are cut off at the start of the next one, unless the URL parameter 'overlap' is set to 'keep'.
+func exportSessionSubtitles(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	format := vars["format"]
+	session, err := cleanSessionName(vars["session"])
+	if err != nil {
+		msg := fmt.Sprintf("exportSessionSubtitles: %v", err)
+		log.Print(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	utts, err := readSessionUtterances(session)
+	if err != nil {
+		msg := fmt.Sprintf("exportSessionSubtitles: %v", err)
+		log.Print(msg)
+		status := http.StatusInternalServerError
+		if !store.SessionExists(session) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, msg, status)
+		return
+	}
+	cues := sessionCues(utts, r.URL.Query().Get("overlap") == "keep")
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.%s\"", session, format))
+	if format == "vtt" {
+		w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+		err = subtitle.WriteWebVTT(w, cues)
+	} else {
+		w.Header().Set("Content-Type", "application/x-subrip; charset=utf-8")
+		err = subtitle.WriteSRT(w, cues)
+	}
+	if err != nil {
+		log.Printf("exportSessionSubtitles: failed to write subtitles : %v", err)
+	}
+}
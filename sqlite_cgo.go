@@ -0,0 +1,7 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+// sqliteAvailable tells if the SQLite driver is usable: it needs cgo
+const sqliteAvailable = true
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteStore keeps the sessions, utterances, audio files and abbreviations in an embedded SQLite database.
+// Temporary files (audio being received or converted, and audio copied out for external commands) are kept in tmpDir.
+type sqliteStore struct {
+	db     *sql.DB
+	tmpDir string
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS sessions (
+	name TEXT PRIMARY KEY
+);
+CREATE TABLE IF NOT EXISTS metadata (
+	session TEXT NOT NULL REFERENCES sessions(name),
+	basename TEXT NOT NULL,
+	json TEXT NOT NULL,
+	PRIMARY KEY (session, basename)
+);
+CREATE TABLE IF NOT EXISTS texts (
+	session TEXT NOT NULL REFERENCES sessions(name),
+	basename TEXT NOT NULL,
+	version TEXT NOT NULL,
+	text TEXT NOT NULL,
+	PRIMARY KEY (session, basename, version)
+);
+CREATE TABLE IF NOT EXISTS audio (
+	session TEXT NOT NULL REFERENCES sessions(name),
+	basename TEXT NOT NULL,
+	ext TEXT NOT NULL,
+	data BLOB NOT NULL,
+	modified INTEGER NOT NULL, -- Unix time in nanoseconds
+	PRIMARY KEY (session, basename, ext)
+);
+CREATE TABLE IF NOT EXISTS backups (
+	id INTEGER PRIMARY KEY,
+	session TEXT NOT NULL,
+	name TEXT NOT NULL,
+	data BLOB NOT NULL,
+	created INTEGER NOT NULL -- Unix time in nanoseconds
+);
+CREATE TABLE IF NOT EXISTS revisions (
+	session TEXT NOT NULL REFERENCES sessions(name),
+	basename TEXT NOT NULL,
+	id INTEGER NOT NULL,
+	time TEXT NOT NULL,
+	author TEXT NOT NULL,
+	comment TEXT NOT NULL,
+	restored_from INTEGER NOT NULL,
+	text TEXT NOT NULL,
+	PRIMARY KEY (session, basename, id)
+);
+CREATE TABLE IF NOT EXISTS abbrev_scopes (
+	scope TEXT PRIMARY KEY
+);
+CREATE TABLE IF NOT EXISTS abbrevs (
+	scope TEXT NOT NULL REFERENCES abbrev_scopes(scope),
+	abbrev TEXT NOT NULL,
+	expansion TEXT NOT NULL,
+	PRIMARY KEY (scope, abbrev)
+);
+`
+
+// newSQLiteStore opens (or creates) the database file
+func newSQLiteStore(dbFile, tmpDir string) (*sqliteStore, error) {
+	if !sqliteAvailable {
+		return nil, fmt.Errorf("the sqlite store is not available: this binary was built without cgo (build with CGO_ENABLED=1)")
+	}
+	db, err := sql.Open("sqlite3", dbFile+"?_foreign_keys=1&_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database %s : %v", dbFile, err)
+	}
+	// SQLite allows only one writer at a time
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(sqliteSchema)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialise database %s : %v", dbFile, err)
+	}
+	return &sqliteStore{db: db, tmpDir: tmpDir}, nil
+}
+
+// strings returns the first column of the rows of a query
+func (s *sqliteStore) strings(query string, args ...interface{}) ([]string, error) {
+	res := []string{}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return res, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return res, err
+		}
+		res = append(res, v)
+	}
+	return res, rows.Err()
+}
+
+func (s *sqliteStore) Sessions() ([]string, error) {
+	return s.strings("SELECT name FROM sessions ORDER BY name")
+}
+
+func (s *sqliteStore) SessionExists(session string) bool {
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM sessions WHERE name = ?", session).Scan(&n)
+	return err == nil && n > 0
+}
+
+func (s *sqliteStore) CreateSession(session string) (bool, error) {
+	res, err := s.db.Exec("INSERT OR IGNORE INTO sessions (name) VALUES (?)", session)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqliteStore) Files(session string) ([]string, error) {
+	if !s.SessionExists(session) {
+		return []string{}, notExist(session)
+	}
+	return s.strings(`SELECT basename || '.json' FROM metadata WHERE session = ?1
+		UNION SELECT basename || '.' || version FROM texts WHERE session = ?1
+		UNION SELECT basename || '.' || ext FROM audio WHERE session = ?1
+		ORDER BY 1`, session)
+}
+
+func (s *sqliteStore) Exists(session, fileName string) bool {
+	basename, ext := splitFileName(fileName, "")
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM (
+		SELECT 1 FROM metadata WHERE session = ?1 AND basename = ?2 AND ?3 = 'json'
+		UNION ALL SELECT 1 FROM texts WHERE session = ?1 AND basename = ?2 AND version = ?3
+		UNION ALL SELECT 1 FROM audio WHERE session = ?1 AND basename = ?2 AND ext = ?3)`, session, basename, ext).Scan(&n)
+	return err == nil && n > 0
+}
+
+func (s *sqliteStore) Metadata(session, basename string) (JSONObject, error) {
+	res := JSONObject{}
+	var js string
+	err := s.db.QueryRow("SELECT json FROM metadata WHERE session = ? AND basename = ?", session, basename).Scan(&js)
+	if err == sql.ErrNoRows {
+		return res, notExist(path.Join(session, basename+".json"))
+	}
+	if err != nil {
+		return res, err
+	}
+	err = json.Unmarshal([]byte(js), &res)
+	if err != nil {
+		return res, fmt.Errorf("couldn't unmarshal JSON : %v", err)
+	}
+	return res, nil
+}
+
+func (s *sqliteStore) SaveMetadata(session, basename string, jo JSONObject) error {
+	js, err := json.Marshal(jo)
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON : %v", err)
+	}
+	_, err = s.db.Exec("INSERT OR REPLACE INTO metadata (session, basename, json) VALUES (?, ?, ?)", session, basename, string(js))
+	return err
+}
+
+func (s *sqliteStore) Text(session, basename, version string) (string, error) {
+	var res string
+	err := s.db.QueryRow("SELECT text FROM texts WHERE session = ? AND basename = ? AND version = ?", session, basename, version).Scan(&res)
+	if err == sql.ErrNoRows {
+		return res, notExist(path.Join(session, basename+"."+version))
+	}
+	return res, err
+}
+
+func (s *sqliteStore) SaveText(session, basename, version, text string) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO texts (session, basename, version, text) VALUES (?, ?, ?, ?)", session, basename, version, text)
+	return err
+}
+
+// memBlob is an audio file read into memory
+type memBlob struct {
+	*bytes.Reader
+	name    string
+	modTime time.Time
+}
+
+func (b memBlob) Name() string       { return b.name }
+func (b memBlob) ModTime() time.Time { return b.modTime }
+func (b memBlob) Close() error       { return nil }
+
+func (s *sqliteStore) Audio(session, basename, ext string) (audioBlob, error) {
+	var data []byte
+	var modified int64
+	err := s.db.QueryRow("SELECT data, modified FROM audio WHERE session = ? AND basename = ? AND ext = ?", session, basename, ext).Scan(&data, &modified)
+	if err == sql.ErrNoRows {
+		return nil, notExist(path.Join(session, basename+"."+ext))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return memBlob{Reader: bytes.NewReader(data), name: basename + "." + ext, modTime: time.Unix(0, modified)}, nil
+}
+
+func (s *sqliteStore) SaveAudio(session, basename, ext string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("INSERT OR REPLACE INTO audio (session, basename, ext, data, modified) VALUES (?, ?, ?, ?, ?)", session, basename, ext, data, time.Now().UnixNano())
+	return err
+}
+
+func (s *sqliteStore) ImportAudio(session, basename, ext, tmpFile string) error {
+	fh, err := os.Open(tmpFile)
+	if err != nil {
+		return err
+	}
+	err = s.SaveAudio(session, basename, ext, fh)
+	fh.Close()
+	if err != nil {
+		return err
+	}
+	os.Remove(tmpFile)
+	return nil
+}
+
+func (s *sqliteStore) RemoveAudio(session, basename, ext string) error {
+	res, err := s.db.Exec("DELETE FROM audio WHERE session = ? AND basename = ? AND ext = ?", session, basename, ext)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return notExist(path.Join(session, basename+"."+ext))
+	}
+	return nil
+}
+
+// AudioPath copies the audio file to a temporary file, which is removed by the release function
+func (s *sqliteStore) AudioPath(session, basename, ext string) (string, func(), error) {
+	blob, err := s.Audio(session, basename, ext)
+	if err != nil {
+		return "", func() {}, err
+	}
+	defer blob.Close()
+	fh, err := ioutil.TempFile(s.tmpDir, basename+"-*."+ext)
+	if err != nil {
+		return "", func() {}, err
+	}
+	_, err = io.Copy(fh, blob)
+	closeErr := fh.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(fh.Name())
+		return "", func() {}, err
+	}
+	return fh.Name(), func() { os.Remove(fh.Name()) }, nil
+}
+
+func (s *sqliteStore) TempFile(session, pattern string) (*os.File, error) {
+	return ioutil.TempFile(s.tmpDir, pattern)
+}
+
+// Check runs the SQLite integrity check. Every write is a transaction, so a crash doesn't leave partial data.
+func (s *sqliteStore) Check() ([]string, error) {
+	res, err := s.strings("PRAGMA integrity_check")
+	if err != nil {
+		return res, err
+	}
+	if len(res) == 1 && res[0] == "ok" {
+		return []string{}, nil
+	}
+	for i, msg := range res {
+		res[i] = "database: " + msg
+	}
+	return res, nil
+}
+
+// SaveBackup saves a backup in the backups table. Earlier backups of the same file are kept.
+func (s *sqliteStore) SaveBackup(session, fileName string, r io.Reader) (string, error) {
+	name := path.Join(session, fileName+".BAK")
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return name, err
+	}
+	_, err = s.db.Exec("INSERT INTO backups (session, name, data, created) VALUES (?, ?, ?, ?)", session, fileName, data, time.Now().UnixNano())
+	return name, err
+}
+
+func (s *sqliteStore) Revisions(session, basename string) ([]revision, error) {
+	res := []revision{}
+	rows, err := s.db.Query("SELECT id, time, author, comment, restored_from FROM revisions WHERE session = ? AND basename = ? ORDER BY id", session, basename)
+	if err != nil {
+		return res, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rev revision
+		err = rows.Scan(&rev.ID, &rev.Time, &rev.Author, &rev.Comment, &rev.RestoredFrom)
+		if err != nil {
+			return res, err
+		}
+		res = append(res, rev)
+	}
+	return res, rows.Err()
+}
+
+func (s *sqliteStore) RevisionText(session, basename string, id int) (string, error) {
+	var res string
+	err := s.db.QueryRow("SELECT text FROM revisions WHERE session = ? AND basename = ? AND id = ?", session, basename, id).Scan(&res)
+	if err == sql.ErrNoRows {
+		return res, notExist(fmt.Sprintf("%s/%s.edi revision %d", session, basename, id))
+	}
+	return res, err
+}
+
+func (s *sqliteStore) SaveRevision(session, basename string, rev revision, text string) (revision, error) {
+	err := s.db.QueryRow("SELECT COALESCE(MAX(id), 0) + 1 FROM revisions WHERE session = ? AND basename = ?", session, basename).Scan(&rev.ID)
+	if err != nil {
+		return rev, err
+	}
+	_, err = s.db.Exec("INSERT INTO revisions (session, basename, id, time, author, comment, restored_from, text) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		session, basename, rev.ID, rev.Time, rev.Author, rev.Comment, rev.RestoredFrom, text)
+	return rev, err
+}
+
+func (s *sqliteStore) Abbrevs() (map[abbrevScope]map[string]string, error) {
+	scopes, err := s.strings("SELECT scope FROM abbrev_scopes")
+	if err != nil {
+		return nil, err
+	}
+	if len(scopes) == 0 {
+		return nil, notExist("abbrevs")
+	}
+	res := map[abbrevScope]map[string]string{globalScope: {}}
+	for _, sc := range scopes {
+		scope, err := parseAbbrevScope(sc)
+		if err != nil {
+			return nil, err
+		}
+		res[scope] = make(map[string]string)
+	}
+
+	rows, err := s.db.Query("SELECT scope, abbrev, expansion FROM abbrevs")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sc, abbrev, expansion string
+		if err := rows.Scan(&sc, &abbrev, &expansion); err != nil {
+			return nil, err
+		}
+		scope, err := parseAbbrevScope(sc)
+		if err != nil {
+			return nil, err
+		}
+		res[scope][abbrev] = expansion
+	}
+	return res, rows.Err()
+}
+
+// SaveAbbrevs writes the scopes and abbreviations that differ from the database
+func (s *sqliteStore) SaveAbbrevs(m map[abbrevScope]map[string]string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	scopes := map[string]bool{}
+	old := map[string]map[string]string{}
+	rows, err := tx.Query("SELECT scope FROM abbrev_scopes")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var sc string
+		if err := rows.Scan(&sc); err != nil {
+			rows.Close()
+			return err
+		}
+		scopes[sc] = true
+		old[sc] = map[string]string{}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows, err = tx.Query("SELECT scope, abbrev, expansion FROM abbrevs")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var sc, abbrev, expansion string
+		if err := rows.Scan(&sc, &abbrev, &expansion); err != nil {
+			rows.Close()
+			return err
+		}
+		old[sc][abbrev] = expansion
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// the global scope is always kept, so that an empty set of abbreviations is saved
+	if !scopes[globalScope.String()] {
+		if _, err := tx.Exec("INSERT INTO abbrev_scopes (scope) VALUES (?)", globalScope.String()); err != nil {
+			return err
+		}
+	}
+	for scope, as := range m {
+		sc := scope.String()
+		if !scopes[sc] && scope != globalScope {
+			if _, err := tx.Exec("INSERT INTO abbrev_scopes (scope) VALUES (?)", sc); err != nil {
+				return err
+			}
+		}
+		for abbrev, expansion := range as {
+			if e, ok := old[sc][abbrev]; ok && e == expansion {
+				continue
+			}
+			if _, err := tx.Exec("INSERT OR REPLACE INTO abbrevs (scope, abbrev, expansion) VALUES (?, ?, ?)", sc, abbrev, expansion); err != nil {
+				return err
+			}
+		}
+	}
+	for sc, as := range old {
+		scope, err := parseAbbrevScope(sc)
+		if err != nil {
+			return err
+		}
+		newAs, ok := m[scope]
+		for abbrev := range as {
+			if _, exists := newAs[abbrev]; !exists {
+				if _, err := tx.Exec("DELETE FROM abbrevs WHERE scope = ? AND abbrev = ?", sc, abbrev); err != nil {
+					return err
+				}
+			}
+		}
+		if !ok && scope != globalScope {
+			if _, err := tx.Exec("DELETE FROM abbrev_scopes WHERE scope = ?", sc); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
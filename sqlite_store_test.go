@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSQLiteSaveAbbrevs(t *testing.T) {
+	if !sqliteAvailable {
+		t.Skip("built without cgo")
+	}
+	dir, err := ioutil.TempDir("", "chromedictator_sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := newSQLiteStore(filepath.Join(dir, "test.db"), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.db.Close()
+
+	profile := abbrevScope{kind: "profile", name: "p"}
+	rowid := func(scope abbrevScope, abbrev string) int64 {
+		var id int64
+		err := s.db.QueryRow("SELECT rowid FROM abbrevs WHERE scope = ? AND abbrev = ?", scope.String(), abbrev).Scan(&id)
+		if err != nil {
+			t.Fatalf("%s %s: %v", scope, abbrev, err)
+		}
+		return id
+	}
+
+	steps := []map[abbrevScope]map[string]string{
+		{globalScope: {"a": "b", "c": "d"}, profile: {"e": "f"}},
+		{globalScope: {"a": "b", "c": "x", "g": "h"}, profile: {"e": "f"}},
+		{globalScope: {"a": "b", "g": "h"}},
+		{globalScope: {}},
+	}
+	for i, m := range steps {
+		var before int64
+		if i > 0 {
+			before = rowid(globalScope, "a")
+		}
+		if err := s.SaveAbbrevs(m); err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		res, err := s.Abbrevs()
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(res, m) {
+			t.Errorf("step %d: expected %v, got %v", i, m, res)
+		}
+		// the unchanged row is not rewritten
+		if _, ok := m[globalScope]["a"]; ok && i > 0 && rowid(globalScope, "a") != before {
+			t.Errorf("step %d: unchanged abbreviation was rewritten", i)
+		}
+	}
+}
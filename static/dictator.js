@@ -39,6 +39,7 @@ let recStartTime;
 let sessionStart;
 
 let abbrevMap = {};
+let abbrevScopes = {}; // abbrev => scope in which it was found (global, lang:<lang>, session:<session>, ...)
 let breakKeywords = {
     "sv" : {
 	"punkt": ".",
@@ -75,8 +76,8 @@ window.onload = function () {
     initWebkitSpeechRecognition();
     initMediaAccess();
     
-    loadAbbrevTable();
     populateLanguages();
+    loadAbbrevTable();
     populateShortcuts();
 
     document.getElementById("current-utt").focus();
@@ -191,6 +192,7 @@ function initMediaAccess() {
 			"end_time": recEnd,
 			"time_code_start": timeCodeStart,
 			"time_code_end": timeCodeEnd,
+			"language": recognition.lang,
 		    };
 		    soundToServer(payload);
 		});
@@ -225,6 +227,7 @@ function initWebkitSpeechRecognition() {
 	const lang = langSelect.options[i].value;
 	recognition.lang = lang;
 	logMessage("info", "language set to: " + recognition.lang);
+	loadAbbrevTable();
     });
 
 
@@ -419,15 +422,23 @@ function populateShortcuts() {
 // ------------------
 // ABBREVS
 
+// abbreviations for the current session and language, looked up in the order session, language, global
 async function loadAbbrevTable() {
-    await fetch(baseURL+ "/abbrev/list").then(async function(r) {
+    const params = new URLSearchParams();
+    if (sessionField.value.trim() !== "")
+	params.append("session", sessionField.value.trim());
+    if (recognition !== undefined && recognition.lang !== undefined)
+	params.append("lang", recognition.lang);
+    await fetch(baseURL+ "/abbrev/list?" + params.toString()).then(async function(r) {
 	if (r.ok) {
 	    const serverAbbrevs = await r.json();
 	    abbrevMap = {};
+	    abbrevScopes = {};
 	    for (let i = 0; i < serverAbbrevs.length; i++) {
 		//console.log("i: ", i, serverAbbrevs[i]);
 		const a = serverAbbrevs[i];
 		abbrevMap[a.abbrev] = a.expansion;
+		abbrevScopes[a.abbrev] = a.scope;
 	    };
 	    updateAbbrevTable();
 	} else {
@@ -441,13 +452,16 @@ function updateAbbrevTable() {
     at.innerHTML = '';
     Object.keys(abbrevMap).forEach(function(k) {
     	const v = abbrevMap[k];
+    	const scope = abbrevScopes[k];
     	const tr = document.createElement('tr');
     	const td1 = document.createElement('td');
     	const td2 = document.createElement('td');
     	const td3 = document.createElement('td');
+    	const td4 = document.createElement('td');
 
     	td1.innerText = k;
     	td2.innerText = v;
+    	td4.innerText = scope;
 	td3.setAttribute("class","abbrev_row_delete");
 	td3.setAttribute("style","vertical-align: middle; text-align: left");
 	const del = document.createElement('button');
@@ -456,12 +470,13 @@ function updateAbbrevTable() {
 	del.setAttribute("style","background: none; vertical-align: middle; text-align: left; border: none; font-size: 50%; width: 100%; height: 100%");
 	del.setAttribute("title", "delete abbrev '" + k + "'");
 	del.addEventListener('click', function(evt) {
-	    deleteAbbrev(k);
+	    deleteAbbrev(k, scope);
 	});
 	td3.appendChild(del);
 	
     	tr.appendChild(td1);
     	tr.appendChild(td2);
+    	tr.appendChild(td4);
     	tr.appendChild(td3);
     	at.appendChild(tr);
     });       
@@ -471,9 +486,24 @@ function updateAbbrevTable() {
     const td1 = document.createElement('td');
     const td2 = document.createElement('td');
     const td3 = document.createElement('td');
+    const td4 = document.createElement('td');
     
     td1.innerHTML = "<input id='abbrev_add_key' style='height: 20pt; font-size: 100%'/>";
     td2.innerHTML = "<input id='abbrev_add_value' style='height: 20pt; font-size: 100%'/>";
+    const scopeSelect = document.createElement('select');
+    scopeSelect.setAttribute("id", "abbrev_add_scope");
+    const scopeOpts = ["global"];
+    if (recognition !== undefined && recognition.lang !== undefined)
+	scopeOpts.push("lang:" + recognition.lang);
+    if (sessionField.value.trim() !== "")
+	scopeOpts.push("session:" + sessionField.value.trim());
+    for (let i = 0; i < scopeOpts.length; i++) {
+	const opt = document.createElement('option');
+	opt.value = scopeOpts[i];
+	opt.innerText = scopeOpts[i];
+	scopeSelect.appendChild(opt);
+    }
+    td4.appendChild(scopeSelect);
     td3.setAttribute("class","abbrev_row_add");
     td3.setAttribute("style","vertical-align: middle");
     const add = document.createElement('span');
@@ -485,13 +515,15 @@ function updateAbbrevTable() {
     
     tr.appendChild(td1);
     tr.appendChild(td2);
+    tr.appendChild(td4);
     tr.appendChild(td3);
     at.appendChild(tr);
 
-    const addThisAbbrev = function() {
+    const addThisAbbrev = async function() {
 	const from = document.getElementById("abbrev_add_key").value;
 	const to = document.getElementById("abbrev_add_value").value;
-	addAbbrev(from, to);
+	const scope = document.getElementById("abbrev_add_scope").value;
+	await addAbbrev(from, to, scope);
 	loadAbbrevTable();
     }
     
@@ -512,18 +544,31 @@ function updateAbbrevTable() {
 
 }
 
-async function addAbbrev(abbrev, expansion) {
-    await fetch(baseURL+ "/abbrev/add/"+ abbrev + "/" + expansion).then(function(r) {
-	if (r.ok) {
-	    logMessage("info", "added abbrev " + abbrev + " => " + expansion);
+async function addAbbrev(abbrev, expansion, scope) {
+    await fetch(baseURL+ "/abbrev/add/"+ abbrev + "/" + expansion + "?scope=" + encodeURIComponent(scope)).then(async function(r) {
+	if (r.status === 409) {
+	    if (confirm("Abbreviation " + abbrev + " already exists (" + scope + "). Replace it?"))
+		await updateAbbrev(abbrev, expansion, scope);
+	} else if (r.ok) {
+	    logMessage("info", "added abbrev " + abbrev + " => " + expansion + " (" + scope + ")");
 	} else {
 	    logMessage("error","couldn't add abbrev " + abbrev + " => " + expansion);
 	}
     });
 };
 
-async function deleteAbbrev(abbrev) {
-    await fetch(baseURL + "/abbrev/delete/" + abbrev).then(function(r) {
+async function updateAbbrev(abbrev, expansion, scope) {
+    await fetch(baseURL+ "/abbrev/update/"+ abbrev + "/" + expansion + "?scope=" + encodeURIComponent(scope)).then(function(r) {
+	if (r.ok) {
+	    logMessage("info", "updated abbrev " + abbrev + " => " + expansion + " (" + scope + ")");
+	} else {
+	    logMessage("error","couldn't update abbrev " + abbrev + " => " + expansion);
+	}
+    });
+};
+
+async function deleteAbbrev(abbrev, scope) {
+    await fetch(baseURL + "/abbrev/delete/" + abbrev + "?scope=" + encodeURIComponent(scope)).then(function(r) {
 	if (r.ok) {
 	    logMessage("info", "deleted abbrev " + abbrev);
 	    loadAbbrevTable();
@@ -684,6 +729,7 @@ async function textToServer(sessionName, fileName, text, isEdited, overwrite) {
 	"file_name" : fileName,
 	"data" : text,
 	"over_write" : overwrite,
+	"language": recognition.lang,
     };
     let res = true;
 
@@ -828,7 +874,7 @@ function addToUttList(session, fName, text) {
 	    audioSpan.firstChild.innerHTML = play;
 	    audioSpan.title = "Play";
 	};
-	cacheAudio(audio, audioSpan.firstChild, baseURL + "/get_audio/" + sessionField.value.trim() + "/" + fName);
+	streamAudio(audio, audioSpan.firstChild, baseURL + "/audio/" + sessionField.value.trim() + "/" + fName);
 	//audio.src = document.getElementById("audio").src;
 	audioSpan.appendChild(audio);
 
@@ -889,53 +935,16 @@ async function getText(sessionName, fName, extension) {
     return res;
 }
 
-// fetch audio from server, and cache for playback
-function cacheAudio(audioElement, playPauseButton, url) {
-
-    (async () => {
-	
-	const resp = await fetch(url, {
-	});
-	
-	if (resp.ok) {
-	    const content = await resp.text();
-	    //console.log(content);
-	    try {
-		const json = JSON.parse(content);
-		if (json.data === undefined || json.data === null || json.data === "" ) {
-		    audioElement.setAttribute("disabled","disabled");
-		    playPauseButton.setAttribute("disabled","disabled");
-		    playPauseButton.setAttribute("title","No audio");
-		    logMessage("error", "couldn't get audio from server : " + json.message);
-		} else {
-
-    		    // https://stackoverflow.com/questions/16245767/creating-a-blob-from-a-base64-string-in-javascript#16245768
-    		    const byteCharacters = atob(json.data);
-		    
-    		    const byteNumbers = new Array(byteCharacters.length);
-    		    for (let i = 0; i < byteCharacters.length; i++) {
-    			byteNumbers[i] = byteCharacters.charCodeAt(i);
-    		    }
-    		    const byteArray = new Uint8Array(byteNumbers);
-		    
-    		    const blob = new Blob([byteArray], {'type' : json.file_type});
-    		    audioElement.src = URL.createObjectURL(blob);
-		    
-		}
-	    } catch (err) {
-		audioElement.setAttribute("disabled","disabled");
-		playPauseButton.setAttribute("disabled","disabled");
-		playPauseButton.setAttribute("title","No audio");
-	    	logMessage("error", err.message, err);
-	    }
-	} else {
-	    console.log(resp);
-	    const errMsg = await resp.text();
-	    logMessage("error", "couldn't get audio from server : " + errMsg);
-	}
-	
-    })();
-
+// set up audio element for playback of audio streamed from server (with support for seeking)
+function streamAudio(audioElement, playPauseButton, url) {
+    audioElement.preload = "metadata";
+    audioElement.onerror = function() {
+	audioElement.setAttribute("disabled","disabled");
+	playPauseButton.setAttribute("disabled","disabled");
+	playPauseButton.setAttribute("title","No audio");
+	logMessage("error", "couldn't get audio from server : " + url);
+    };
+    audioElement.src = url;
 }
 
 // validate session name text field
@@ -992,7 +1001,7 @@ recSendButton.addEventListener("click", function() {
 });
 
 sessionField.addEventListener("keyup", function() { validateSessionName() });
-sessionField.addEventListener("change", function() { validateSessionName() });
+sessionField.addEventListener("change", function() { validateSessionName(); loadAbbrevTable(); });
 
 document.getElementById("do_autostart").addEventListener("click", function(evt) {
     const ele = document.getElementById("autostart_on_off_text");
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Storage of sessions, utterances and abbreviations. The handlers read and write through the Store interface, which has
+// two implementations: fsStore, which keeps the files in session folders in baseDir (the default), and sqliteStore, which
+// keeps the sessions and abbreviations in an embedded SQLite database. The store is selected by the -store flag.
+//
+// Server state that isn't session data is kept in files in baseDir with either store, and doesn't go through Store:
+// uploads in progress (see streamToFile and chunkedUploadPaths), the recognition jobs and their results (see
+// jobFilePath), and the abbreviation change log (see abbrevLogFilePath). A few features need the session files in the
+// local file system, and are only available with fsStore (see localDir).
+
+// Store holds the sessions, and for each utterance (basename) of a session: its metadata (the .json file), its text
+// versions (rec and edi), and its audio files (the uploaded file, and converted files, one per file extension).
+// Methods looking up a missing session or file return an error for which os.IsNotExist is true.
+// Names should be cleaned before they are passed to a store (see cleanSessionName).
+type Store interface {
+	// Sessions lists the sessions, sorted by name
+	Sessions() ([]string, error)
+	SessionExists(session string) bool
+	// CreateSession creates a session if it doesn't exist, and returns true if it was created
+	CreateSession(session string) (bool, error)
+	// Files lists the files of a session as <basename>.<ext> (json for the metadata), sorted by name
+	Files(session string) ([]string, error)
+	// Exists returns true if the session has the file <basename>.<ext>
+	Exists(session, fileName string) bool
+
+	Metadata(session, basename string) (JSONObject, error)
+	SaveMetadata(session, basename string, jo JSONObject) error
+
+	// Text returns a text version (rec or edi) of an utterance
+	Text(session, basename, version string) (string, error)
+	SaveText(session, basename, version, text string) error
+
+	// Audio opens the audio file with the given extension (e.g. webm, or wav for a converted file)
+	Audio(session, basename, ext string) (audioBlob, error)
+	SaveAudio(session, basename, ext string, r io.Reader) error
+	// ImportAudio moves a local file into the store: a file created by TempFile, or an upload in baseDir (see streamToFile)
+	ImportAudio(session, basename, ext, tmpFile string) error
+	RemoveAudio(session, basename, ext string) error
+	// AudioPath returns the path of an audio file in the local file system, for external commands.
+	// The release function must be called when the file is no longer needed.
+	AudioPath(session, basename, ext string) (string, func(), error)
+	// TempFile creates a temporary file in the local file system (see ioutil.TempFile), e.g. for audio to be imported
+	TempFile(session, pattern string) (*os.File, error)
+
+	// Check looks for files left incomplete by a crash, repairs them if possible, and returns a list of the problems found
+	Check() ([]string, error)
+
+	// SaveBackup saves a copy of a file before it is overwritten, and returns the name of the backup.
+	// Earlier backups of the same file are kept.
+	SaveBackup(session, fileName string, r io.Reader) (string, error)
+
+	// Revisions lists the revisions of the edited text (edi) of an utterance, oldest first
+	Revisions(session, basename string) ([]revision, error)
+	// RevisionText returns the text of a revision
+	RevisionText(session, basename string, id int) (string, error)
+	// SaveRevision adds a revision of the edited text, numbered after the latest revision, and returns it with its id.
+	// The caller should hold the utterance lock (see lockUtterance).
+	SaveRevision(session, basename string, rev revision, text string) (revision, error)
+
+	// Abbrevs returns the saved abbreviations, by scope
+	Abbrevs() (map[abbrevScope]map[string]string, error)
+	SaveAbbrevs(m map[abbrevScope]map[string]string) error
+}
+
+// store is set by main, using the -store flag
+var store Store
+
+// localDir returns the folder of the session folders, if the store keeps them in the local file system (fsStore). It is
+// used for watching the abbreviation file (see watchAbbrevFile), and for the default audio_dir of a Kaldi export.
+func localDir(s Store) (string, bool) {
+	fs, ok := s.(fsStore)
+	return fs.dir, ok
+}
+
+// audioBlob is an audio file opened from a store
+type audioBlob interface {
+	io.ReadSeeker
+	io.Closer
+	Name() string
+	Size() int64
+	ModTime() time.Time
+}
+
+// notExist returns an error for a missing file, for which os.IsNotExist is true
+func notExist(name string) error {
+	return &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+}
+
+// splitFileName splits a file name into basename and extension (without dot). If there is no extension, defaultExt is used.
+func splitFileName(fileName, defaultExt string) (string, string) {
+	ext := filepath.Ext(fileName)
+	if ext == "" {
+		return fileName, defaultExt
+	}
+	return strings.TrimSuffix(fileName, ext), strings.TrimPrefix(ext, ".")
+}
+
+// fsStore keeps each session in a folder in dir, with the files <basename>.json, <basename>.rec, <basename>.edi
+// and <basename>.<audio ext>. Revisions of the edited text are kept in the folder historyDir in the session folder, as
+// <basename>.<id>.edi and <basename>.<id>.json (the revision info). The abbreviations are kept in abbrevFilePath.
+type fsStore struct {
+	dir string
+}
+
+func newFSStore(dir string) fsStore {
+	return fsStore{dir: dir}
+}
+
+// historyDir is the folder of revisions in a session folder. Session file names can't start with a dot, so it doesn't
+// clash with other files.
+const historyDir = ".history"
+
+// path returns the path of a session folder, or a file or folder in it. Every file that is read or written goes
+// through path, which checks that each part is inside the folder before it (see inDir), so that the session is a folder
+// in s.dir, and the file is inside the session folder.
+func (s fsStore) path(session string, elem ...string) (string, error) {
+	p := s.dir
+	for _, e := range append([]string{session}, elem...) {
+		next := filepath.Join(p, e)
+		if err := inDir(p, next); err != nil {
+			return next, err
+		}
+		p = next
+	}
+	return p, nil
+}
+
+func (s fsStore) file(session, basename, ext string) (string, error) {
+	return s.path(session, basename+"."+ext)
+}
+
+func (s fsStore) revisionFile(session, basename string, id int, ext string) (string, error) {
+	return s.path(session, historyDir, fmt.Sprintf("%s.%d.%s", basename, id, ext))
+}
+
+func (s fsStore) Sessions() ([]string, error) {
+	res := []string{}
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return res, err
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			res = append(res, f.Name())
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func (s fsStore) SessionExists(session string) bool {
+	p, err := s.path(session)
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(p)
+	return err == nil && info.IsDir()
+}
+
+func (s fsStore) CreateSession(session string) (bool, error) {
+	p, err := s.path(session)
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		return false, nil
+	}
+	err = os.Mkdir(p, os.ModePerm)
+	if os.IsExist(err) {
+		// created by a concurrent request
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Files lists the files of a session folder, except backup (.BAK) and temporary (~) files, and folders
+func (s fsStore) Files(session string) ([]string, error) {
+	res := []string{}
+	dir, err := s.path(session)
+	if err != nil {
+		return res, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return res, err
+	}
+	for _, f := range files {
+		fName := f.Name()
+		if f.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(fName, ".BAK") {
+			continue
+		}
+		if strings.HasSuffix(fName, "~") {
+			continue
+		}
+		res = append(res, fName)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func (s fsStore) Exists(session, fileName string) bool {
+	p, err := s.path(session, fileName)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(p)
+	return !os.IsNotExist(err)
+}
+
+func (s fsStore) Metadata(session, basename string) (JSONObject, error) {
+	res := JSONObject{}
+	fName, err := s.file(session, basename, "json")
+	if err != nil {
+		return res, err
+	}
+	bts, err := ioutil.ReadFile(fName)
+	if err != nil {
+		return res, err
+	}
+	err = json.Unmarshal(bts, &res)
+	if err != nil {
+		return res, fmt.Errorf("couldn't unmarshal JSON : %v", err)
+	}
+	return res, nil
+}
+
+func (s fsStore) SaveMetadata(session, basename string, jo JSONObject) error {
+	jsonPretty, err := prettyMarshal(jo)
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON : %v", err)
+	}
+	fName, err := s.file(session, basename, "json")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fName, jsonPretty, 0644)
+}
+
+func (s fsStore) Text(session, basename, version string) (string, error) {
+	fName, err := s.file(session, basename, version)
+	if err != nil {
+		return "", err
+	}
+	bts, err := ioutil.ReadFile(fName)
+	if err != nil {
+		return "", err
+	}
+	return string(bts), nil
+}
+
+func (s fsStore) SaveText(session, basename, version, text string) error {
+	fName, err := s.file(session, basename, version)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fName, []byte(text), 0644)
+}
+
+// fileBlob is an audio file in the file system
+type fileBlob struct {
+	*os.File
+	info os.FileInfo
+}
+
+func (b fileBlob) Name() string       { return b.info.Name() }
+func (b fileBlob) Size() int64        { return b.info.Size() }
+func (b fileBlob) ModTime() time.Time { return b.info.ModTime() }
+
+func (s fsStore) Audio(session, basename, ext string) (audioBlob, error) {
+	fName, err := s.file(session, basename, ext)
+	if err != nil {
+		return nil, err
+	}
+	fh, err := os.Open(fName)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		fh.Close()
+		return nil, notExist(fName)
+	}
+	return fileBlob{File: fh, info: info}, nil
+}
+
+func (s fsStore) SaveAudio(session, basename, ext string, r io.Reader) error {
+	fName, err := s.file(session, basename, ext)
+	if err != nil {
+		return err
+	}
+	return copyFileAtomic(fName, r, 0644)
+}
+
+func (s fsStore) ImportAudio(session, basename, ext, tmpFile string) error {
+	fName, err := s.file(session, basename, ext)
+	if err != nil {
+		return err
+	}
+	os.Chmod(tmpFile, 0644)
+	return renameAtomic(tmpFile, fName)
+}
+
+func (s fsStore) RemoveAudio(session, basename, ext string) error {
+	fName, err := s.file(session, basename, ext)
+	if err != nil {
+		return err
+	}
+	return os.Remove(fName)
+}
+
+func (s fsStore) AudioPath(session, basename, ext string) (string, func(), error) {
+	fName, err := s.file(session, basename, ext)
+	if err != nil {
+		return "", func() {}, err
+	}
+	if _, err := os.Stat(fName); err != nil {
+		return "", func() {}, err
+	}
+	return fName, func() {}, nil
+}
+
+// TempFile creates a temporary file in the session folder. The pattern should end with ~, so that the file is not listed.
+func (s fsStore) TempFile(session, pattern string) (*os.File, error) {
+	dir, err := s.path(session)
+	if err != nil {
+		return nil, err
+	}
+	if strings.ContainsAny(pattern, `/\`) {
+		return nil, fmt.Errorf("invalid temp file pattern: %s", pattern)
+	}
+	return ioutil.TempFile(dir, pattern)
+}
+
+// SaveBackup saves a backup file as <fileName>.<time>.BAK
+func (s fsStore) SaveBackup(session, fileName string, r io.Reader) (string, error) {
+	fName, err := s.path(session, fileName+"."+time.Now().UTC().Format("20060102T150405.000")+".BAK")
+	if err != nil {
+		return fName, err
+	}
+	return fName, copyFileAtomic(fName, r, 0644)
+}
+
+// revisionID returns the revision id of a revision info file name (<basename>.<id>.json)
+func revisionID(name, basename string) (int, bool) {
+	if !strings.HasPrefix(name, basename+".") || !strings.HasSuffix(name, ".json") {
+		return 0, false
+	}
+	s := strings.TrimSuffix(strings.TrimPrefix(name, basename+"."), ".json")
+	id, err := strconv.Atoi(s)
+	if err != nil || id <= 0 || strconv.Itoa(id) != s {
+		return 0, false
+	}
+	return id, true
+}
+
+func (s fsStore) Revisions(session, basename string) ([]revision, error) {
+	res := []revision{}
+	dir, err := s.path(session, historyDir)
+	if err != nil {
+		return res, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return res, nil
+	}
+	if err != nil {
+		return res, err
+	}
+	for _, f := range files {
+		id, ok := revisionID(f.Name(), basename)
+		if !ok {
+			continue
+		}
+		bts, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return res, err
+		}
+		var rev revision
+		err = json.Unmarshal(bts, &rev)
+		if err != nil {
+			return res, fmt.Errorf("couldn't unmarshal JSON %s : %v", f.Name(), err)
+		}
+		rev.ID = id
+		res = append(res, rev)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res, nil
+}
+
+func (s fsStore) RevisionText(session, basename string, id int) (string, error) {
+	infoFile, err := s.revisionFile(session, basename, id, "json")
+	if err != nil {
+		return "", err
+	}
+	textFile, err := s.revisionFile(session, basename, id, "edi")
+	if err != nil {
+		return "", err
+	}
+	// the info file is written last, so a revision without it is incomplete
+	if _, err := os.Stat(infoFile); err != nil {
+		return "", err
+	}
+	bts, err := ioutil.ReadFile(textFile)
+	if err != nil {
+		return "", err
+	}
+	return string(bts), nil
+}
+
+func (s fsStore) SaveRevision(session, basename string, rev revision, text string) (revision, error) {
+	revs, err := s.Revisions(session, basename)
+	if err != nil {
+		return rev, err
+	}
+	rev.ID = 1
+	if len(revs) > 0 {
+		rev.ID = revs[len(revs)-1].ID + 1
+	}
+	dir, err := s.path(session, historyDir)
+	if err != nil {
+		return rev, err
+	}
+	textFile, err := s.revisionFile(session, basename, rev.ID, "edi")
+	if err != nil {
+		return rev, err
+	}
+	infoFile, err := s.revisionFile(session, basename, rev.ID, "json")
+	if err != nil {
+		return rev, err
+	}
+	err = os.Mkdir(dir, os.ModePerm)
+	if err != nil && !os.IsExist(err) {
+		return rev, err
+	}
+	err = writeFileAtomic(textFile, []byte(text), 0644)
+	if err != nil {
+		return rev, err
+	}
+	jsonPretty, err := prettyMarshal(rev)
+	if err != nil {
+		return rev, fmt.Errorf("failed to marshal JSON : %v", err)
+	}
+	return rev, writeFileAtomic(infoFile, jsonPretty, 0644)
+}
+
+// Check removes temporary files left by interrupted writes, cuts incomplete data off the end of WebM files (see
+// repairTruncated), and reports empty files, invalid .json files and unsaved live recordings
+func (s fsStore) Check() ([]string, error) {
+	res := []string{}
+	sessions, err := s.Sessions()
+	if err != nil {
+		return res, err
+	}
+	for _, session := range sessions {
+		files, err := ioutil.ReadDir(filepath.Join(s.dir, session))
+		if err != nil {
+			return res, err
+		}
+		for _, f := range files {
+			name := f.Name()
+			fName := filepath.Join(s.dir, session, name)
+			basename, ext := splitFileName(name, "")
+			switch {
+			case f.IsDir() && name == historyDir:
+				res = append(res, removeTempFiles(fName)...)
+			case f.IsDir() || strings.HasSuffix(name, ".BAK"):
+			case strings.HasSuffix(name, tmpFileSuffix):
+				if err := os.Remove(fName); err != nil {
+					res = append(res, fmt.Sprintf("failed to remove temporary file %s : %v", fName, err))
+				} else {
+					res = append(res, fmt.Sprintf("removed temporary file %s", fName))
+				}
+			case strings.Contains(name, ".live") && strings.HasSuffix(name, "~"):
+				res = append(res, fmt.Sprintf("unsaved live recording: %s", fName))
+			case strings.HasSuffix(name, "~"):
+			case f.Size() == 0:
+				res = append(res, fmt.Sprintf("empty file: %s", fName))
+			case ext == "json":
+				if _, err := s.Metadata(session, basename); err != nil {
+					res = append(res, fmt.Sprintf("invalid file %s : %v", fName, err))
+				}
+			case ext == "rec" || ext == "edi":
+			default:
+				_, err := repairTruncated(fName)
+				if err != nil {
+					res = append(res, fmt.Sprintf("invalid audio file %s : %v", fName, err))
+				} else if info, err := os.Stat(fName); err == nil && info.Size() < f.Size() {
+					res = append(res, fmt.Sprintf("removed incomplete data at the end of %s (%d bytes)", fName, f.Size()-info.Size()))
+				}
+			}
+		}
+	}
+	return res, nil
+}
+
+// removeTempFiles removes temporary files left by interrupted writes in a folder
+func removeTempFiles(dir string) []string {
+	res := []string{}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return append(res, fmt.Sprintf("failed to read folder %s : %v", dir, err))
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), tmpFileSuffix) {
+			continue
+		}
+		fName := filepath.Join(dir, f.Name())
+		if err := os.Remove(fName); err != nil {
+			res = append(res, fmt.Sprintf("failed to remove temporary file %s : %v", fName, err))
+		} else {
+			res = append(res, fmt.Sprintf("removed temporary file %s", fName))
+		}
+	}
+	return res
+}
+
+func (s fsStore) Abbrevs() (map[abbrevScope]map[string]string, error) {
+	if _, err := os.Stat(abbrevFilePath); err != nil {
+		return nil, err
+	}
+	return tsvFile2Abbrevs(abbrevFilePath)
+}
+
+func (s fsStore) SaveAbbrevs(m map[abbrevScope]map[string]string) error {
+	return abbrevs2TSVFile(m, abbrevFilePath)
+}
@@ -0,0 +1,306 @@
+// Package subtitle reads and writes subtitles in SRT (SubRip) and WebVTT format.
+package subtitle
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cue is a single subtitle: a time interval and one or more lines of text
+type Cue struct {
+	// ID is the cue number of an SRT file, or the (optional) cue identifier of a WebVTT file
+	ID string
+
+	Start time.Duration
+	End   time.Duration
+
+	// Lines of text (may be empty)
+	Lines []string
+
+	// Settings holds WebVTT cue settings, e.g. "align:start line:0"
+	Settings string
+}
+
+// Text returns the lines of the cue, separated by newline
+func (c Cue) Text() string {
+	return strings.Join(c.Lines, "\n")
+}
+
+// Timing returns the timing line of the cue in SRT format, e.g. 00:00:01,500 --> 00:00:03,000
+func (c Cue) Timing() string {
+	return FormatSRTTime(c.Start) + " --> " + FormatSRTTime(c.End)
+}
+
+// FormatSRTTime formats a duration as an SRT timestamp, e.g. 01:02:03,004
+func FormatSRTTime(d time.Duration) string {
+	return formatTime(d, ",")
+}
+
+// FormatVTTTime formats a duration as a WebVTT timestamp, e.g. 01:02:03.004
+func FormatVTTTime(d time.Duration) string {
+	return formatTime(d, ".")
+}
+
+func formatTime(d time.Duration, msSep string) string {
+	if d < 0 {
+		d = 0
+	}
+	ms := int64(d / time.Millisecond)
+	h := ms / 3600000
+	m := (ms / 60000) % 60
+	s := (ms / 1000) % 60
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", h, m, s, msSep, ms%1000)
+}
+
+// ParseTime parses an SRT or WebVTT timestamp: [hh:]mm:ss[,.]ttt. Both comma and period are accepted as decimal separator.
+func ParseTime(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	fields := strings.Split(strings.Replace(s, ",", ".", 1), ":")
+	if len(fields) < 2 || len(fields) > 3 {
+		return 0, fmt.Errorf("invalid timestamp '%s'", s)
+	}
+	var h, m int64
+	var err error
+	if len(fields) == 3 {
+		h, err = strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || h < 0 {
+			return 0, fmt.Errorf("invalid hours in timestamp '%s'", s)
+		}
+		fields = fields[1:]
+	}
+	m, err = strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || m < 0 || m > 59 {
+		return 0, fmt.Errorf("invalid minutes in timestamp '%s'", s)
+	}
+	secFields := strings.SplitN(fields[1], ".", 2)
+	sec, err := strconv.ParseInt(secFields[0], 10, 64)
+	if err != nil || sec < 0 || sec > 59 {
+		return 0, fmt.Errorf("invalid seconds in timestamp '%s'", s)
+	}
+	var ms int64
+	if len(secFields) == 2 {
+		frac := secFields[1]
+		if frac == "" || len(frac) > 3 {
+			return 0, fmt.Errorf("invalid milliseconds in timestamp '%s'", s)
+		}
+		frac = (frac + "00")[:3]
+		ms, err = strconv.ParseInt(frac, 10, 64)
+		if err != nil || ms < 0 {
+			return 0, fmt.Errorf("invalid milliseconds in timestamp '%s'", s)
+		}
+	}
+	return time.Duration(((h*60+m)*60+sec)*1000+ms) * time.Millisecond, nil
+}
+
+// parseTiming parses a timing line, e.g. "00:00:01,500 --> 00:00:03,000 align:start".
+// Anything after the end timestamp is returned as settings.
+func parseTiming(line string) (time.Duration, time.Duration, string, error) {
+	fields := strings.SplitN(line, "-->", 2)
+	if len(fields) != 2 {
+		return 0, 0, "", fmt.Errorf("invalid timing line '%s'", line)
+	}
+	start, err := ParseTime(fields[0])
+	if err != nil {
+		return 0, 0, "", err
+	}
+	rest := strings.Fields(fields[1])
+	if len(rest) == 0 {
+		return 0, 0, "", fmt.Errorf("missing end time in timing line '%s'", line)
+	}
+	end, err := ParseTime(rest[0])
+	if err != nil {
+		return 0, 0, "", err
+	}
+	if end < start {
+		return 0, 0, "", fmt.Errorf("end time before start time in timing line '%s'", line)
+	}
+	return start, end, strings.Join(rest[1:], " "), nil
+}
+
+type block struct {
+	firstLine int // line number of the first line, for error messages
+	lines     []string
+}
+
+// readBlocks reads the input as blocks of lines separated by blank lines.
+// A byte order mark is removed, and CRLF or CR line endings are accepted.
+func readBlocks(r io.Reader) ([]block, error) {
+	bts, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	s := strings.TrimPrefix(string(bts), "\ufeff")
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	s = strings.Replace(s, "\r", "\n", -1)
+
+	res := []block{}
+	var cur *block
+	sc := bufio.NewScanner(strings.NewReader(s))
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	n := 0
+	for sc.Scan() {
+		n++
+		line := strings.TrimRight(sc.Text(), " \t")
+		if strings.TrimSpace(line) == "" {
+			if cur != nil {
+				res = append(res, *cur)
+				cur = nil
+			}
+			continue
+		}
+		if cur == nil {
+			cur = &block{firstLine: n}
+		}
+		cur.lines = append(cur.lines, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if cur != nil {
+		res = append(res, *cur)
+	}
+	return res, nil
+}
+
+// ParseSRT reads subtitles in SRT format. The cue number line is optional,
+// and cues may have any number of text lines.
+func ParseSRT(r io.Reader) ([]Cue, error) {
+	blocks, err := readBlocks(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read srt : %v", err)
+	}
+	res := []Cue{}
+	for _, b := range blocks {
+		var c Cue
+		lines := b.lines
+		lineNo := b.firstLine
+		if !strings.Contains(lines[0], "-->") {
+			c.ID = strings.TrimSpace(lines[0])
+			if _, err := strconv.Atoi(c.ID); err != nil {
+				return res, fmt.Errorf("line %d: expected cue number, found '%s'", lineNo, lines[0])
+			}
+			lines = lines[1:]
+			lineNo++
+		}
+		if len(lines) == 0 {
+			return res, fmt.Errorf("line %d: missing timing line after cue number %s", lineNo, c.ID)
+		}
+		c.Start, c.End, _, err = parseTiming(lines[0])
+		if err != nil {
+			return res, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		c.Lines = append([]string{}, lines[1:]...)
+		if c.ID == "" {
+			c.ID = strconv.Itoa(len(res) + 1)
+		}
+		res = append(res, c)
+	}
+	return res, nil
+}
+
+// ParseWebVTT reads subtitles in WebVTT format. NOTE, STYLE and REGION blocks are skipped.
+func ParseWebVTT(r io.Reader) ([]Cue, error) {
+	blocks, err := readBlocks(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read webvtt : %v", err)
+	}
+	if len(blocks) == 0 || !isVTTHeader(blocks[0].lines[0]) {
+		return nil, fmt.Errorf("missing WEBVTT header")
+	}
+	res := []Cue{}
+	for _, b := range blocks[1:] {
+		lines := b.lines
+		lineNo := b.firstLine
+		first := strings.Fields(lines[0])
+		if len(first) > 0 && (first[0] == "NOTE" || first[0] == "STYLE" || first[0] == "REGION") && !strings.Contains(lines[0], "-->") {
+			continue
+		}
+		var c Cue
+		if !strings.Contains(lines[0], "-->") {
+			c.ID = lines[0]
+			lines = lines[1:]
+			lineNo++
+		}
+		if len(lines) == 0 {
+			return res, fmt.Errorf("line %d: missing timing line after cue identifier '%s'", lineNo, c.ID)
+		}
+		c.Start, c.End, c.Settings, err = parseTiming(lines[0])
+		if err != nil {
+			return res, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		c.Lines = append([]string{}, lines[1:]...)
+		res = append(res, c)
+	}
+	return res, nil
+}
+
+func isVTTHeader(line string) bool {
+	return line == "WEBVTT" || strings.HasPrefix(line, "WEBVTT ") || strings.HasPrefix(line, "WEBVTT\t")
+}
+
+// Parse reads subtitles in WebVTT format if the input starts with a WEBVTT header, otherwise in SRT format
+func Parse(r io.Reader) ([]Cue, error) {
+	bts, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	s := strings.TrimPrefix(string(bts), "\ufeff")
+	if isVTTHeader(strings.TrimRight(strings.SplitN(s, "\n", 2)[0], "\r")) {
+		return ParseWebVTT(strings.NewReader(s))
+	}
+	return ParseSRT(strings.NewReader(s))
+}
+
+// cueLines returns the text lines of a cue, without empty lines (which would end the cue)
+func cueLines(c Cue) []string {
+	res := []string{}
+	for _, l := range c.Lines {
+		for _, ll := range strings.Split(l, "\n") {
+			if strings.TrimSpace(ll) != "" {
+				res = append(res, strings.TrimRight(ll, "\r"))
+			}
+		}
+	}
+	return res
+}
+
+// WriteSRT writes the cues in SRT format. Cues are numbered from 1, in the order given.
+func WriteSRT(w io.Writer, cues []Cue) error {
+	bw := bufio.NewWriter(w)
+	for i, c := range cues {
+		if i > 0 {
+			fmt.Fprint(bw, "\n")
+		}
+		fmt.Fprintf(bw, "%d\n%s --> %s\n", i+1, FormatSRTTime(c.Start), FormatSRTTime(c.End))
+		for _, l := range cueLines(c) {
+			fmt.Fprintf(bw, "%s\n", l)
+		}
+	}
+	return bw.Flush()
+}
+
+// WriteWebVTT writes the cues in WebVTT format
+func WriteWebVTT(w io.Writer, cues []Cue) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprint(bw, "WEBVTT\n")
+	for _, c := range cues {
+		fmt.Fprint(bw, "\n")
+		if id := strings.TrimSpace(c.ID); id != "" && !strings.Contains(id, "-->") {
+			fmt.Fprintf(bw, "%s\n", id)
+		}
+		fmt.Fprintf(bw, "%s --> %s", FormatVTTTime(c.Start), FormatVTTTime(c.End))
+		if c.Settings != "" {
+			fmt.Fprintf(bw, " %s", c.Settings)
+		}
+		fmt.Fprint(bw, "\n")
+		for _, l := range cueLines(c) {
+			fmt.Fprintf(bw, "%s\n", l)
+		}
+	}
+	return bw.Flush()
+}
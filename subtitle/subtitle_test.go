@@ -0,0 +1,213 @@
+package subtitle
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func ms(n int) time.Duration {
+	return time.Duration(n) * time.Millisecond
+}
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		in     string
+		expect time.Duration
+	}{
+		{"00:00:01,500", ms(1500)},
+		{"00:00:01.500", ms(1500)},
+		{"01:02:03,004", ms(3723004)},
+		{"02:03.4", ms(123400)},
+		{"100:00:00,000", 100 * time.Hour},
+	}
+	for _, test := range tests {
+		res, err := ParseTime(test.in)
+		if err != nil {
+			t.Errorf("ParseTime(%q): %v", test.in, err)
+			continue
+		}
+		if res != test.expect {
+			t.Errorf("ParseTime(%q): expected %v, got %v", test.in, test.expect, res)
+		}
+	}
+
+	for _, in := range []string{"", "1", "00:00:01,", "00:00:01,5000", "00:60:00,000", "00:00:60,000", "aa:00:01,000", "00:-1:01,000", "1:2:3:4", "00:00:01,a00"} {
+		if _, err := ParseTime(in); err == nil {
+			t.Errorf("ParseTime(%q): expected error", in)
+		}
+	}
+}
+
+func TestParseSRT(t *testing.T) {
+	expect := []Cue{
+		{ID: "1", Start: ms(1000), End: ms(2500), Lines: []string{"first line", "second line"}},
+		{ID: "2", Start: ms(3000), End: ms(4000), Lines: []string{"third"}},
+	}
+	tests := map[string]string{
+		"LF":       "1\n00:00:01,000 --> 00:00:02,500\nfirst line\nsecond line\n\n2\n00:00:03,000 --> 00:00:04,000\nthird\n",
+		"CRLF":     "1\r\n00:00:01,000 --> 00:00:02,500\r\nfirst line\r\nsecond line\r\n\r\n2\r\n00:00:03,000 --> 00:00:04,000\r\nthird\r\n",
+		"CR":       "1\r00:00:01,000 --> 00:00:02,500\rfirst line\rsecond line\r\r2\r00:00:03,000 --> 00:00:04,000\rthird\r",
+		"BOM":      "\ufeff1\n00:00:01,000 --> 00:00:02,500\nfirst line\nsecond line\n\n2\n00:00:03,000 --> 00:00:04,000\nthird\n",
+		"numbers":  "00:00:01,000 --> 00:00:02,500\nfirst line\nsecond line\n\n00:00:03,000 --> 00:00:04,000\nthird\n",
+		"blanks":   "\n\n1\n00:00:01,000 --> 00:00:02,500\nfirst line  \nsecond line\n \n\n\n2\n00:00:03,000 --> 00:00:04,000\nthird",
+		"period":   "1\n00:00:01.000 --> 00:00:02.500\nfirst line\nsecond line\n\n2\n00:00:03.000 --> 00:00:04.000\nthird\n",
+		"settings": "1\n00:00:01,000 --> 00:00:02,500 X1:0 X2:10\nfirst line\nsecond line\n\n2\n00:00:03,000 --> 00:00:04,000\nthird\n",
+	}
+	for name, in := range tests {
+		res, err := ParseSRT(strings.NewReader(in))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(res, expect) {
+			t.Errorf("%s: expected %#v, got %#v", name, expect, res)
+		}
+	}
+}
+
+func TestParseSRTEmptyCue(t *testing.T) {
+	res, err := ParseSRT(strings.NewReader("1\n00:00:01,000 --> 00:00:02,000\n\n2\n00:00:03,000 --> 00:00:04,000\ntext\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || len(res[0].Lines) != 0 || res[1].Text() != "text" {
+		t.Errorf("unexpected cues: %#v", res)
+	}
+}
+
+func TestParseSRTErrors(t *testing.T) {
+	tests := map[string]string{
+		"invalid timestamp": "1\n00:00:01,000 --> 00:0x:02,000\ntext\n",
+		"end before start":  "1\n00:00:02,000 --> 00:00:01,000\ntext\n",
+		"missing end time":  "1\n00:00:01,000 -->\ntext\n",
+		"missing arrow":     "1\n00:00:01,000 00:00:02,000\ntext\n",
+		"missing timing":    "1\n\n2\n00:00:01,000 --> 00:00:02,000\ntext\n",
+		"invalid number":    "one\n00:00:01,000 --> 00:00:02,000\ntext\n",
+	}
+	for name, in := range tests {
+		if _, err := ParseSRT(strings.NewReader(in)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestParseWebVTT(t *testing.T) {
+	in := "\ufeffWEBVTT - test file\r\n" +
+		"\r\n" +
+		"NOTE a comment\r\n" +
+		"spanning two lines\r\n" +
+		"\r\n" +
+		"STYLE\r\n" +
+		"::cue { color: yellow }\r\n" +
+		"\r\n" +
+		"REGION\r\n" +
+		"id:r1 width:40%\r\n" +
+		"\r\n" +
+		"intro\r\n" +
+		"00:01.000 --> 00:02.500 align:start line:0\r\n" +
+		"first line\r\n" +
+		"second line\r\n" +
+		"\r\n" +
+		"00:00:03.000 --> 00:00:04.000\r\n" +
+		"third\r\n"
+	expect := []Cue{
+		{ID: "intro", Start: ms(1000), End: ms(2500), Lines: []string{"first line", "second line"}, Settings: "align:start line:0"},
+		{Start: ms(3000), End: ms(4000), Lines: []string{"third"}},
+	}
+	res, err := ParseWebVTT(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, expect) {
+		t.Errorf("expected %#v, got %#v", expect, res)
+	}
+}
+
+func TestParseWebVTTErrors(t *testing.T) {
+	tests := map[string]string{
+		"missing header":    "00:01.000 --> 00:02.000\ntext\n",
+		"invalid header":    "WEBVTTX\n\n00:01.000 --> 00:02.000\ntext\n",
+		"invalid timestamp": "WEBVTT\n\n00:01.000 --> 00:02.0000\ntext\n",
+		"end before start":  "WEBVTT\n\n00:03.000 --> 00:02.000\ntext\n",
+		"missing timing":    "WEBVTT\n\nid\n\n00:01.000 --> 00:02.000\ntext\n",
+	}
+	for name, in := range tests {
+		if _, err := ParseWebVTT(strings.NewReader(in)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	vtt, err := Parse(strings.NewReader("\ufeffWEBVTT\r\n\r\n00:01.000 --> 00:02.000 align:end\r\ntext\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vtt) != 1 || vtt[0].Settings != "align:end" {
+		t.Errorf("expected WebVTT cue with settings, got %#v", vtt)
+	}
+	srt, err := Parse(strings.NewReader("1\n00:00:01,000 --> 00:00:02,000\ntext\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srt) != 1 || srt[0].ID != "1" {
+		t.Errorf("expected SRT cue, got %#v", srt)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	cues := []Cue{
+		{ID: "7", Start: ms(1000), End: ms(2500), Lines: []string{"first line", "", "second line\nthird line"}},
+		{Start: ms(3723004), End: ms(3724000), Lines: []string{"last"}, Settings: "align:start"},
+	}
+
+	var srt bytes.Buffer
+	if err := WriteSRT(&srt, cues); err != nil {
+		t.Fatal(err)
+	}
+	expectSRT := "1\n00:00:01,000 --> 00:00:02,500\nfirst line\nsecond line\nthird line\n\n2\n01:02:03,004 --> 01:02:04,000\nlast\n"
+	if srt.String() != expectSRT {
+		t.Errorf("expected SRT %q, got %q", expectSRT, srt.String())
+	}
+
+	var vtt bytes.Buffer
+	if err := WriteWebVTT(&vtt, cues); err != nil {
+		t.Fatal(err)
+	}
+	expectVTT := "WEBVTT\n\n7\n00:00:01.000 --> 00:00:02.500\nfirst line\nsecond line\nthird line\n\n01:02:03.004 --> 01:02:04.000 align:start\nlast\n"
+	if vtt.String() != expectVTT {
+		t.Errorf("expected WebVTT %q, got %q", expectVTT, vtt.String())
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	in := "1\r\n00:00:01,000 --> 00:00:02,500\r\nfirst line\r\nsecond line\r\n\r\n2\r\n00:00:03,000 --> 00:01:04,040\r\nthird\r\n"
+	cues, err := ParseSRT(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var vtt bytes.Buffer
+	if err := WriteWebVTT(&vtt, cues); err != nil {
+		t.Fatal(err)
+	}
+	vttCues, err := ParseWebVTT(&vtt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vttCues, cues) {
+		t.Errorf("SRT -> WebVTT: expected %#v, got %#v", cues, vttCues)
+	}
+
+	var srt bytes.Buffer
+	if err := WriteSRT(&srt, vttCues); err != nil {
+		t.Fatal(err)
+	}
+	expect := strings.Replace(in, "\r\n", "\n", -1)
+	if srt.String() != expect {
+		t.Errorf("SRT -> WebVTT -> SRT: expected %q, got %q", expect, srt.String())
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Optimistic concurrency control for text saves. getText returns the ETag of a text (and the latest revision of an
+// edited text), and a save may give the version it was based on, with the If-Match header or the base_revision field.
+// If the text has been changed since, the save is rejected with 409 Conflict, along with both versions, so that the
+// client can merge them.
+
+// textVersion is a version of a text in a conflict response
+type textVersion struct {
+	Revision int    `json:"revision,omitempty"`
+	ETag     string `json:"etag,omitempty"`
+	Text     string `json:"text"`
+}
+
+// textConflictResponse is returned when a text has been changed since the version a save was based on.
+// Current is the saved text, Submitted is the rejected text, and Base is the revision that the client edited, if given
+// by base_revision.
+type textConflictResponse struct {
+	Message   string       `json:"message"`
+	Current   textVersion  `json:"current"`
+	Submitted textVersion  `json:"submitted"`
+	Base      *textVersion `json:"base,omitempty"`
+}
+
+type saveTextResponse struct {
+	Message string `json:"message"`
+	// Revision: the revision of a saved edited text
+	Revision int `json:"revision,omitempty"`
+}
+
+// textETag returns the ETag of a text, a quoted checksum
+func textETag(text string) string {
+	return fmt.Sprintf("\"%x\"", sha256.Sum256([]byte(text)))
+}
+
+// etagMatches checks the value of an If-Match header (a list of ETags, or *) against the ETag of a file
+func etagMatches(ifMatch, etag string, exists bool) bool {
+	for _, t := range strings.Split(ifMatch, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" && exists {
+			return true
+		}
+		// weak ETags are compared as strong ones, since a text has only one representation
+		if exists && strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// latestRevisionID returns the id of the latest revision of an edited text, or 0 if there are no revisions
+func latestRevisionID(session, basename string) (int, error) {
+	revs, err := store.Revisions(session, basename)
+	if err != nil || len(revs) == 0 {
+		return 0, err
+	}
+	return revs[len(revs)-1].ID, nil
+}
+
+// checkTextVersion checks that a text (with the extension rec or edi) hasn't changed since the version given by
+// ifMatch (an If-Match header) and/or baseRevision (edi only). If it has changed, and the new text differs from the
+// saved one, a conflict response is returned.
+func checkTextVersion(session, basename, ext, ifMatch string, baseRevision int, text string) (*textConflictResponse, error) {
+	current, err := store.Text(session, basename, ext)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read text file : %v", err)
+	}
+	exists := err == nil
+	etag := textETag(current)
+	var revision int
+	if ext == "edi" {
+		revision, err = latestRevisionID(session, basename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read revisions : %v", err)
+		}
+	}
+
+	var changes []string
+	if ifMatch != "" && !etagMatches(ifMatch, etag, exists) {
+		changes = append(changes, fmt.Sprintf("ETag %s doesn't match", ifMatch))
+	}
+	if baseRevision > 0 && baseRevision != revision {
+		changes = append(changes, fmt.Sprintf("the latest revision is %d, not %d", revision, baseRevision))
+	}
+	if len(changes) == 0 || (exists && current == text) {
+		return nil, nil
+	}
+
+	fileName := fmt.Sprintf("%s/%s.%s", session, basename, ext)
+	res := &textConflictResponse{
+		Message:   fmt.Sprintf("file '%s' has been changed by someone else (%s)", fileName, strings.Join(changes, ", ")),
+		Submitted: textVersion{ETag: textETag(text), Text: text},
+	}
+	if !exists {
+		res.Message = fmt.Sprintf("file '%s' doesn't exist", fileName)
+	} else {
+		res.Current = textVersion{Revision: revision, ETag: etag, Text: current}
+	}
+	if baseRevision > 0 {
+		baseText, err := store.RevisionText(session, basename, baseRevision)
+		if err == nil {
+			res.Base = &textVersion{Revision: baseRevision, ETag: textETag(baseText), Text: baseText}
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read revision %d : %v", baseRevision, err)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Background conversion of uploaded audio files to other formats (e.g. 16 kHz mono wav or flac), using an external command.
+// The converted files are saved in the store next to the uploaded file, with the same basename.
+
+const defaultTranscodeCommand = "ffmpeg -loglevel error -y -i {input} -ar 16000 -ac 1 -f {format} {output}"
+
+// max time for converting one file
+var transcodeTimeout = 5 * time.Minute
+
+// max number of files waiting for conversion
+const transcodeQueueSize = 1000
+
+var audioFormatRE = regexp.MustCompile("^[a-z0-9]+$")
+
+type transcoder struct {
+	formats []string
+	command string
+	args    []string
+	queue   chan transcodeJob
+}
+
+// transcodeJob is an audio file to convert
+type transcodeJob struct {
+	session  string
+	basename string
+	ext      string
+}
+
+func (j transcodeJob) String() string {
+	return path.Join(j.session, j.basename+"."+j.ext)
+}
+
+// audioTranscoder is nil if transcoding is disabled
+var audioTranscoder *transcoder
+
+// newTranscoder creates a transcoder for a comma-separated list of formats, and starts its worker.
+// The command may contain the placeholders {input}, {output} and {format}. The output file has no
+// format extension, so the command must take the format from {format}.
+func newTranscoder(formats string, command string) (*transcoder, error) {
+	t := &transcoder{queue: make(chan transcodeJob, transcodeQueueSize)}
+	for _, f := range strings.Split(formats, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if f == "" {
+			continue
+		}
+		if !audioFormatRE.MatchString(f) {
+			return nil, fmt.Errorf("invalid audio format '%s'", f)
+		}
+		t.formats = append(t.formats, f)
+	}
+	if len(t.formats) == 0 {
+		return nil, fmt.Errorf("no audio formats to convert to")
+	}
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty transcode command")
+	}
+	t.command = fields[0]
+	t.args = fields[1:]
+	if _, err := exec.LookPath(t.command); err != nil {
+		return nil, fmt.Errorf("external '%s' command does not exist", t.command)
+	}
+	go t.worker()
+	return t, nil
+}
+
+// removeTranscoded removes converted versions of an audio file, since they are outdated when the file is overwritten
+func (t *transcoder) removeTranscoded(session, basename, ext string) {
+	for _, f := range t.formats {
+		if f == ext {
+			continue
+		}
+		if err := store.RemoveAudio(session, basename, f); err != nil && !os.IsNotExist(err) {
+			log.Printf("transcoder: failed to remove %s/%s.%s : %v", session, basename, f, err)
+		}
+	}
+}
+
+// converts returns true if audio files are converted to the given format
+func (t *transcoder) converts(format string) bool {
+	for _, f := range t.formats {
+		if strings.EqualFold(f, format) {
+			return true
+		}
+	}
+	return false
+}
+
+// submit queues an audio file for conversion
+func (t *transcoder) submit(session, basename, ext string) {
+	j := transcodeJob{session: session, basename: basename, ext: ext}
+	select {
+	case t.queue <- j:
+	default:
+		log.Printf("transcoder: queue is full, skipping %s", j)
+	}
+}
+
+func (t *transcoder) worker() {
+	for j := range t.queue {
+		for _, f := range t.formats {
+			if strings.EqualFold(j.ext, f) {
+				continue
+			}
+			err := t.transcode(j, f)
+			if err != nil {
+				log.Printf("transcoder: %v", err)
+				continue
+			}
+			log.Printf("transcoder: converted %s to %s", j, f)
+		}
+	}
+}
+
+// transcode converts an audio file to the given format. The output is written to a temporary file
+// (see Store.TempFile), which is imported into the store when the conversion is done.
+func (t *transcoder) transcode(j transcodeJob, format string) error {
+	audioFile, release, err := store.AudioPath(j.session, j.basename, j.ext)
+	if err != nil {
+		return fmt.Errorf("failed to read %s : %v", j, err)
+	}
+	defer release()
+	fh, err := store.TempFile(j.session, j.basename+"."+format+".*"+tmpFileSuffix)
+	if err != nil {
+		return fmt.Errorf("failed to create temp file : %v", err)
+	}
+	tmpFile := fh.Name()
+	fh.Close()
+	replacer := strings.NewReplacer("{input}", audioFile, "{output}", tmpFile, "{format}", format)
+	args := []string{}
+	for _, a := range t.args {
+		args = append(args, replacer.Replace(a))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), transcodeTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, t.command, args...)
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		os.Remove(tmpFile)
+		return fmt.Errorf("failed to convert %s to %s : %v : %s", j, format, err, strings.TrimSpace(stderr.String()))
+	}
+	unlock := lockUtterance(j.session, j.basename)
+	err = store.ImportAudio(j.session, j.basename, format, tmpFile)
+	unlock()
+	if err != nil {
+		os.Remove(tmpFile)
+		return fmt.Errorf("failed to save %s/%s.%s : %v", j.session, j.basename, format, err)
+	}
+	return nil
+}
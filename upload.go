@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Upload of audio files as multipart/form-data or as raw request body, streamed to disk.
+// Unlike saveAudio, the audio is never held in memory.
+
+// max size of an audio file, in bytes. Set by the -max-upload-size flag.
+var maxUploadSize int64 = 100 * 1024 * 1024
+
+// max size of the metadata (form fields) of an upload
+const maxMetadataSize = 64 * 1024
+
+type uploadResponse struct {
+	Message     string     `json:"message"`
+	Size        int64      `json:"size"`
+	AudioSHA256 string     `json:"audio_sha256"`
+	AudioInfo   *AudioInfo `json:"audio_info,omitempty"`
+}
+
+// isBodyTooLarge returns true for errors from reading a request body limited by http.MaxBytesReader
+func isBodyTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "request body too large")
+}
+
+// errTooLarge is returned by streamToFile if the input is larger than maxUploadSize
+var errTooLarge = fmt.Errorf("audio file too large")
+
+// streamToFile writes the input to a temporary file in the base dir, and returns the file name, size and sha256 checksum.
+// The file is created before the upload metadata is read (a multipart form may send the audio first), so it is kept
+// outside of the store until saveUpload imports it.
+func streamToFile(in io.Reader) (string, int64, string, error) {
+	fh, err := ioutil.TempFile(baseDir, "upload*~")
+	if err != nil {
+		return "", 0, "", fmt.Errorf("failed to create temp file : %v", err)
+	}
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(fh, hash), io.LimitReader(in, maxUploadSize+1))
+	closeErr := fh.Close()
+	if err == nil && n > maxUploadSize {
+		err = errTooLarge
+	}
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(fh.Name())
+		return "", n, "", err
+	}
+	return fh.Name(), n, fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// fileSHA256 returns the sha256 checksum of a file
+func fileSHA256(fName string) (string, error) {
+	fh, err := os.Open(fName)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, fh)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// uploadMetadata reads the fields of an AudioObject (except data) from request values. If file_extension is not given,
+// the extension is taken from the MIME type of the audio.
+func uploadMetadata(values map[string]string, audioMimeType string) (AudioObject, error) {
+	var ao AudioObject
+	var err error
+	ao.SessionID = values["session_id"]
+	ao.FileName = values["file_name"]
+	ao.StartTime = values["start_time"]
+	ao.EndTime = values["end_time"]
+	ao.Language = values["language"]
+	ao.OverWrite = values["over_write"] == "true"
+	for _, f := range []struct {
+		name string
+		v    *int64
+	}{{"time_code_start", &ao.TimeCodeStart}, {"time_code_end", &ao.TimeCodeEnd}} {
+		if values[f.name] != "" {
+			*f.v, err = strconv.ParseInt(values[f.name], 10, 64)
+			if err != nil {
+				return ao, fmt.Errorf("invalid %s: '%s'", f.name, values[f.name])
+			}
+		}
+	}
+	ao.FileExtension = values["file_extension"]
+	if ao.FileExtension == "" && audioMimeType != "" {
+		mt, _, err := mime.ParseMediaType(audioMimeType)
+		if err == nil && strings.HasPrefix(mt, "audio/") {
+			ao.FileExtension = mt
+		}
+	}
+
+	vali := append(ao.cleanNames(), ao.cleanFileExtension()...)
+	if len(vali) > 0 {
+		return ao, fmt.Errorf("%s", strings.Join(vali, " : "))
+	}
+	return ao, nil
+}
+
+// uploadAudio saves an audio file, sent either as multipart/form-data, with the audio in the file field 'audio' and the
+// metadata as form fields, or as raw request body, with the metadata as URL parameters. The metadata fields are the same as
+// for saveAudio (except data). The file extension is taken from the Content-Type of the audio if file_extension is not given.
+func uploadAudio(w http.ResponseWriter, r *http.Request) {
+	fail := func(status int, msg string) {
+		log.Println("[chromedictator] uploadAudio: " + msg)
+		http.Error(w, msg, status)
+	}
+
+	values := make(map[string]string)
+	var tmpFile, checksum, audioType string
+	var size int64
+	var err error
+	defer func() {
+		if tmpFile != "" {
+			os.Remove(tmpFile)
+		}
+	}()
+
+	if mr, mErr := r.MultipartReader(); mErr == nil {
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+maxMetadataSize)
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				fail(http.StatusBadRequest, fmt.Sprintf("failed to read multipart body : %v", err))
+				return
+			}
+			if part.FormName() == "audio" {
+				if tmpFile != "" {
+					fail(http.StatusBadRequest, "more than one audio file")
+					return
+				}
+				audioType = part.Header.Get("Content-Type")
+				tmpFile, size, checksum, err = streamToFile(part)
+				if err == errTooLarge || isBodyTooLarge(err) {
+					fail(http.StatusRequestEntityTooLarge, fmt.Sprintf("audio file too large (max %d bytes)", maxUploadSize))
+					return
+				}
+				if err != nil {
+					fail(http.StatusBadRequest, fmt.Sprintf("failed to read audio : %v", err))
+					return
+				}
+				continue
+			}
+			v, err := ioutil.ReadAll(io.LimitReader(part, maxMetadataSize))
+			if err != nil {
+				fail(http.StatusBadRequest, fmt.Sprintf("failed to read form field %s : %v", part.FormName(), err))
+				return
+			}
+			values[part.FormName()] = string(v)
+		}
+		if tmpFile == "" {
+			fail(http.StatusBadRequest, "missing audio file (form field 'audio')")
+			return
+		}
+	} else {
+		for k := range r.URL.Query() {
+			values[k] = r.URL.Query().Get(k)
+		}
+		audioType = r.Header.Get("Content-Type")
+		if r.ContentLength > maxUploadSize {
+			fail(http.StatusRequestEntityTooLarge, fmt.Sprintf("audio file too large (max %d bytes)", maxUploadSize))
+			return
+		}
+		tmpFile, size, checksum, err = streamToFile(r.Body)
+		if err == errTooLarge {
+			fail(http.StatusRequestEntityTooLarge, fmt.Sprintf("audio file too large (max %d bytes)", maxUploadSize))
+			return
+		}
+		if err != nil {
+			fail(http.StatusBadRequest, fmt.Sprintf("failed to read audio : %v", err))
+			return
+		}
+		if size == 0 {
+			fail(http.StatusBadRequest, "missing audio (empty request body)")
+			return
+		}
+	}
+
+	ao, err := uploadMetadata(values, audioType)
+	if err != nil {
+		fail(http.StatusBadRequest, "Incomplete upload metadata: "+err.Error())
+		return
+	}
+
+	resp, status, err := saveUpload(ao, tmpFile, size, checksum)
+	if err != nil {
+		fail(status, err.Error())
+		return
+	}
+	tmpFile = ""
+	respJSON, err := json.Marshal(resp)
+	if err != nil {
+		fail(http.StatusInternalServerError, fmt.Sprintf("failed to marshal response struct to JSON : %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s\n", string(respJSON))
+}
+
+// checkOverwrite returns an error if the audio file or the .json file of the upload already exists, unless over_write is set
+func checkOverwrite(ao AudioObject) error {
+	if !ao.OverWrite && (store.Exists(ao.SessionID, ao.FileName+"."+ao.FileExtension) || store.Exists(ao.SessionID, ao.FileName+".json")) {
+		return fmt.Errorf("file with the same session ID and file name already exists: %s/%s.%s\nTo overwrite set over_write=true", ao.SessionID, ao.FileName, ao.FileExtension)
+	}
+	return nil
+}
+
+// saveUpload checks an uploaded audio file, saves its .json file, and moves it from tmpFile into the store.
+// If the audio file already exists, the upload is rejected, unless it has over_write set, in which case a backup of the
+// earlier audio file is saved.
+// On error, an HTTP status code is returned along with the error.
+func saveUpload(ao AudioObject, tmpFile string, size int64, checksum string) (uploadResponse, int, error) {
+	var res uploadResponse
+	fh, err := os.Open(tmpFile)
+	if err != nil {
+		return res, http.StatusInternalServerError, fmt.Errorf("failed to open uploaded file : %v", err)
+	}
+	audioInfo, err := inspectAudio(ao.FileExtension, fh, ao.TimeCodeStart, ao.TimeCodeEnd)
+	fh.Close()
+	if err != nil {
+		return res, http.StatusBadRequest, fmt.Errorf("server rejected audio data : %v", err)
+	}
+
+	respMessages := []string{}
+	if audioInfo != nil && audioInfo.DurationMismatch {
+		respMessages = append(respMessages, fmt.Sprintf("audio length %d ms doesn't match time codes %d-%d", audioInfo.Duration, ao.TimeCodeStart, ao.TimeCodeEnd))
+	}
+
+	unlock := lockUtterance(ao.SessionID, ao.FileName)
+	defer unlock()
+
+	msg, err := checkAudioDirs(ao.SessionID)
+	if err != nil {
+		return res, http.StatusBadRequest, err
+	}
+	if msg != "" {
+		respMessages = append(respMessages, msg)
+	}
+
+	jsonObj := JSONObject{
+		SessionObject: ao.SessionObject,
+		StartTime:     ao.StartTime,
+		EndTime:       ao.EndTime,
+		TimeCodeStart: ao.TimeCodeStart,
+		TimeCodeEnd:   ao.TimeCodeEnd,
+		Language:      ao.Language,
+		AudioInfo:     audioInfo,
+		AudioSHA256:   checksum,
+		FileExtension: ao.FileExtension,
+	}
+	audioFileName := ao.FileName + "." + ao.FileExtension
+	audioFile := path.Join(ao.SessionID, audioFileName)
+	audioExists := store.Exists(ao.SessionID, audioFileName)
+	if err := checkOverwrite(ao); err != nil {
+		return res, http.StatusBadRequest, err
+	}
+
+	jsonResps, err := writeJSON(ao.SessionID, ao.FileName, jsonObj, ao.OverWrite)
+	if err != nil {
+		return res, http.StatusInternalServerError, fmt.Errorf("failed to save json file '%s/%s.json' : %v", ao.SessionID, ao.FileName, err)
+	}
+	respMessages = append(respMessages, jsonResps...)
+
+	if audioExists {
+		newName, err := backupFile(ao.SessionID, ao.FileName, ao.FileExtension)
+		if err != nil {
+			return res, http.StatusInternalServerError, fmt.Errorf("couldn't save backup of '%s' : %v", audioFile, err)
+		}
+		respMessages = append(respMessages, fmt.Sprintf("overwriting existing file '%s/%s.%s' (saved backup file %s)", ao.SessionID, ao.FileName, ao.FileExtension, newName))
+	}
+	err = store.ImportAudio(ao.SessionID, ao.FileName, ao.FileExtension, tmpFile)
+	if err != nil {
+		return res, http.StatusInternalServerError, fmt.Errorf("failed to save audio file '%s' : %v", audioFile, err)
+	}
+	fmt.Printf("Server saved %s\n", audioFile)
+	respMessages = append(respMessages, fmt.Sprintf("server saved audio file '%s'", audioFile))
+
+	if audioTranscoder != nil {
+		audioTranscoder.removeTranscoded(ao.SessionID, ao.FileName, ao.FileExtension)
+		audioTranscoder.submit(ao.SessionID, ao.FileName, ao.FileExtension)
+		respMessages = append(respMessages, fmt.Sprintf("converting audio file to %s", strings.Join(audioTranscoder.formats, ", ")))
+	}
+
+	res = uploadResponse{
+		Message:     strings.Join(respMessages, " : "),
+		Size:        size,
+		AudioSHA256: checksum,
+		AudioInfo:   audioInfo,
+	}
+	return res, http.StatusOK, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// existingUtterance creates the .json file of the utterance s/a
+func existingUtterance(t *testing.T) {
+	if _, err := store.CreateSession("s"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveMetadata("s", "a", JSONObject{SessionObject: SessionObject{SessionID: "s"}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// live audio of an existing file is rejected before the connection is upgraded, unless over_write is set
+func TestLiveAudioOfExistingFile(t *testing.T) {
+	dir, cleanup := testStore(t)
+	defer cleanup()
+	router := testRouter()
+	router.HandleFunc("/live_audio", liveAudio).Methods("GET")
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	existingUtterance(t)
+	params := "session_id=s&file_name=a&file_extension=webm&start_time=x&end_time=y"
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/live_audio?"
+	conn, resp, err := websocket.DefaultDialer.Dial(wsURL+params, nil)
+	if err == nil {
+		conn.Close()
+		t.Fatalf("live audio: expected the connection to be refused for existing file")
+	}
+	if resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("live audio: expected status %d for existing file, got %v", http.StatusBadRequest, resp)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "already exists") {
+		t.Errorf("live audio: unexpected response: %s", body)
+	}
+	files, err := filepath.Glob(filepath.Join(baseDir, "s", "*live*"))
+	if err != nil || len(files) > 0 {
+		t.Errorf("live audio: expected no temporary file, found %v", files)
+	}
+
+	conn, _, err = websocket.DefaultDialer.Dial(wsURL+params+"&over_write=true", nil)
+	if err != nil {
+		t.Fatalf("live audio with over_write: %v", err)
+	}
+	err = conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"cancel"}`))
+	if err == nil {
+		_, _, err = conn.ReadMessage()
+	}
+	conn.Close()
+	if err != nil {
+		t.Errorf("live audio with over_write: %v", err)
+	}
+	checkNoFilesOutside(t, dir)
+}
+
+// a chunked upload of an existing file is rejected when it's created, unless over_write is set
+func TestChunkedUploadOfExistingFile(t *testing.T) {
+	_, cleanup := testStore(t)
+	defer cleanup()
+	router := testRouter()
+	router.HandleFunc("/upload_audio/chunked", createChunkedUpload).Methods("POST")
+	router.HandleFunc("/upload_audio/chunked/{id}", appendChunk).Methods("PATCH")
+	router.HandleFunc("/upload_audio/chunked/{id}/complete", completeChunkedUpload).Methods("POST")
+	params := "session_id=s&file_name=a&file_extension=wav&start_time=x&end_time=y"
+
+	// created after the upload is started, so it's rejected on completion
+	w := doRequest(router, "POST", "/upload_audio/chunked?"+params, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	id := w.Header().Get("Location")[len("/upload_audio/chunked/"):]
+	req := httptest.NewRequest("PATCH", "/upload_audio/chunked/"+id+"?offset=0", strings.NewReader("audio"))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("append chunk: expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	existingUtterance(t)
+	w = doRequest(router, "POST", "/upload_audio/chunked/"+id+"/complete", nil)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "already exists") {
+		t.Errorf("complete: expected status %d for existing file, got %d: %s", http.StatusBadRequest, w.Code, w.Body.String())
+	}
+	// the upload is kept, and can be completed with over_write
+	w = doRequest(router, "POST", "/upload_audio/chunked/"+id+"/complete?over_write=true", nil)
+	if w.Code != http.StatusOK {
+		t.Errorf("complete with over_write: expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	w = doRequest(router, "POST", "/upload_audio/chunked?"+params, nil)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "already exists") {
+		t.Errorf("create: expected status %d for existing file, got %d: %s", http.StatusBadRequest, w.Code, w.Body.String())
+	}
+	w = doRequest(router, "POST", "/upload_audio/chunked?"+params+"&over_write=true", nil)
+	if w.Code != http.StatusCreated {
+		t.Errorf("create with over_write: expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+}
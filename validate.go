@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Validation of session names and file names from clients. They are used as path components in baseDir, so they
+// may only contain characters that are safe in file names, and no path separators or dot-segments.
+
+// max length of a session name or file name, in bytes
+const maxNameLength = 128
+
+// characters allowed in names, besides letters, digits and combining marks
+const nameSpecialChars = "-_. "
+
+// file extensions, after removing MIME type and parameters
+var fileExtensionRE = regexp.MustCompile("^[a-z0-9][a-z0-9-]*$")
+
+// cleanName checks a session name or file name, and returns it in Unicode normalization form C, so that a name
+// always refers to the same file, however it was composed. The name may contain letters, digits, combining marks,
+// dashes, underscores, dots and spaces, but it may not start with a dot, or start or end with a space.
+func cleanName(name string) (string, error) {
+	if name == "" {
+		return name, fmt.Errorf("empty name")
+	}
+	if !utf8.ValidString(name) {
+		return name, fmt.Errorf("invalid UTF-8")
+	}
+	res := norm.NFC.String(name)
+	if len(res) > maxNameLength {
+		return res, fmt.Errorf("longer than %d bytes", maxNameLength)
+	}
+	if strings.HasPrefix(res, ".") {
+		return res, fmt.Errorf("starts with a dot")
+	}
+	if strings.TrimSpace(res) != res {
+		return res, fmt.Errorf("starts or ends with white space")
+	}
+	for _, r := range res {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r) && !strings.ContainsRune(nameSpecialChars, r) {
+			return res, fmt.Errorf("illegal character %q", r)
+		}
+	}
+	return res, nil
+}
+
+func cleanSessionName(session string) (string, error) {
+	res, err := cleanName(session)
+	if err != nil {
+		return res, fmt.Errorf("invalid session name '%s' : %v", session, err)
+	}
+	return res, nil
+}
+
+func cleanFileName(fileName string) (string, error) {
+	res, err := cleanName(fileName)
+	if err != nil {
+		return res, fmt.Errorf("invalid file name '%s' : %v", fileName, err)
+	}
+	return res, nil
+}
+
+// cleanFileExtension returns a file extension in lower case, without the MIME type prefix audio/ and parameters
+// (as in audio/webm;codecs=opus)
+func cleanFileExtension(ext string) (string, error) {
+	res := strings.ToLower(strings.TrimSpace(ext))
+	res = strings.TrimPrefix(res, "audio/")
+	if i := strings.Index(res, ";"); i >= 0 {
+		res = strings.TrimSpace(res[:i])
+	}
+	if len(res) > maxNameLength || !fileExtensionRE.MatchString(res) {
+		return res, fmt.Errorf("invalid file extension '%s'", ext)
+	}
+	return res, nil
+}
+
+// inDir returns an error if the path is not inside dir. This should never happen for paths built from
+// cleaned names, so it's a last line of defence, checked for every file that fsStore reads or writes (see fsStore.path).
+func inDir(dir, p string) error {
+	base, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(abs, base+string(filepath.Separator)) {
+		return fmt.Errorf("path outside of %s: %s", dir, p)
+	}
+	return nil
+}
+
+// sessionFileVars returns the cleaned URL variables 'session' and 'filename'
+func sessionFileVars(r *http.Request) (string, string, error) {
+	vars := mux.Vars(r)
+	if vars["session"] == "" {
+		return "", "", fmt.Errorf("missing param 'session'")
+	}
+	if vars["filename"] == "" {
+		return "", "", fmt.Errorf("missing param 'filename'")
+	}
+	session, err := cleanSessionName(vars["session"])
+	if err != nil {
+		return "", "", err
+	}
+	fileName, err := cleanFileName(vars["filename"])
+	if err != nil {
+		return "", "", err
+	}
+	return session, fileName, nil
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// testStore sets store to an fsStore in a new temporary folder (the audio_files folder in dir, which is also set as
+// baseDir), and returns dir and a function that restores store and baseDir, and removes dir
+func testStore(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "chromedictator_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(filepath.Join(dir, "audio_files"), os.ModePerm)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	oldStore, oldBaseDir := store, baseDir
+	baseDir = filepath.Join(dir, "audio_files")
+	store = newFSStore(baseDir)
+	return dir, func() {
+		store, baseDir = oldStore, oldBaseDir
+		os.RemoveAll(dir)
+	}
+}
+
+// checkNoFilesOutside fails if there are other files in dir than the audio_files folder
+func checkNoFilesOutside(t *testing.T, dir string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if f.Name() != "audio_files" {
+			t.Errorf("file created outside of audio_files: %s", f.Name())
+		}
+	}
+}
+
+// invalidNames are session names and file names that should be rejected
+var invalidNames = map[string]string{
+	"empty":             "",
+	"dot":               ".",
+	"dot dot":           "..",
+	"parent dirs":       "../../etc",
+	"history folder":    ".history",
+	"leading dot":       ".a",
+	"slash":             "a/b",
+	"backslash":         `a\b`,
+	"NUL":               "a\x00b",
+	"newline":           "a\nb",
+	"tab":               "a\tb",
+	"DEL":               "a\x7fb",
+	"invalid UTF-8":     "a\xffb",
+	"truncated UTF-8":   "a\xc3",
+	"too long":          strings.Repeat("a", maxNameLength+1),
+	"too long in UTF-8": strings.Repeat("\u00e5", maxNameLength/2+1),
+	"leading space":     " a",
+	"trailing space":    "a ",
+	"only space":        " ",
+	"no-break space":    "a\u00a0",
+	"colon":             "a:b",
+	"star":              "a*",
+}
+
+func TestCleanName(t *testing.T) {
+	for name, in := range invalidNames {
+		if res, err := cleanName(in); err == nil {
+			t.Errorf("%s: expected error for %q, got %q", name, in, res)
+		}
+	}
+
+	valid := []struct {
+		in     string
+		expect string
+	}{
+		{"abc", "abc"},
+		{"a b", "a b"},
+		{"a-b_c.d", "a-b_c.d"},
+		{"a..b", "a..b"},
+		{"2018-11-16", "2018-11-16"},
+		{"åäö", "åäö"},
+		{"日本語", "日本語"},
+		{strings.Repeat("a", maxNameLength), strings.Repeat("a", maxNameLength)},
+		// NFD (a + combining ring above) is converted to NFC
+		{"a\u030a", "\u00e5"},
+		{"\u00e5", "\u00e5"},
+		{"Ange\u0301lica", "Ang\u00e9lica"},
+	}
+	for _, test := range valid {
+		res, err := cleanName(test.in)
+		if err != nil {
+			t.Errorf("cleanName(%q): %v", test.in, err)
+			continue
+		}
+		if res != test.expect {
+			t.Errorf("cleanName(%q): expected %q, got %q", test.in, test.expect, res)
+		}
+	}
+
+	// NFD takes more bytes than NFC, and the length is checked after normalisation
+	nfd := strings.Repeat("a\u030a", maxNameLength/2)
+	if len(nfd) <= maxNameLength {
+		t.Fatalf("expected NFD name longer than %d bytes", maxNameLength)
+	}
+	if _, err := cleanName(nfd); err != nil {
+		t.Errorf("cleanName(%q): %v", nfd, err)
+	}
+}
+
+func TestCleanFileExtension(t *testing.T) {
+	valid := map[string]string{
+		"webm":                            "webm",
+		"WAV":                             "wav",
+		"audio/webm":                      "webm",
+		"audio/webm;codecs=opus":          "webm",
+		" audio/x-matroska ; codecs=opus": "x-matroska",
+		"mp3":                             "mp3",
+	}
+	for in, expect := range valid {
+		res, err := cleanFileExtension(in)
+		if err != nil {
+			t.Errorf("cleanFileExtension(%q): %v", in, err)
+			continue
+		}
+		if res != expect {
+			t.Errorf("cleanFileExtension(%q): expected %q, got %q", in, expect, res)
+		}
+	}
+	for _, in := range []string{"", ".", "..", ".webm", "-webm", "we bm", "a/b", "../webm", `a\b`, "webm\x00", "wébm", strings.Repeat("a", maxNameLength+1)} {
+		if res, err := cleanFileExtension(in); err == nil {
+			t.Errorf("cleanFileExtension(%q): expected error, got %q", in, res)
+		}
+	}
+}
+
+func TestInDir(t *testing.T) {
+	dir := filepath.Join("tmp", "audio_files")
+	for _, p := range []string{
+		filepath.Join(dir, "s"),
+		filepath.Join(dir, "s", "a.edi"),
+		filepath.Join(dir, "s", historyDir, "a.1.edi"),
+		filepath.Join(dir, "s", "..", "t"),
+	} {
+		if err := inDir(dir, p); err != nil {
+			t.Errorf("inDir(%q, %q): %v", dir, p, err)
+		}
+	}
+	for _, p := range []string{
+		dir,
+		filepath.Join(dir, ".."),
+		filepath.Join(dir, "..", "x"),
+		filepath.Join(dir, "s", "..", "..", "x"),
+		dir + "2",
+		filepath.Join(dir+"2", "s"),
+		"/etc/passwd",
+	} {
+		if err := inDir(dir, p); err == nil {
+			t.Errorf("inDir(%q, %q): expected error", dir, p)
+		}
+	}
+}
+
+func TestFSStorePaths(t *testing.T) {
+	dir, cleanup := testStore(t)
+	defer cleanup()
+
+	for _, session := range []string{"", ".", "..", "../x", "../../etc"} {
+		if store.SessionExists(session) {
+			t.Errorf("SessionExists(%q): expected false", session)
+		}
+		if _, err := store.CreateSession(session); err == nil {
+			t.Errorf("CreateSession(%q): expected error", session)
+		}
+		if err := store.SaveText(session, "a", "edi", "text"); err == nil {
+			t.Errorf("SaveText(%q, ...): expected error", session)
+		}
+		if _, err := store.SaveBackup(session, "a.edi", strings.NewReader("text")); err == nil {
+			t.Errorf("SaveBackup(%q, ...): expected error", session)
+		}
+		if _, err := store.TempFile(session, "a*~"); err == nil {
+			t.Errorf("TempFile(%q, ...): expected error", session)
+		}
+	}
+	if _, err := store.CreateSession("s"); err != nil {
+		t.Fatal(err)
+	}
+	for _, basename := range []string{"../a", "../../a", "../s/../../a"} {
+		if err := store.SaveText("s", basename, "edi", "text"); err == nil {
+			t.Errorf("SaveText(\"s\", %q, ...): expected error", basename)
+		}
+		if _, err := store.Text("s", basename, "edi"); err == nil || os.IsNotExist(err) {
+			t.Errorf("Text(\"s\", %q, ...): expected path error, got %v", basename, err)
+		}
+		if _, err := store.SaveRevision("s", basename, revision{}, "text"); err == nil {
+			t.Errorf("SaveRevision(\"s\", %q, ...): expected error", basename)
+		}
+	}
+	if _, err := store.TempFile("s", "../a*~"); err == nil {
+		t.Errorf("TempFile with path in pattern: expected error")
+	}
+	checkNoFilesOutside(t, dir)
+}
+
+// testRouter returns a router with the handlers that take session and file names from clients
+func testRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/get_audio/{session}/{filename}", getAudio).Methods("GET")
+	r.HandleFunc("/get_edited_text/{session}/{filename}", getEditedText).Methods("GET")
+	r.HandleFunc("/get_recogniser_text/{session}/{filename}", getRecogniserText).Methods("GET")
+	r.HandleFunc("/save_audio", saveAudio).Methods("POST")
+	r.HandleFunc("/save_recogniser_text", saveRecogniserText).Methods("POST")
+	r.HandleFunc("/save_edited_text", saveEditedText).Methods("POST")
+	r.HandleFunc("/recognise/{session}/{filename}", recognise).Methods("GET")
+	return r
+}
+
+func doRequest(router http.Handler, method, target string, body interface{}) *httptest.ResponseRecorder {
+	var reqBody bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&reqBody).Encode(body)
+	}
+	req := httptest.NewRequest(method, "/", &reqBody)
+	// the target is set after parsing, since httptest.NewRequest doesn't accept all escaped paths
+	u, err := url.Parse(target)
+	if err != nil {
+		req.URL.Path = target
+	} else {
+		req.URL = u
+	}
+	req.RequestURI = target
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestHandlersRejectInvalidNames(t *testing.T) {
+	dir, cleanup := testStore(t)
+	defer cleanup()
+	router := testRouter()
+
+	for name, invalid := range invalidNames {
+		if invalid == "" {
+			continue
+		}
+		// a URL path with a slash or dot-segment is not routed to the handler (404, or a redirect to the cleaned path)
+		routed := !strings.Contains(invalid, "/") && invalid != "." && invalid != ".."
+		for _, names := range [][2]string{{invalid, "a"}, {"s", invalid}} {
+			session, fileName := names[0], names[1]
+			p := url.PathEscape(session) + "/" + url.PathEscape(fileName)
+			for _, target := range []string{"/get_audio/" + p, "/get_edited_text/" + p, "/get_recogniser_text/" + p, "/recognise/" + p} {
+				w := doRequest(router, "GET", target, nil)
+				if routed && w.Code != http.StatusBadRequest {
+					t.Errorf("%s: GET %s: expected status %d, got %d", name, target, http.StatusBadRequest, w.Code)
+				}
+				if !routed && w.Code == http.StatusOK {
+					t.Errorf("%s: GET %s: expected error status, got %d", name, target, w.Code)
+				}
+			}
+
+			text := TextObject{JSONObject: JSONObject{SessionObject: SessionObject{SessionID: session}}, FileName: fileName, Data: "text"}
+			for _, target := range []string{"/save_edited_text", "/save_recogniser_text"} {
+				w := doRequest(router, "POST", target, text)
+				if w.Code != http.StatusBadRequest {
+					t.Errorf("%s: POST %s with %q/%q: expected status %d, got %d", name, target, session, fileName, http.StatusBadRequest, w.Code)
+				}
+			}
+			audio := AudioObject{TextObject: text, FileExtension: "webm"}
+			audio.StartTime = "2018-11-16T15:38:00.606Z"
+			audio.EndTime = "2018-11-16T15:38:02.606Z"
+			w := doRequest(router, "POST", "/save_audio", audio)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s: POST /save_audio with %q/%q: expected status %d, got %d", name, session, fileName, http.StatusBadRequest, w.Code)
+			}
+		}
+	}
+
+	sessions, err := store.Sessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) > 0 {
+		t.Errorf("expected no sessions, found %v", sessions)
+	}
+	checkNoFilesOutside(t, dir)
+}
+
+func TestHandlersNormaliseNames(t *testing.T) {
+	_, cleanup := testStore(t)
+	defer cleanup()
+	router := testRouter()
+
+	// saved with NFD names, read with NFC names
+	nfdSession, nfdFile := "Ma\u030arten", "Ange\u0301lica"
+	nfcSession, nfcFile := "M\u00e5rten", "Ang\u00e9lica"
+	text := TextObject{JSONObject: JSONObject{SessionObject: SessionObject{SessionID: nfdSession}}, FileName: nfdFile, Data: "hello"}
+	w := doRequest(router, "POST", "/save_edited_text", text)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /save_edited_text: expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if !store.Exists(nfcSession, nfcFile+".edi") {
+		t.Errorf("expected the file to be saved with NFC names")
+	}
+
+	for _, p := range []string{url.PathEscape(nfcSession) + "/" + url.PathEscape(nfcFile), url.PathEscape(nfdSession) + "/" + url.PathEscape(nfdFile)} {
+		w = doRequest(router, "GET", "/get_edited_text/"+p, nil)
+		if w.Code != http.StatusOK {
+			t.Errorf("GET %s: expected status %d, got %d", p, http.StatusOK, w.Code)
+			continue
+		}
+		var res textResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if res.Text != "hello" {
+			t.Errorf("GET %s: expected text %q, got %q (%s)", p, "hello", res.Text, res.Message)
+		}
+	}
+
+	sessions, err := store.Sessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0] != nfcSession {
+		t.Errorf("expected session %q, found %q", nfcSession, sessions)
+	}
+}
@@ -0,0 +1,401 @@
+// Package webm reads the audio properties of WebM (Matroska) files: codec, sample rate, number of channels and duration.
+// Only the parts of the EBML structure needed for this are parsed, and everything else is skipped.
+package webm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"time"
+)
+
+// Info holds the properties of the first audio track of a WebM file
+type Info struct {
+	DocType    string // webm or matroska
+	Codec      string // Matroska codec id, e.g. A_OPUS
+	SampleRate float64
+	Channels   int
+	Duration   time.Duration
+
+	// For truncated files, the size in bytes of the file up to the incomplete element, or 0 if
+	// that part has no audio data. The other fields are then computed from this part of the file.
+	ValidSize int64
+}
+
+// ErrTruncated is returned for files that end in the middle of an element. Inspect then returns the
+// properties of the complete part of the file (if it has audio data) along with the error.
+var ErrTruncated = errors.New("file is truncated")
+
+// Element ids
+const (
+	idEBML            = 0x1A45DFA3
+	idDocType         = 0x4282
+	idSegment         = 0x18538067
+	idInfo            = 0x1549A966
+	idTimecodeScale   = 0x2AD7B1
+	idDuration        = 0x4489
+	idTracks          = 0x1654AE6B
+	idTrackEntry      = 0xAE
+	idTrackNumber     = 0xD7
+	idTrackType       = 0x83
+	idCodecID         = 0x86
+	idDefaultDuration = 0x23E383
+	idAudio           = 0xE1
+	idSamplingFreq    = 0xB5
+	idChannels        = 0x9F
+	idCluster         = 0x1F43B675
+	idTimecode        = 0xE7
+	idSimpleBlock     = 0xA3
+	idBlockGroup      = 0xA0
+	idBlock           = 0xA1
+	idBlockDuration   = 0x9B
+)
+
+// Master elements that are parsed (other elements are skipped). Segment and Cluster may have unknown size,
+// so children are read in sequence, without checking which master element they belong to.
+var masterElements = map[uint64]bool{
+	idEBML:       true,
+	idSegment:    true,
+	idInfo:       true,
+	idTracks:     true,
+	idTrackEntry: true,
+	idAudio:      true,
+	idCluster:    true,
+	idBlockGroup: true,
+}
+
+const trackTypeAudio = 2
+
+const unknownSize = math.MaxUint64
+
+type track struct {
+	number          uint64
+	trackType       uint64
+	codec           string
+	sampleRate      float64
+	channels        int
+	defaultDuration uint64 // ns
+}
+
+type reader struct {
+	r      *bufio.Reader
+	offset int64
+}
+
+func (r *reader) readByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.offset++
+	}
+	return b, err
+}
+
+// readVint reads a variable size integer. If keepMarker is set, the length marker bit is kept (as in element ids).
+func (r *reader) readVint(keepMarker bool) (uint64, int, error) {
+	first, err := r.readByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	length := 1
+	mask := byte(0x80)
+	for length <= 8 && first&mask == 0 {
+		length++
+		mask >>= 1
+	}
+	if length > 8 {
+		return 0, 0, fmt.Errorf("invalid variable size integer at offset %d", r.offset-1)
+	}
+	v := uint64(first)
+	if !keepMarker {
+		v = uint64(first & (mask - 1))
+	}
+	allOnes := first&(mask-1) == mask-1
+	for i := 1; i < length; i++ {
+		b, err := r.readByte()
+		if err != nil {
+			return 0, 0, ErrTruncated
+		}
+		allOnes = allOnes && b == 0xFF
+		v = v<<8 | uint64(b)
+	}
+	if !keepMarker && allOnes {
+		return unknownSize, length, nil
+	}
+	return v, length, nil
+}
+
+func (r *reader) readBytes(size uint64) ([]byte, error) {
+	if size > 16*1024*1024 {
+		return nil, fmt.Errorf("element too large at offset %d: %d bytes", r.offset, size)
+	}
+	buf := make([]byte, size)
+	n, err := io.ReadFull(r.r, buf)
+	r.offset += int64(n)
+	if err != nil {
+		return nil, ErrTruncated
+	}
+	return buf, nil
+}
+
+func (r *reader) skip(size uint64) error {
+	n, err := io.CopyN(ioutil.Discard, r.r, int64(size))
+	r.offset += n
+	if err != nil {
+		return ErrTruncated
+	}
+	return nil
+}
+
+func readUint(b []byte) uint64 {
+	var v uint64
+	for _, x := range b {
+		v = v<<8 | uint64(x)
+	}
+	return v
+}
+
+func readFloat(b []byte) (float64, error) {
+	switch len(b) {
+	case 0:
+		return 0, nil
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	}
+	return 0, fmt.Errorf("invalid float size: %d", len(b))
+}
+
+// IsEBML returns true if the data starts with an EBML header, as WebM files do
+func IsEBML(data []byte) bool {
+	return bytes.HasPrefix(data, []byte{0x1A, 0x45, 0xDF, 0xA3})
+}
+
+// Inspect reads a WebM file, and returns the properties of its first audio track. An error is
+// returned if the file is not a WebM or Matroska file, if it is corrupt or truncated, or if it has no audio.
+func Inspect(in io.Reader) (Info, error) {
+	var res Info
+	r := &reader{r: bufio.NewReader(in)}
+
+	var timecodeScale uint64 = 1000000 // ns
+	var infoDuration float64
+	tracks := []*track{}
+	var cur *track
+	var clusterTimecode int64
+	var audioTrack *track
+
+	// block timestamps of the audio track, in timecode scale units
+	var blocks int
+	var firstBlock, lastBlock, prevBlock int64
+	var lastBlockDuration uint64
+
+	// end offsets of the master elements being read (except those of unknown size)
+	masterEnds := []int64{}
+
+	// audioInfo returns the properties of the audio track, from the elements read so far
+	audioInfo := func(truncated bool) (Info, error) {
+		if audioTrack == nil {
+			audioTrack = findAudioTrack(tracks)
+			if audioTrack == nil {
+				return res, fmt.Errorf("no audio track")
+			}
+		}
+		if blocks == 0 {
+			return res, fmt.Errorf("no audio data")
+		}
+		res.Codec = audioTrack.codec
+		res.SampleRate = audioTrack.sampleRate
+		if res.SampleRate == 0 {
+			res.SampleRate = 8000 // Matroska default
+		}
+		res.Channels = audioTrack.channels
+		if res.Channels == 0 {
+			res.Channels = 1 // Matroska default
+		}
+
+		if infoDuration > 0 && !truncated {
+			res.Duration = time.Duration(infoDuration * float64(timecodeScale))
+			return res, nil
+		}
+		// no duration in the header (as in files recorded by Chrome), or a truncated file, so it's computed
+		// from the block timestamps, plus the duration of the last block
+		end := time.Duration(uint64(lastBlock-firstBlock) * timecodeScale)
+		switch {
+		case lastBlockDuration > 0:
+			end += time.Duration(lastBlockDuration * timecodeScale)
+		case audioTrack.defaultDuration > 0:
+			end += time.Duration(audioTrack.defaultDuration)
+		case blocks > 1:
+			end += time.Duration(uint64(lastBlock-prevBlock) * timecodeScale)
+		}
+		res.Duration = end
+		return res, nil
+	}
+	// truncated returns the properties of the file up to offset, where an incomplete element starts
+	truncated := func(offset int64) (Info, error) {
+		if _, err := audioInfo(true); err == nil {
+			res.ValidSize = offset
+		}
+		return res, ErrTruncated
+	}
+	fail := func(err error, offset int64) (Info, error) {
+		if err == ErrTruncated || err == io.EOF {
+			return truncated(offset)
+		}
+		return res, err
+	}
+
+	first := true
+	for {
+		startOffset := r.offset
+		for len(masterEnds) > 0 && masterEnds[len(masterEnds)-1] <= startOffset {
+			masterEnds = masterEnds[:len(masterEnds)-1]
+		}
+		id, _, err := r.readVint(true)
+		if err == io.EOF {
+			if len(masterEnds) > 0 {
+				return truncated(startOffset)
+			}
+			break
+		}
+		if err != nil {
+			return fail(err, startOffset)
+		}
+		size, _, err := r.readVint(false)
+		if err == io.EOF {
+			return truncated(startOffset)
+		}
+		if err != nil {
+			return fail(err, startOffset)
+		}
+		if first {
+			if id != idEBML {
+				return res, fmt.Errorf("not a WebM file: no EBML header")
+			}
+			first = false
+		}
+
+		if masterElements[id] {
+			if size != unknownSize {
+				masterEnds = append(masterEnds, r.offset+int64(size))
+			}
+			if id == idTrackEntry {
+				cur = &track{}
+				tracks = append(tracks, cur)
+			}
+			if id == idCluster && audioTrack == nil {
+				audioTrack = findAudioTrack(tracks)
+				if audioTrack == nil {
+					return res, fmt.Errorf("no audio track")
+				}
+			}
+			continue
+		}
+		if size == unknownSize {
+			return res, fmt.Errorf("unknown size for element 0x%X at offset %d", id, startOffset)
+		}
+
+		switch id {
+		case idDocType, idTimecodeScale, idDuration, idTrackNumber, idTrackType, idCodecID, idDefaultDuration, idSamplingFreq, idChannels, idTimecode, idBlockDuration:
+			b, err := r.readBytes(size)
+			if err != nil {
+				return fail(err, startOffset)
+			}
+			switch id {
+			case idDocType:
+				res.DocType = string(bytes.TrimRight(b, "\x00"))
+				if res.DocType != "webm" && res.DocType != "matroska" {
+					return res, fmt.Errorf("not a WebM file: doc type '%s'", res.DocType)
+				}
+			case idTimecodeScale:
+				timecodeScale = readUint(b)
+			case idDuration:
+				infoDuration, err = readFloat(b)
+				if err != nil {
+					return fail(err, startOffset)
+				}
+			case idTimecode:
+				clusterTimecode = int64(readUint(b))
+			case idBlockDuration:
+				lastBlockDuration = readUint(b)
+			default:
+				if cur == nil {
+					return res, fmt.Errorf("track element 0x%X outside of track entry at offset %d", id, startOffset)
+				}
+				switch id {
+				case idTrackNumber:
+					cur.number = readUint(b)
+				case idTrackType:
+					cur.trackType = readUint(b)
+				case idCodecID:
+					cur.codec = string(bytes.TrimRight(b, "\x00"))
+				case idDefaultDuration:
+					cur.defaultDuration = readUint(b)
+				case idSamplingFreq:
+					cur.sampleRate, err = readFloat(b)
+					if err != nil {
+						return fail(err, startOffset)
+					}
+				case idChannels:
+					cur.channels = int(readUint(b))
+				}
+			}
+		case idSimpleBlock, idBlock:
+			if audioTrack == nil {
+				return res, fmt.Errorf("block before tracks at offset %d", startOffset)
+			}
+			trackNumber, n, err := r.readVint(false)
+			if err != nil {
+				return fail(err, startOffset)
+			}
+			if size < uint64(n)+3 {
+				return res, fmt.Errorf("invalid block at offset %d", startOffset)
+			}
+			hdr, err := r.readBytes(3)
+			if err != nil {
+				return fail(err, startOffset)
+			}
+			err = r.skip(size - uint64(n) - 3)
+			if err != nil {
+				return fail(err, startOffset)
+			}
+			if trackNumber != audioTrack.number {
+				continue
+			}
+			t := clusterTimecode + int64(int16(binary.BigEndian.Uint16(hdr[0:2])))
+			if blocks == 0 || t < firstBlock {
+				firstBlock = t
+			}
+			if blocks == 0 || t >= lastBlock {
+				prevBlock = lastBlock
+				lastBlock = t
+				lastBlockDuration = 0
+			}
+			blocks++
+		default:
+			err := r.skip(size)
+			if err != nil {
+				return fail(err, startOffset)
+			}
+		}
+	}
+
+	if first {
+		return res, fmt.Errorf("empty file")
+	}
+	return audioInfo(false)
+}
+
+func findAudioTrack(tracks []*track) *track {
+	for _, t := range tracks {
+		if t.trackType == trackTypeAudio {
+			return t
+		}
+	}
+	return nil
+}
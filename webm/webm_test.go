@@ -0,0 +1,288 @@
+package webm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// el returns an EBML element with the id (including the length marker, as in the id constants) and the children as data
+func el(id uint64, children ...[]byte) []byte {
+	data := bytes.Join(children, nil)
+	return append(append(idBytes(id), sizeBytes(uint64(len(data)))...), data...)
+}
+
+// unknownSizeEl returns an element of unknown size, as written by Chrome for Segment and Cluster
+func unknownSizeEl(id uint64, children ...[]byte) []byte {
+	res := append(idBytes(id), 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+	return append(res, bytes.Join(children, nil)...)
+}
+
+func idBytes(id uint64) []byte {
+	res := []byte{}
+	for ; id > 0; id >>= 8 {
+		res = append([]byte{byte(id)}, res...)
+	}
+	return res
+}
+
+// sizeBytes returns the size as an 8 byte variable size integer
+func sizeBytes(size uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, size)
+	b[0] = 0x01
+	return b
+}
+
+func uintEl(id uint64, v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return el(id, b)
+}
+
+func floatEl(id uint64, v float64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, math.Float64bits(v))
+	return el(id, b)
+}
+
+func stringEl(id uint64, s string) []byte {
+	return el(id, []byte(s))
+}
+
+// simpleBlock returns a SimpleBlock of the track, with the timecode relative to the cluster
+func simpleBlock(track byte, timecode int16) []byte {
+	data := []byte{0x80 | track, byte(uint16(timecode) >> 8), byte(timecode), 0x80, 1, 2, 3, 4}
+	return el(idSimpleBlock, data)
+}
+
+func ebmlHeader(docType string) []byte {
+	return el(idEBML, stringEl(idDocType, docType))
+}
+
+func audioTrackEntry(number uint64, codec string, sampleRate float64, channels uint64) []byte {
+	return el(idTrackEntry,
+		uintEl(idTrackNumber, number),
+		uintEl(idTrackType, trackTypeAudio),
+		stringEl(idCodecID, codec),
+		el(idAudio, floatEl(idSamplingFreq, sampleRate), uintEl(idChannels, channels)),
+	)
+}
+
+func cluster(timecode uint64, blocks ...[]byte) []byte {
+	return el(idCluster, append([][]byte{uintEl(idTimecode, timecode)}, blocks...)...)
+}
+
+var opusTracks = el(idTracks, audioTrackEntry(1, "A_OPUS", 48000, 2))
+
+// opusFile is a WebM file with an Opus track, a duration of 2 s in the header, and blocks at 0, 20 and 40 ms
+var opusFile = bytes.Join([][]byte{
+	ebmlHeader("webm"),
+	el(idSegment,
+		el(idInfo, uintEl(idTimecodeScale, 1000000), floatEl(idDuration, 2000)),
+		opusTracks,
+		cluster(0, simpleBlock(1, 0), simpleBlock(1, 20), simpleBlock(1, 40)),
+	),
+}, nil)
+
+// chromeBlocks are the blocks of chromeFile, which has no Duration, and Segment and Cluster of unknown size
+var chromeBlocks = [][]byte{simpleBlock(1, 0), simpleBlock(1, 20), simpleBlock(1, 40), simpleBlock(1, 60)}
+
+var chromeFile = bytes.Join([][]byte{
+	ebmlHeader("webm"),
+	unknownSizeEl(idSegment,
+		el(idInfo, uintEl(idTimecodeScale, 1000000)),
+		opusTracks,
+		unknownSizeEl(idCluster, append([][]byte{uintEl(idTimecode, 1000)}, chromeBlocks...)...),
+	),
+}, nil)
+
+// chromeLastBlock is the offset of the last block of chromeFile
+var chromeLastBlock = int64(len(chromeFile) - len(chromeBlocks[3]))
+
+func TestInspect(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		expect Info
+		err    error
+	}{
+		{
+			name:   "opus with duration",
+			data:   opusFile,
+			expect: Info{DocType: "webm", Codec: "A_OPUS", SampleRate: 48000, Channels: 2, Duration: 2 * time.Second},
+		},
+		{
+			// computed from the block timestamps: the last block at 60 ms, and 20 ms between blocks
+			name:   "no duration",
+			data:   chromeFile,
+			expect: Info{DocType: "webm", Codec: "A_OPUS", SampleRate: 48000, Channels: 2, Duration: 80 * time.Millisecond},
+		},
+		{
+			name: "default duration",
+			data: bytes.Join([][]byte{
+				ebmlHeader("webm"),
+				el(idSegment,
+					el(idTracks, el(idTrackEntry,
+						uintEl(idTrackNumber, 1),
+						uintEl(idTrackType, trackTypeAudio),
+						stringEl(idCodecID, "A_VORBIS"),
+						uintEl(idDefaultDuration, uint64(10*time.Millisecond)),
+					)),
+					cluster(0, simpleBlock(1, 0), simpleBlock(1, 30)),
+				),
+			}, nil),
+			// Matroska defaults for sample rate and channels
+			expect: Info{DocType: "webm", Codec: "A_VORBIS", SampleRate: 8000, Channels: 1, Duration: 40 * time.Millisecond},
+		},
+		{
+			name: "audio after video track",
+			data: bytes.Join([][]byte{
+				ebmlHeader("matroska"),
+				el(idSegment,
+					el(idTracks,
+						el(idTrackEntry, uintEl(idTrackNumber, 1), uintEl(idTrackType, 1), stringEl(idCodecID, "V_VP8")),
+						audioTrackEntry(2, "A_OPUS", 16000, 1),
+					),
+					// the video blocks are not counted
+					cluster(0, simpleBlock(1, 0), simpleBlock(2, 0), simpleBlock(2, 20), simpleBlock(1, 500)),
+				),
+			}, nil),
+			expect: Info{DocType: "matroska", Codec: "A_OPUS", SampleRate: 16000, Channels: 1, Duration: 40 * time.Millisecond},
+		},
+		{
+			// cut in the middle of the last block: the duration is computed from the complete blocks
+			name:   "truncated in block",
+			data:   chromeFile[:len(chromeFile)-3],
+			expect: Info{DocType: "webm", Codec: "A_OPUS", SampleRate: 48000, Channels: 2, Duration: 60 * time.Millisecond, ValidSize: chromeLastBlock},
+			err:    ErrTruncated,
+		},
+		{
+			name:   "truncated in element size",
+			data:   chromeFile[:chromeLastBlock+2],
+			expect: Info{DocType: "webm", Codec: "A_OPUS", SampleRate: 48000, Channels: 2, Duration: 60 * time.Millisecond, ValidSize: chromeLastBlock},
+			err:    ErrTruncated,
+		},
+		{
+			// the segment size tells that the file is incomplete, and the header duration is not used
+			name:   "truncated segment of known size",
+			data:   opusFile[:len(opusFile)-len(simpleBlock(1, 40))],
+			expect: Info{DocType: "webm", Codec: "A_OPUS", SampleRate: 48000, Channels: 2, Duration: 40 * time.Millisecond, ValidSize: int64(len(opusFile) - len(simpleBlock(1, 40)))},
+			err:    ErrTruncated,
+		},
+		{
+			name:   "truncated before audio data",
+			data:   opusFile[:len(opusFile)-40],
+			expect: Info{DocType: "webm"},
+			err:    ErrTruncated,
+		},
+	}
+	for _, test := range tests {
+		res, err := Inspect(bytes.NewReader(test.data))
+		if err != test.err {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.err, err)
+		}
+		if res != test.expect {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.expect, res)
+		}
+	}
+}
+
+func TestInspectErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"empty file", []byte{}, "empty file"},
+		{"not EBML", []byte("RIFF\x24\x00\x00\x00WAVEfmt "), "no EBML header"},
+		{"other doc type", ebmlHeader("mkvx"), "doc type 'mkvx'"},
+		{
+			name: "no audio track",
+			data: bytes.Join([][]byte{
+				ebmlHeader("webm"),
+				el(idSegment,
+					el(idTracks, el(idTrackEntry, uintEl(idTrackNumber, 1), uintEl(idTrackType, 1), stringEl(idCodecID, "V_VP8"))),
+					cluster(0, simpleBlock(1, 0)),
+				),
+			}, nil),
+			err: "no audio track",
+		},
+		{
+			name: "no tracks or clusters",
+			data: bytes.Join([][]byte{ebmlHeader("webm"), el(idSegment, el(idInfo, uintEl(idTimecodeScale, 1000000)))}, nil),
+			err:  "no audio track",
+		},
+		{
+			name: "no audio data",
+			data: bytes.Join([][]byte{ebmlHeader("webm"), el(idSegment, opusTracks, cluster(0))}, nil),
+			err:  "no audio data",
+		},
+		{
+			// the length marker of an element size can't be in the second byte
+			name: "corrupt element size",
+			data: bytes.Join([][]byte{ebmlHeader("webm"), el(idSegment, opusTracks, []byte{0xE7, 0x00, 0x00})}, nil),
+			err:  "invalid variable size integer",
+		},
+		{
+			name: "element too large",
+			data: bytes.Join([][]byte{ebmlHeader("webm"), el(idSegment, idBytes(idCodecID), sizeBytes(1<<40))}, nil),
+			err:  "element too large",
+		},
+		{
+			name: "unknown size of non-master element",
+			data: bytes.Join([][]byte{ebmlHeader("webm"), unknownSizeEl(idSegment, unknownSizeEl(idCodecID))}, nil),
+			err:  "unknown size",
+		},
+		{
+			name: "invalid float size",
+			data: bytes.Join([][]byte{ebmlHeader("webm"), el(idSegment, el(idInfo, el(idDuration, []byte{1, 2, 3})))}, nil),
+			err:  "invalid float size",
+		},
+		{
+			name: "block before tracks",
+			data: bytes.Join([][]byte{ebmlHeader("webm"), el(idSegment, simpleBlock(1, 0))}, nil),
+			err:  "block before tracks",
+		},
+		{
+			name: "invalid block",
+			data: bytes.Join([][]byte{ebmlHeader("webm"), el(idSegment, opusTracks, cluster(0, el(idSimpleBlock, []byte{0x81})))}, nil),
+			err:  "invalid block",
+		},
+		{
+			name: "track element outside of track entry",
+			data: bytes.Join([][]byte{ebmlHeader("webm"), el(idSegment, uintEl(idChannels, 2))}, nil),
+			err:  "outside of track entry",
+		},
+	}
+	for _, test := range tests {
+		_, err := Inspect(bytes.NewReader(test.data))
+		if err == nil || err == ErrTruncated || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error containing '%s', got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestIsEBML(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		expect bool
+	}{
+		{"webm", opusFile, true},
+		{"header only", []byte{0x1A, 0x45, 0xDF, 0xA3}, true},
+		{"short", []byte{0x1A, 0x45, 0xDF}, false},
+		{"empty", nil, false},
+		{"wav", []byte("RIFF\x24\x00\x00\x00WAVE"), false},
+		{"ogg", []byte("OggS\x00\x02"), false},
+		{"text", []byte("1A45DFA3"), false},
+	}
+	for _, test := range tests {
+		if res := IsEBML(test.data); res != test.expect {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expect, res)
+		}
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/stts-se/rec"
+)
+
+// Comparison of the recogniser text (.rec) with the edited text (.edi) of utterances, to measure how well the
+// recogniser does: a word alignment, and the word and character error rates (WER and CER), with the edited text as
+// the reference. The error rate is (substitutions + insertions + deletions) / number of words (or characters) in the
+// edited text. Unless normalise=false, the texts are compared in lower case, without punctuation.
+
+// alignedWord is a part of an alignment: a recognised word that is correct (ok) or substituted (sub), an inserted
+// word that is only in the recogniser text (ins), or a deleted word that is only in the edited text (del)
+type alignedWord struct {
+	Op  string `json:"op"`
+	Rec string `json:"rec,omitempty"`
+	Edi string `json:"edi,omitempty"`
+}
+
+// errorCounts holds the number of words (or characters) of the edited text, and the number of errors of each kind
+type errorCounts struct {
+	Ref int `json:"ref"`
+	Sub int `json:"sub"`
+	Ins int `json:"ins"`
+	Del int `json:"del"`
+}
+
+func (c errorCounts) add(o errorCounts) errorCounts {
+	return errorCounts{Ref: c.Ref + o.Ref, Sub: c.Sub + o.Sub, Ins: c.Ins + o.Ins, Del: c.Del + o.Del}
+}
+
+// errors returns the total number of errors
+func (c errorCounts) errors() int {
+	return c.Sub + c.Ins + c.Del
+}
+
+// rate returns the error rate. If the edited text is empty, it is 0 without errors, otherwise 1.
+func (c errorCounts) rate() float64 {
+	errs := c.errors()
+	if c.Ref == 0 {
+		if errs == 0 {
+			return 0
+		}
+		return 1
+	}
+	return float64(errs) / float64(c.Ref)
+}
+
+type errorRates struct {
+	WER   float64     `json:"wer"`
+	CER   float64     `json:"cer"`
+	Words errorCounts `json:"words"`
+	Chars errorCounts `json:"chars"`
+}
+
+func newErrorRates(words, chars errorCounts) errorRates {
+	return errorRates{WER: words.rate(), CER: chars.rate(), Words: words, Chars: chars}
+}
+
+// utteranceErrorRates holds the error rates of an utterance, and optionally the word alignment
+type utteranceErrorRates struct {
+	SessionID string `json:"session_id"`
+	Basename  string `json:"file_name"`
+	Language  string `json:"language,omitempty"`
+	StartTime string `json:"start_time,omitempty"`
+	errorRates
+	Alignment []alignedWord `json:"alignment,omitempty"`
+}
+
+// aggregateErrorRates holds the error rates of a number of utterances, computed from the total counts
+type aggregateErrorRates struct {
+	Utterances int `json:"utterances"`
+	errorRates
+}
+
+func (a *aggregateErrorRates) add(r errorRates) {
+	a.Utterances++
+	a.errorRates = newErrorRates(a.Words.add(r.Words), a.Chars.add(r.Chars))
+}
+
+type werReport struct {
+	Total      aggregateErrorRates             `json:"total"`
+	BySession  map[string]*aggregateErrorRates `json:"by_session"`
+	ByLanguage map[string]*aggregateErrorRates `json:"by_language"`
+	// ByDate: by the date of the start time (YYYY-MM-DD, UTC)
+	ByDate map[string]*aggregateErrorRates `json:"by_date"`
+	// Skipped: number of utterances without recogniser or edited text
+	Skipped    int                   `json:"skipped"`
+	Utterances []utteranceErrorRates `json:"utterances,omitempty"`
+}
+
+// werWords splits a text into words. If normalise is set, the words are lower cased, and punctuation at the start
+// and end of words is removed.
+func werWords(text string, normalise bool) []string {
+	if !normalise {
+		return strings.Fields(text)
+	}
+	res := []string{}
+	for _, w := range strings.Fields(strings.ToLower(text)) {
+		w = strings.TrimFunc(w, unicode.IsPunct)
+		if w != "" {
+			res = append(res, w)
+		}
+	}
+	return res
+}
+
+// editCounts returns the minimum number of substitutions, insertions and deletions that turn the edited words (or
+// characters) into the recognised ones (Levenshtein distance). Only two rows of the distance matrix are kept, so that
+// long texts can be compared; see alignWords for the alignment.
+func editCounts(recWords, ediWords []string) errorCounts {
+	// prev[j] and cur[j] are the counts for recWords[:i-1] and recWords[:i] against ediWords[:j]
+	prev := make([]errorCounts, len(ediWords)+1)
+	cur := make([]errorCounts, len(ediWords)+1)
+	for j := range prev {
+		prev[j] = errorCounts{Del: j}
+	}
+	for i := 1; i <= len(recWords); i++ {
+		cur[0] = errorCounts{Ins: i}
+		for j := 1; j <= len(ediWords); j++ {
+			// prefer matches and substitutions, as in alignWords
+			best := prev[j-1]
+			if recWords[i-1] != ediWords[j-1] {
+				best.Sub++
+			}
+			if del := cur[j-1]; del.errors()+1 < best.errors() {
+				best = del
+				best.Del++
+			}
+			if ins := prev[j]; ins.errors()+1 < best.errors() {
+				best = ins
+				best.Ins++
+			}
+			cur[j] = best
+		}
+		prev, cur = cur, prev
+	}
+	res := prev[len(ediWords)]
+	res.Ref = len(ediWords)
+	return res
+}
+
+// alignWords aligns the recognised words with the edited words, with the minimum number of substitutions,
+// insertions and deletions (Levenshtein distance). It keeps the whole distance matrix, so it's only used for the word
+// alignment of an utterance (see utteranceWER), and editCounts is used otherwise.
+func alignWords(recWords, ediWords []string) ([]alignedWord, errorCounts) {
+	// d[i][j] is the distance between recWords[:i] and ediWords[:j]
+	d := make([][]int, len(recWords)+1)
+	for i := range d {
+		d[i] = make([]int, len(ediWords)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(recWords); i++ {
+		for j := 1; j <= len(ediWords); j++ {
+			sub := d[i-1][j-1]
+			if recWords[i-1] != ediWords[j-1] {
+				sub++
+			}
+			d[i][j] = min3(sub, d[i-1][j]+1, d[i][j-1]+1)
+		}
+	}
+
+	// trace back from the end, preferring matches and substitutions
+	res := []alignedWord{}
+	counts := errorCounts{Ref: len(ediWords)}
+	i, j := len(recWords), len(ediWords)
+	for i > 0 || j > 0 {
+		switch {
+		case i > 0 && j > 0 && recWords[i-1] == ediWords[j-1] && d[i][j] == d[i-1][j-1]:
+			res = append(res, alignedWord{Op: "ok", Rec: recWords[i-1], Edi: ediWords[j-1]})
+			i--
+			j--
+		case i > 0 && j > 0 && d[i][j] == d[i-1][j-1]+1:
+			res = append(res, alignedWord{Op: "sub", Rec: recWords[i-1], Edi: ediWords[j-1]})
+			counts.Sub++
+			i--
+			j--
+		case j > 0 && d[i][j] == d[i][j-1]+1:
+			res = append(res, alignedWord{Op: "del", Edi: ediWords[j-1]})
+			counts.Del++
+			j--
+		default:
+			res = append(res, alignedWord{Op: "ins", Rec: recWords[i-1]})
+			counts.Ins++
+			i--
+		}
+	}
+	for l, r := 0, len(res)-1; l < r; l, r = l+1, r-1 {
+		res[l], res[r] = res[r], res[l]
+	}
+	return res, counts
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// splitChars splits the words, separated by single spaces, into characters
+func splitChars(words []string) []string {
+	res := []string{}
+	for _, r := range strings.Join(words, " ") {
+		res = append(res, string(r))
+	}
+	return res
+}
+
+// compareTexts computes the error rates of the recogniser text, with the edited text as reference. If align is set, the
+// word alignment is returned as well.
+func compareTexts(recText, ediText string, normalise, align bool) ([]alignedWord, errorRates) {
+	recWords := werWords(recText, normalise)
+	ediWords := werWords(ediText, normalise)
+	var alignment []alignedWord
+	var wordCounts errorCounts
+	if align {
+		alignment, wordCounts = alignWords(recWords, ediWords)
+	} else {
+		wordCounts = editCounts(recWords, ediWords)
+	}
+	charCounts := editCounts(splitChars(recWords), splitChars(ediWords))
+	return alignment, newErrorRates(wordCounts, charCounts)
+}
+
+// utteranceWER returns the word alignment and error rates of an utterance
+func utteranceWER(w http.ResponseWriter, r *http.Request) {
+	fail := func(status int, msg string) {
+		msg = "utteranceWER: " + msg
+		log.Print(msg)
+		http.Error(w, msg, status)
+	}
+	session, basename, err := sessionFileVars(r)
+	if err != nil {
+		fail(http.StatusBadRequest, err.Error())
+		return
+	}
+	normalise := r.URL.Query().Get("normalise") != "false"
+
+	recText, hasRec, err := readText(session, basename, "rec")
+	if err != nil {
+		fail(http.StatusInternalServerError, fmt.Sprintf("failed to read text file : %v", err))
+		return
+	}
+	ediText, hasEdi, err := readText(session, basename, "edi")
+	if err != nil {
+		fail(http.StatusInternalServerError, fmt.Sprintf("failed to read text file : %v", err))
+		return
+	}
+	if !hasRec || !hasEdi {
+		fail(http.StatusNotFound, fmt.Sprintf("%s/%s needs both a recogniser text (.rec) and an edited text (.edi)", session, basename))
+		return
+	}
+
+	res := utteranceErrorRates{SessionID: session, Basename: basename}
+	if jsonObj, err := store.Metadata(session, basename); err == nil {
+		res.Language = jsonObj.Language
+		res.StartTime = jsonObj.StartTime
+	}
+	res.Alignment, res.errorRates = compareTexts(recText, ediText, normalise, true)
+
+	resJSON, err := rec.PrettyMarshal(res)
+	if err != nil {
+		fail(http.StatusInternalServerError, fmt.Sprintf("failed to create JSON from struct : %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s\n", string(resJSON))
+}
+
+// parseDateParam parses a date (YYYY-MM-DD) or time (RFC 3339). If endOfDay is set, a date is moved to the end of the day.
+func parseDateParam(s string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		if endOfDay {
+			t = t.Add(24*time.Hour - time.Nanosecond)
+		}
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("invalid date '%s' (expected YYYY-MM-DD or RFC 3339)", s)
+	}
+	return t, nil
+}
+
+// reportWER returns the error rates of the utterances with both recogniser and edited text, in total and by session,
+// language and date. The utterances are selected by the URL parameters session (see exportSessionNames), language
+// (comma separated), and from and to (the start time of the utterance, inclusive). With utterances=true, the error
+// rates of each utterance are listed as well.
+func reportWER(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	fail := func(status int, msg string) {
+		msg = "reportWER: " + msg
+		log.Print(msg)
+		http.Error(w, msg, status)
+	}
+	sessions, err := exportSessionNames(r)
+	if err != nil {
+		fail(http.StatusBadRequest, err.Error())
+		return
+	}
+	var languages []string
+	for _, l := range strings.Split(q.Get("language"), ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			languages = append(languages, l)
+		}
+	}
+	var from, to time.Time
+	if q.Get("from") != "" {
+		if from, err = parseDateParam(q.Get("from"), false); err != nil {
+			fail(http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if q.Get("to") != "" {
+		if to, err = parseDateParam(q.Get("to"), true); err != nil {
+			fail(http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	normalise := q.Get("normalise") != "false"
+	listUtterances := q.Get("utterances") == "true"
+
+	res := werReport{
+		BySession:  make(map[string]*aggregateErrorRates),
+		ByLanguage: make(map[string]*aggregateErrorRates),
+		ByDate:     make(map[string]*aggregateErrorRates),
+	}
+	addTo := func(m map[string]*aggregateErrorRates, key string, rates errorRates) {
+		if key == "" {
+			key = "unknown"
+		}
+		if _, ok := m[key]; !ok {
+			m[key] = &aggregateErrorRates{}
+		}
+		m[key].add(rates)
+	}
+	for _, session := range sessions {
+		utts, err := readSessionUtterances(session)
+		if err != nil {
+			fail(http.StatusInternalServerError, err.Error())
+			return
+		}
+		for _, u := range utts {
+			if len(languages) > 0 && !contains(languages, u.Language) {
+				continue
+			}
+			start, err := time.Parse(time.RFC3339, u.StartTime)
+			if err != nil && (!from.IsZero() || !to.IsZero()) {
+				continue
+			}
+			if (!from.IsZero() && start.Before(from)) || (!to.IsZero() && start.After(to)) {
+				continue
+			}
+			if !u.HasRec || !u.HasEdi {
+				res.Skipped++
+				continue
+			}
+
+			_, rates := compareTexts(u.RecText, u.EdiText, normalise, false)
+			res.Total.add(rates)
+			addTo(res.BySession, session, rates)
+			addTo(res.ByLanguage, u.Language, rates)
+			date := ""
+			if err == nil {
+				date = start.UTC().Format("2006-01-02")
+			}
+			addTo(res.ByDate, date, rates)
+			if listUtterances {
+				res.Utterances = append(res.Utterances, utteranceErrorRates{SessionID: session, Basename: u.Basename, Language: u.Language, StartTime: u.StartTime, errorRates: rates})
+			}
+		}
+	}
+	resJSON, err := rec.PrettyMarshal(res)
+	if err != nil {
+		fail(http.StatusInternalServerError, fmt.Sprintf("failed to create JSON from struct : %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s\n", string(resJSON))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestErrorCountsRate(t *testing.T) {
+	tests := []struct {
+		counts errorCounts
+		expect float64
+	}{
+		{errorCounts{}, 0},
+		{errorCounts{Ref: 3}, 0},
+		// empty reference
+		{errorCounts{Ins: 2}, 1},
+		// empty hypothesis
+		{errorCounts{Ref: 2, Del: 2}, 1},
+		// more insertions than reference words
+		{errorCounts{Ref: 2, Ins: 3}, 1.5},
+		{errorCounts{Ref: 4, Sub: 1}, 0.25},
+		{errorCounts{Ref: 4, Sub: 1, Ins: 1, Del: 1}, 0.75},
+	}
+	for _, test := range tests {
+		if res := test.counts.rate(); res != test.expect {
+			t.Errorf("%+v: expected rate %v, got %v", test.counts, test.expect, res)
+		}
+	}
+}
+
+func TestAlignWords(t *testing.T) {
+	tests := []struct {
+		name   string
+		rec    string
+		edi    string
+		ops    string
+		counts errorCounts
+	}{
+		{"both empty", "", "", "", errorCounts{}},
+		{"empty reference", "a b", "", "ins ins", errorCounts{Ins: 2}},
+		{"empty hypothesis", "", "a b", "del del", errorCounts{Ref: 2, Del: 2}},
+		{"identical", "a b c", "a b c", "ok ok ok", errorCounts{Ref: 3}},
+		{"all insertions", "x a y b z", "a b", "ins ok ins ok ins", errorCounts{Ref: 2, Ins: 3}},
+		{"substitution", "a x c", "a b c", "ok sub ok", errorCounts{Ref: 3, Sub: 1}},
+		{"deletion", "a c", "a b c", "ok del ok", errorCounts{Ref: 3, Del: 1}},
+		{"all substitutions", "x y", "a b", "sub sub", errorCounts{Ref: 2, Sub: 2}},
+	}
+	for _, test := range tests {
+		rec, edi := strings.Fields(test.rec), strings.Fields(test.edi)
+		alignment, counts := alignWords(rec, edi)
+		ops := []string{}
+		var recRes, ediRes []string
+		for _, a := range alignment {
+			ops = append(ops, a.Op)
+			if a.Op != "del" {
+				recRes = append(recRes, a.Rec)
+			}
+			if a.Op != "ins" {
+				ediRes = append(ediRes, a.Edi)
+			}
+		}
+		if res := strings.Join(ops, " "); res != test.ops {
+			t.Errorf("%s: expected alignment %q, got %q", test.name, test.ops, res)
+		}
+		if strings.Join(recRes, " ") != test.rec || strings.Join(ediRes, " ") != test.edi {
+			t.Errorf("%s: the alignment doesn't have the words of the texts: %+v", test.name, alignment)
+		}
+		if counts != test.counts {
+			t.Errorf("%s: expected counts %+v, got %+v", test.name, test.counts, counts)
+		}
+		if res := editCounts(rec, edi); res != test.counts {
+			t.Errorf("%s: expected editCounts %+v, got %+v", test.name, test.counts, res)
+		}
+	}
+}
+
+func TestEditCounts(t *testing.T) {
+	// the number of errors is the same as for the full alignment, also where there is more than one minimal alignment
+	tests := []struct{ rec, edi string }{
+		{"a c d", "a b c"},
+		{"kitten", "sitting"},
+		{"flaw", "lawn"},
+		{"intention", "execution"},
+		{"abc", ""},
+		{"", "abc"},
+		{"aaaa", "aa"},
+	}
+	for _, test := range tests {
+		rec, edi := splitChars([]string{test.rec}), splitChars([]string{test.edi})
+		_, expect := alignWords(rec, edi)
+		res := editCounts(rec, edi)
+		if res.Ref != expect.Ref || res.errors() != expect.errors() {
+			t.Errorf("%q/%q: expected %d errors of %d, got %+v", test.rec, test.edi, expect.errors(), expect.Ref, res)
+		}
+	}
+	if res := editCounts(splitChars([]string{"kitten"}), splitChars([]string{"sitting"})); res != (errorCounts{Ref: 7, Sub: 2, Del: 1}) {
+		t.Errorf("kitten/sitting: expected 2 substitutions and 1 deletion, got %+v", res)
+	}
+}
+
+func TestCompareTexts(t *testing.T) {
+	alignment, rates := compareTexts("Hello, world!", "hello world", true, true)
+	if rates.WER != 0 || rates.CER != 0 {
+		t.Errorf("normalised: expected no errors, got %+v", rates)
+	}
+	if len(alignment) != 2 {
+		t.Errorf("normalised: expected alignment of 2 words, got %+v", alignment)
+	}
+
+	alignment, rates = compareTexts("Hello, world!", "hello world", false, false)
+	if alignment != nil {
+		t.Errorf("expected no alignment, got %+v", alignment)
+	}
+	if expect := (errorCounts{Ref: 2, Sub: 2}); rates.Words != expect || rates.WER != 1 {
+		t.Errorf("expected word counts %+v and WER 1, got %+v", expect, rates)
+	}
+	// H -> h, and the inserted , and !
+	if expect := (errorCounts{Ref: 11, Sub: 1, Ins: 2}); rates.Chars != expect {
+		t.Errorf("expected char counts %+v, got %+v", expect, rates.Chars)
+	}
+
+	_, rates = compareTexts("", "", true, false)
+	if rates.WER != 0 || rates.CER != 0 {
+		t.Errorf("empty texts: expected no errors, got %+v", rates)
+	}
+	_, rates = compareTexts("a b", "", true, false)
+	if rates.WER != 1 || rates.CER != 1 {
+		t.Errorf("empty reference: expected error rates 1, got %+v", rates)
+	}
+}